@@ -5,12 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"path"
+	"sync/atomic"
 	"time"
 
 	"github.com/streamingfast/dhammer"
 	"github.com/streamingfast/dstore"
 	"github.com/streamingfast/shutter"
 
+	graphload "github.com/streamingfast/substreams-graph-load"
 	"github.com/streamingfast/substreams-graph-load/bundler/writer"
 
 	"github.com/streamingfast/bstream"
@@ -29,7 +31,12 @@ type Bundler struct {
 	activeBoundary *bstream.Range
 	stopBlock      uint64
 	uploadQueue    *dhammer.Nailer
+	uploadsDone    chan struct{}
 	zlogger        *zap.Logger
+
+	// uploadedUpTo is the exclusive end block of the last boundary that was
+	// fully uploaded to the output store, uploads complete in boundary order.
+	uploadedUpTo atomic.Uint64
 }
 
 var ErrStopBlockReached = errors.New("stop block reached")
@@ -49,17 +56,17 @@ func New(
 		blockCount:     size,
 		stopBlock:      stopBlock,
 		stats:          newStats(),
+		uploadsDone:    make(chan struct{}),
 		zlogger:        zlogger,
 	}
 
 	b.uploadQueue = dhammer.NewNailer(5, b.uploadBoundary, dhammer.NailerLogger(zlogger))
 
-	switch boundaryWriter.Type() {
-	case writer.FileTypeJSONL:
-		b.encoder = JSONLEncode
-	default:
-		return nil, fmt.Errorf("invalid file type %q", boundaryWriter.Type())
+	encoder, err := NewEncoder(boundaryWriter.Type())
+	if err != nil {
+		return nil, err
 	}
+	b.encoder = encoder
 	return b, nil
 }
 
@@ -75,8 +82,10 @@ func (b *Bundler) Launch(ctx context.Context) {
 	b.uploadQueue.Start(ctx)
 
 	go func() {
+		defer close(b.uploadsDone)
 		for v := range b.uploadQueue.Out {
 			bf := v.(*boundaryFile)
+			b.uploadedUpTo.Store(bf.endBlock)
 			b.zlogger.Debug("uploaded file", zap.String("filename", bf.name))
 		}
 		if b.uploadQueue.Err() != nil {
@@ -94,9 +103,21 @@ func (b *Bundler) Close() {
 	b.uploadQueue.Close()
 	b.zlogger.Debug("waiting till queue is drained")
 	b.uploadQueue.WaitUntilEmpty(context.Background())
+	<-b.uploadsDone
 	b.zlogger.Debug("boundary upload completed")
 }
 
+// UploadedUpTo returns the exclusive end block of the last boundary that was
+// fully uploaded to the output store, 0 if nothing was uploaded yet.
+func (b *Bundler) UploadedUpTo() uint64 {
+	return b.uploadedUpTo.Load()
+}
+
+// ActiveBoundary returns the boundary currently being written to, nil if none.
+func (b *Bundler) ActiveBoundary() *bstream.Range {
+	return b.activeBoundary
+}
+
 func (b *Bundler) Roll(ctx context.Context, blockNum uint64) error {
 	if b.activeBoundary.Contains(blockNum) {
 		return nil
@@ -137,6 +158,18 @@ func (b *Bundler) TrackBlockProcessDuration(elapsed time.Duration) {
 	b.stats.addProcessingDataDur(elapsed)
 }
 
+// WriteEntityChange encodes the change in the bundler's file type and writes it to
+// the active boundary.
+func (b *Bundler) WriteEntityChange(change *graphload.EntityChangeAtBlockNum) error {
+	data, err := b.encoder(change)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.boundaryWriter.Write(data)
+	return err
+}
+
 func (b *Bundler) Writer() writer.Writer {
 	return b.boundaryWriter
 }
@@ -167,8 +200,9 @@ func (b *Bundler) stop(ctx context.Context) error {
 		zap.Stringer("boundary", b.activeBoundary),
 	)
 	b.uploadQueue.In <- &boundaryFile{
-		name: b.activeBoundary.String(),
-		file: file,
+		name:     b.activeBoundary.String(),
+		endBlock: *b.activeBoundary.EndBlock(),
+		file:     file,
 	}
 
 	b.activeBoundary = nil
@@ -203,8 +237,9 @@ func computeEndBlock(startBlockNum, size uint64) uint64 {
 }
 
 type boundaryFile struct {
-	name string
-	file writer.Uploadeable
+	name     string
+	endBlock uint64
+	file     writer.Uploadeable
 }
 
 func (b *Bundler) uploadBoundary(ctx context.Context, v interface{}) (interface{}, error) {
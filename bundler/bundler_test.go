@@ -5,6 +5,7 @@ import (
 
 	"github.com/streamingfast/bstream"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBoundary_newBoundary(t *testing.T) {
@@ -86,3 +87,13 @@ func TestBundler_boundariesToSkip(t *testing.T) {
 		})
 	}
 }
+
+func TestBlockRangeFromFilename(t *testing.T) {
+	start, stop, err := BlockRangeFromFilename("pool/0000012000-0000012999.jsonl.gz")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(12000), start)
+	assert.Equal(t, uint64(12999), stop)
+
+	_, _, err = BlockRangeFromFilename("pool/state.json")
+	assert.EqualError(t, err, "no block range in filename: pool/state.json")
+}
@@ -0,0 +1,62 @@
+package bundler
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+)
+
+// ConvertBundle re-encodes the bundle filename read from src in srcType into dest
+// in destType, streaming one entity change at a time. The entity changes, and
+// their order, are preserved.
+func ConvertBundle(ctx context.Context, src dstore.Store, srcType writer.FileType, dest dstore.Store, destType writer.FileType, filename string) error {
+	encoder, err := NewEncoder(destType)
+	if err != nil {
+		return err
+	}
+
+	reader, err := src.OpenObject(ctx, filename)
+	if err != nil {
+		return fmt.Errorf("open %q: %w", filename, err)
+	}
+	defer reader.Close()
+
+	decoder, err := NewDecoder(reader, srcType)
+	if err != nil {
+		return err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		for {
+			change, err := decoder.Decode()
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				pipeWriter.CloseWithError(err)
+				return
+			}
+
+			data, err := encoder(change)
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+
+			if _, err := pipeWriter.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = dest.WriteObject(ctx, filename, pipeReader)
+	pipeReader.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("write %q: %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package bundler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Decoder reads back the entity changes of a bundle file, Decode returns io.EOF
+// once all of them have been read.
+type Decoder interface {
+	Decode() (*graphload.EntityChangeAtBlockNum, error)
+}
+
+func NewDecoder(reader io.Reader, fileType writer.FileType) (Decoder, error) {
+	switch fileType {
+	case writer.FileTypeJSONL:
+		return &jsonlDecoder{reader: bufio.NewReader(reader)}, nil
+	case writer.FileTypeProtobuf:
+		return &protobufDecoder{reader: bufio.NewReader(reader)}, nil
+	}
+
+	return nil, fmt.Errorf("invalid file type %q", fileType)
+}
+
+type jsonlDecoder struct {
+	reader *bufio.Reader
+}
+
+func (d *jsonlDecoder) Decode() (*graphload.EntityChangeAtBlockNum, error) {
+	line, err := d.reader.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("unable to read newline: %w", err)
+	}
+
+	change := &graphload.EntityChangeAtBlockNum{}
+	if err := json.Unmarshal(line, change); err != nil {
+		return nil, fmt.Errorf("unable to decode line: %w", err)
+	}
+	return change, nil
+}
+
+type protobufDecoder struct {
+	reader *bufio.Reader
+	buf    []byte
+}
+
+func (d *protobufDecoder) Decode() (*graphload.EntityChangeAtBlockNum, error) {
+	blockNum, err := binary.ReadUvarint(d.reader)
+	if err != nil {
+		// A clean EOF can only happen before the first byte of a record
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("unable to read block number: %w", err)
+	}
+
+	index, err := binary.ReadUvarint(d.reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read index: %w", unexpectedEOF(err))
+	}
+
+	length, err := binary.ReadUvarint(d.reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read message length: %w", unexpectedEOF(err))
+	}
+
+	if uint64(cap(d.buf)) < length {
+		d.buf = make([]byte, length)
+	}
+	d.buf = d.buf[:length]
+	if _, err := io.ReadFull(d.reader, d.buf); err != nil {
+		return nil, fmt.Errorf("unable to read message: %w", unexpectedEOF(err))
+	}
+
+	entityChange := &pbentity.EntityChange{}
+	if err := proto.Unmarshal(d.buf, entityChange); err != nil {
+		return nil, fmt.Errorf("unable to decode message at block %d: %w", blockNum, err)
+	}
+
+	return &graphload.EntityChangeAtBlockNum{
+		EntityChange: entityChange,
+		BlockNum:     blockNum,
+		Index:        index,
+	}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
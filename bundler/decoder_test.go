@@ -0,0 +1,107 @@
+package bundler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/streamingfast/dstore"
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func testEntityChanges() []*graphload.EntityChangeAtBlockNum {
+	return []*graphload.EntityChangeAtBlockNum{
+		{BlockNum: 12, Index: 0, EntityChange: &pbentity.EntityChange{
+			Entity:    "Pool",
+			Id:        "0xabc",
+			Operation: pbentity.EntityChange_OPERATION_CREATE,
+			Fields: []*pbentity.Field{
+				{Name: "name", NewValue: &pbentity.Value{Typed: &pbentity.Value_String_{String_: "pool"}}},
+				{Name: "count", NewValue: &pbentity.Value{Typed: &pbentity.Value_Int32{Int32: 3}}},
+				{Name: "tags", NewValue: &pbentity.Value{Typed: &pbentity.Value_Array{Array: &pbentity.Array{Value: []*pbentity.Value{
+					{Typed: &pbentity.Value_Bytes{Bytes: "AQID"}},
+				}}}}},
+			},
+		}},
+		{BlockNum: 12, Index: 4, EntityChange: &pbentity.EntityChange{Entity: "Pool", Id: "0xdef", Operation: pbentity.EntityChange_OPERATION_DELETE}},
+		{BlockNum: 300, Index: 1, EntityChange: &pbentity.EntityChange{Entity: "Pool", Id: "0xabc", Operation: pbentity.EntityChange_OPERATION_UPDATE}},
+	}
+}
+
+func encodeAll(t *testing.T, fileType writer.FileType, changes []*graphload.EntityChangeAtBlockNum) []byte {
+	encoder, err := NewEncoder(fileType)
+	require.NoError(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	for _, change := range changes {
+		data, err := encoder(change)
+		require.NoError(t, err)
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func decodeAll(t *testing.T, fileType writer.FileType, reader io.Reader) (out []*graphload.EntityChangeAtBlockNum) {
+	decoder, err := NewDecoder(reader, fileType)
+	require.NoError(t, err)
+
+	for {
+		change, err := decoder.Decode()
+		if err == io.EOF {
+			return out
+		}
+		require.NoError(t, err)
+		out = append(out, change)
+	}
+}
+
+func assertEntityChangesEqual(t *testing.T, expected, actual []*graphload.EntityChangeAtBlockNum) {
+	require.Len(t, actual, len(expected))
+	for i := range expected {
+		assert.Equal(t, expected[i].BlockNum, actual[i].BlockNum)
+		assert.Equal(t, expected[i].Index, actual[i].Index)
+		assert.True(t, proto.Equal(expected[i].EntityChange, actual[i].EntityChange), "expected %s, got %s", expected[i].EntityChange, actual[i].EntityChange)
+	}
+}
+
+func TestDecoder_RoundTrip(t *testing.T) {
+	for _, fileType := range writer.FileTypes {
+		t.Run(string(fileType), func(t *testing.T) {
+			changes := testEntityChanges()
+			assertEntityChangesEqual(t, changes, decodeAll(t, fileType, bytes.NewReader(encodeAll(t, fileType, changes))))
+		})
+	}
+}
+
+func TestDecoder_ProtobufTruncated(t *testing.T) {
+	data := encodeAll(t, writer.FileTypeProtobuf, testEntityChanges()[:1])
+
+	decoder, err := NewDecoder(bytes.NewReader(data[:len(data)-1]), writer.FileTypeProtobuf)
+	require.NoError(t, err)
+
+	_, err = decoder.Decode()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestConvertBundle(t *testing.T) {
+	ctx := context.Background()
+	changes := testEntityChanges()
+
+	src := dstore.NewMockStore(nil)
+	src.SetFile("0000000000-0000000999", encodeAll(t, writer.FileTypeJSONL, changes))
+
+	dest := dstore.NewMockStore(nil)
+	require.NoError(t, ConvertBundle(ctx, src, writer.FileTypeJSONL, dest, writer.FileTypeProtobuf, "0000000000-0000000999"))
+
+	reader, err := dest.OpenObject(ctx, "0000000000-0000000999")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	assertEntityChangesEqual(t, changes, decodeAll(t, writer.FileTypeProtobuf, reader))
+}
@@ -1,16 +1,31 @@
 package bundler
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
 	"google.golang.org/protobuf/proto"
 )
 
-type Encoder func(proto.Message) ([]byte, error)
+// Encoder encodes an entity change as a record of a bundle file.
+type Encoder func(change *graphload.EntityChangeAtBlockNum) ([]byte, error)
 
-func JSONLEncode(message proto.Message) ([]byte, error) {
-	return JSONLEncodeAny(message)
+func NewEncoder(fileType writer.FileType) (Encoder, error) {
+	switch fileType {
+	case writer.FileTypeJSONL:
+		return JSONLEncode, nil
+	case writer.FileTypeProtobuf:
+		return ProtobufEncode, nil
+	}
+
+	return nil, fmt.Errorf("invalid file type %q", fileType)
+}
+
+func JSONLEncode(change *graphload.EntityChangeAtBlockNum) ([]byte, error) {
+	return JSONLEncodeAny(change)
 }
 
 func JSONLEncodeAny(message any) ([]byte, error) {
@@ -23,3 +38,21 @@ func JSONLEncodeAny(message any) ([]byte, error) {
 	buf = append(buf, byte('\n'))
 	return buf, nil
 }
+
+var protobufMarshalOptions = proto.MarshalOptions{Deterministic: true}
+
+// ProtobufEncode encodes the change as the uvarint block number, the uvarint index,
+// then the uvarint length of the `EntityChange` protobuf message followed by the
+// message itself.
+func ProtobufEncode(change *graphload.EntityChangeAtBlockNum) ([]byte, error) {
+	message, err := protobufMarshalOptions.Marshal(change.EntityChange)
+	if err != nil {
+		return nil, fmt.Errorf("proto marshal: %w", err)
+	}
+
+	buf := make([]byte, 0, 3*binary.MaxVarintLen64+len(message))
+	buf = binary.AppendUvarint(buf, change.BlockNum)
+	buf = binary.AppendUvarint(buf, change.Index)
+	buf = binary.AppendUvarint(buf, uint64(len(message)))
+	return append(buf, message...), nil
+}
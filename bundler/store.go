@@ -0,0 +1,64 @@
+package bundler
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
+)
+
+// DetectEntityStore returns a store reading the bundles written for entity in
+// baseURL, along with their file type and compression, detected from the files
+// extension of the first bundle found. A folder without any bundle is assumed to
+// hold gzip compressed JSONL.
+func DetectEntityStore(ctx context.Context, baseURL string, entity string) (dstore.Store, writer.FileType, compression.Type, error) {
+	rawStore, err := dstore.NewStore(baseURL, "", "", false)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	entityStore, err := rawStore.SubStore(entity)
+	if err != nil {
+		return nil, "", "", err
+	}
+	entityURL := entityStore.BaseURL().String()
+
+	fileTypes := make([]string, len(writer.FileTypes))
+	for i, fileType := range writer.FileTypes {
+		fileTypes[i] = string(fileType)
+	}
+
+	fileType, bundleCompression := writer.FileTypeJSONL, compression.Gzip
+	foundFileType, foundCompression, found, err := compression.Detect(ctx, entityURL, fileTypes...)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if found {
+		fileType, bundleCompression = writer.FileType(foundFileType), foundCompression
+	}
+
+	store, err := compression.NewStore(entityURL, string(fileType), bundleCompression, false)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return store, fileType, bundleCompression, nil
+}
+
+var blockRangeRegex = regexp.MustCompile(`(\d{10})-(\d{10})`)
+
+// BlockRangeFromFilename returns the start and stop blocks encoded as
+// `<start>-<stop>` in the name of a bundle or of a CSV file produced from it.
+func BlockRangeFromFilename(filename string) (startBlock, stopBlock uint64, err error) {
+	match := blockRangeRegex.FindStringSubmatch(filename)
+	if match == nil {
+		return 0, 0, fmt.Errorf("no block range in filename: %s", filename)
+	}
+
+	startBlock, _ = strconv.ParseUint(match[1], 10, 64)
+	stopBlock, _ = strconv.ParseUint(match[2], 10, 64)
+	return startBlock, stopBlock, nil
+}
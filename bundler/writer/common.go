@@ -11,8 +11,24 @@ type FileType string
 
 const (
 	FileTypeJSONL FileType = "jsonl"
+	// FileTypeProtobuf holds length-delimited `EntityChange` protobuf messages, each
+	// prefixed by its block number and index within the block.
+	FileTypeProtobuf FileType = "binpb"
 )
 
+// FileTypes lists the supported file types, JSONL being the default one.
+var FileTypes = []FileType{FileTypeJSONL, FileTypeProtobuf}
+
+func ParseFileType(in string) (FileType, error) {
+	for _, fileType := range FileTypes {
+		if FileType(in) == fileType {
+			return fileType, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid file type %q, must be one of %q", in, FileTypes)
+}
+
 type baseWriter struct {
 	fileType FileType
 	zlogger  *zap.Logger
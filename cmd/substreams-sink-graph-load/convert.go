@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	. "github.com/streamingfast/cli"
+	"github.com/streamingfast/cli/sflags"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	"go.uber.org/zap"
+)
+
+var convertCmd = Command(convertE,
+	"convert (--entities|--graphql-schema) <source_folder> <destination_folder>",
+	"Convert the entity bundles written by 'run' to another file type and/or compression",
+	Description(`
+		Re-encode every <source_folder>/<entity> bundle, as well as the poi2$ ones, into
+		<destination_folder>/<entity> using the requested file type, 'jsonl' or 'binpb'
+		(length-delimited protobuf). The file type and compression of the source bundles
+		are detected from their extension.
+
+		Arguments:
+		- <source_folder>: Folder containing one folder per entity with bundles, created with 'run' command.
+		- <destination_folder>: Folder where converted bundles will be written, must differ from <source_folder>.
+	`),
+	ExactArgs(2),
+	Flags(func(flags *pflag.FlagSet) {
+		flags.String("file-type", string(writer.FileTypeProtobuf), "File type of the converted bundles, one of 'jsonl' or 'binpb'")
+		flags.String("compression", "", "Compression of the converted bundles, one of 'none', 'gzip' or 'zstd', same as the source bundles if empty")
+		flags.String("entities", "", "Comma-separated list of entities to convert (alternative to providing the subgraph manifest)")
+		flags.String("graphql-schema", "", "Path to graphql schema to read the list of entities automatically (alternative to setting 'entities' value)")
+	}),
+)
+
+func convertE(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
+	sourceFolder := args[0]
+	destFolder := args[1]
+	if sourceFolder == destFolder {
+		return fmt.Errorf("destination folder must differ from source folder")
+	}
+
+	fileType, err := writer.ParseFileType(sflags.MustGetString(cmd, "file-type"))
+	if err != nil {
+		return err
+	}
+
+	var destCompression *compression.Type
+	if in := sflags.MustGetString(cmd, "compression"); in != "" {
+		t, err := compression.Parse(in)
+		if err != nil {
+			return err
+		}
+		destCompression = &t
+	}
+
+	entities, err := entitiesFromFlags(cmd)
+	if err != nil {
+		return err
+	}
+	entities = append(entities, schema.PoiEntityName)
+
+	for _, entity := range entities {
+		srcStore, srcType, srcCompression, err := bundler.DetectEntityStore(ctx, sourceFolder, entity)
+		if err != nil {
+			return fmt.Errorf("entity %q: %w", entity, err)
+		}
+
+		entityCompression := srcCompression
+		if destCompression != nil {
+			entityCompression = *destCompression
+		}
+
+		baseDestStore, err := compression.NewStore(destFolder, string(fileType), entityCompression, true)
+		if err != nil {
+			return err
+		}
+		destStore, err := baseDestStore.SubStore(entity)
+		if err != nil {
+			return err
+		}
+
+		var filenames []string
+		if err := srcStore.Walk(ctx, "", func(filename string) error {
+			filenames = append(filenames, filename)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("entity %q: unable to walk files: %w", entity, err)
+		}
+
+		for _, filename := range filenames {
+			if err := bundler.ConvertBundle(ctx, srcStore, srcType, destStore, fileType, filename); err != nil {
+				return fmt.Errorf("entity %q: %w", entity, err)
+			}
+		}
+
+		zlog.Info("entity converted",
+			zap.String("entity", entity),
+			zap.Int("file_count", len(filenames)),
+			zap.String("from", string(srcType)+"/"+string(srcCompression)),
+			zap.String("to", string(fileType)+"/"+string(entityCompression)),
+		)
+	}
+
+	return nil
+}
@@ -1,27 +1,56 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
 	"github.com/abourget/llerrgroup"
-	"github.com/jmoiron/sqlx"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	. "github.com/streamingfast/cli"
+	"github.com/streamingfast/cli/sflags"
 	"github.com/streamingfast/substreams-graph-load/postgres"
 	"github.com/streamingfast/substreams-graph-load/schema"
 	"go.uber.org/zap"
-	"os"
-	"strings"
 )
 
 var createIndexesCmd = Command(
 	createIndexesRun,
-	"create-index <deployment-hash|sgdx_schema> <create-indexes-filepath> <psql-dsn> <graphql-schema>",
+	"create-index <deployment> <create-indexes-filepath> <psql-dsn|graph-node-config> <graphql-schema>",
 	"Create all indexes of a database given a schema name or a deployment hash", ExactArgs(4),
-	Flags(func(flags *pflag.FlagSet) {}),
+	Flags(func(flags *pflag.FlagSet) {
+		flags.Bool("concurrently", false, "Create the indexes with CREATE INDEX CONCURRENTLY, slower but without locking the tables against writes")
+		flags.Int("parallel", postgres.MAX_CONNECTIONS, "Number of tables whose indexes are created at the same time, the indexes of a table are created one after the other")
+		flags.Duration("progress-interval", 30*time.Second, "Interval at which the progress of the indexes being built is logged")
+		flags.String("password-file", "", "File holding the Postgres password, for DSNs without one, instead of the pgpass file (PGPASSFILE or ~/.pgpass)")
+	}),
+	Description(`
+		The DDL file holds 'CREATE INDEX' statements separated by ';', possibly spanning
+		several lines, with '--' and '/* */' comments. The statements are rewritten to
+		create the indexes in the schema of the deployment, whatever the schema they
+		were extracted from, and named indexes are created with 'IF NOT EXISTS' so the
+		command can be run again after a failure. Only the indexes of the tables of
+		<graphql-schema> are created.
+
+		The indexes that failed are reported at the end and the command then exits
+		with an error.
+	`),
 )
 
+type createIndexResult struct {
+	table    string
+	index    *postgres.IndexDef
+	duration time.Duration
+	err      error
+}
+
 func createIndexesRun(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
 
@@ -33,34 +62,28 @@ func createIndexesRun(cmd *cobra.Command, args []string) error {
 
 	psqlDSN := args[2]
 	graphqlSchema := args[3]
-	zlog.Debug("psql DSN", zap.String("dsn", psqlDSN))
+	concurrently := sflags.MustGetBool(cmd, "concurrently")
+	parallel := sflags.MustGetInt(cmd, "parallel")
+	if parallel <= 0 {
+		return fmt.Errorf("--parallel must be >0, got %d", parallel)
+	}
 
-	postgresDSN, err := postgres.ParseDSN(psqlDSN)
+	content, err := os.ReadFile(createIndexesFilepath)
 	if err != nil {
-		return fmt.Errorf("invalid postgres DSN %q: %w", psqlDSN, err)
-	}
-
-	var pgSchema string
-	var sqlxDB *sqlx.DB
-	switch {
-	case strings.HasPrefix(schemaOrHash, "sgd"):
-		pgSchema = schemaOrHash
-		zlog.Debug("postgresql schema", zap.String("sgd", pgSchema))
-	case strings.HasPrefix(schemaOrHash, "Qm"):
-		sqlxDB, err = postgres.CreatePostgresDB(ctx, postgresDSN)
-		sqlxDB.SetMaxOpenConns(postgres.MAX_CONNECTIONS)
-		if err != nil {
-			return fmt.Errorf("creating postgres db: %w", err)
-		}
-		pgSchema, err = schema.GetSubgraphSchema(ctx, sqlxDB, schemaOrHash)
-		if err != nil {
-			return fmt.Errorf("unable to retrieve specs: %q", err)
-		}
+		return fmt.Errorf("reading file %s: %w", createIndexesFilepath, err)
+	}
+	indexDefs, err := postgres.ParseIndexDDL(string(content))
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", createIndexesFilepath, err)
+	}
 
-		zlog.Debug("postgresql schema from deployment hash", zap.String("deployment_hash", schemaOrHash), zap.String("sgd", pgSchema))
-	default:
-		return fmt.Errorf("invalid value for first parameter: %q, should be either a postgresql schema (ex: sgd1) or a deployment Qm hash", schemaOrHash)
+	// One connection per table being indexed, one for the progress queries
+	deployment, err := openDeployment(cmd, psqlDSN, schemaOrHash, parallel+1)
+	if err != nil {
+		return err
 	}
+	defer deployment.Close()
+	pool, pgSchema := deployment.Pool, deployment.Schema
 
 	zlog.Debug("graphql schema", zap.String("path", graphqlSchema))
 	graphqlEntities, err := schema.GetEntitiesFromSchema(graphqlSchema)
@@ -73,93 +96,158 @@ func createIndexesRun(cmd *cobra.Command, args []string) error {
 		graphqlSchemaTables[elem.Name] = true
 	}
 
-	var tableName string
-	indexDefs := make(map[string][]string)
-
-	// todo: read createIndexesFilepath and extract create indexes in the indexDefs
-	file, err := os.Open(createIndexesFilepath)
-	if err != nil {
-		return fmt.Errorf("opening file %s: %w", createIndexesFilepath, err)
+	indexesByTable := make(map[string][]*postgres.IndexDef)
+	var tables []string
+	for _, indexDef := range indexDefs {
+		if !graphqlSchemaTables[indexDef.Table] {
+			zlog.Info("skipping index of a table not in the graphql schema", zap.String("table", indexDef.Table), zap.String("index", indexDef.Name))
+			continue
+		}
+		if indexDef.Schema != "" && indexDef.Schema != pgSchema {
+			zlog.Debug("rewriting index schema", zap.String("index", indexDef.Name), zap.String("from", indexDef.Schema), zap.String("to", pgSchema))
+		}
+		if indexesByTable[indexDef.Table] == nil {
+			tables = append(tables, indexDef.Table)
+		}
+		indexesByTable[indexDef.Table] = append(indexesByTable[indexDef.Table], indexDef)
 	}
-	defer file.Close()
+	if len(tables) == 0 {
+		zlog.Info("no indexes to create")
+		return nil
+	}
+
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	go logIndexProgress(progressCtx, pool, pgSchema, sflags.MustGetDuration(cmd, "progress-interval"))
 
-	scanner := bufio.NewScanner(file)
-	// optionally, resize scanner's capacity for lines over 64K, see next example
-	for scanner.Scan() {
-		indexDef := scanner.Text()
-		splitStr := pgSchema + "."
-		indexLineSplit := strings.Split(indexDef, splitStr)[1]
-		tableName = strings.Split(indexLineSplit, " ")[0]
+	var resultsLock sync.Mutex
+	var results []*createIndexResult
 
-		if ok := graphqlSchemaTables[tableName]; ok {
-			indexDefs[tableName] = append(indexDefs[tableName], indexDef)
+	llg := llerrgroup.New(parallel)
+	for _, t := range tables {
+		if llg.Stop() {
+			break
 		}
-	}
+		table := t
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("reading lines from scanner: %w", err)
+		llg.Go(func() error {
+			for _, indexDef := range indexesByTable[table] {
+				result := createIndex(ctx, pool, pgSchema, table, indexDef, concurrently)
+
+				resultsLock.Lock()
+				results = append(results, result)
+				resultsLock.Unlock()
+			}
+			return nil
+		})
 	}
 
-	lenStmt := 0
-	for _, idxDefs := range indexDefs {
-		lenStmt += len(idxDefs)
+	if err := llg.Wait(); err != nil {
+		return err
 	}
+	stopProgress()
 
-	logCh := make(chan string, lenStmt)
-	errCh := make(chan error, lenStmt)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].table < results[j].table })
+	return reportCreatedIndexes(results, len(indexesByTable))
+}
 
-	numOfClients := new(int32)
-	*numOfClients = 0
+func createIndex(ctx context.Context, pool *pgxpool.Pool, pgSchema, table string, indexDef *postgres.IndexDef, concurrently bool) *createIndexResult {
+	statement := indexDef.SQL(pgSchema, concurrently)
+	zlog.Info("creating index", zap.String("table", table), zap.String("index", indexDef.Name))
+	zlog.Debug("create index statement", zap.String("statement", statement))
 
-	llg := llerrgroup.New(postgres.MAX_CONNECTIONS)
+	start := time.Now()
+	_, err := pool.Exec(ctx, statement)
+	result := &createIndexResult{table: table, index: indexDef, duration: time.Since(start), err: err}
 
-	go func() {
-		defer close(logCh)
-		for log := range logCh {
-			zlog.Info(log)
+	if err != nil {
+		zlog.Error("failed to create index", zap.String("table", table), zap.String("index", indexDef.Name), zap.Error(err))
+		if concurrently {
+			// A failed concurrent build leaves an invalid index behind, which 'IF NOT
+			// EXISTS' would then skip
+			zlog.Warn("a failed concurrent build leaves an invalid index, drop it before running the command again", zap.String("index", indexDef.Name))
 		}
-	}()
+	} else {
+		zlog.Info("created index", zap.String("table", table), zap.String("index", indexDef.Name), zap.Duration("elapsed", result.duration))
+	}
+	return result
+}
 
-	go func() {
-		defer close(errCh)
-		for err := range errCh {
-			zlog.Error("creating index", zap.Error(err))
+// logIndexProgress periodically logs the progress of the indexes being built in
+// pgSchema, as reported by Postgres.
+func logIndexProgress(ctx context.Context, pool *pgxpool.Pool, pgSchema string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-	}()
 
-	for t, idxs := range indexDefs {
-		zlog.Info("launching go routine to create indexes", zap.String("table", t))
-		if llg.Stop() {
+		rows, err := pool.Query(ctx, `
+			SELECT t.relname, coalesce(i.relname, ''), p.phase, p.blocks_done, p.blocks_total, p.tuples_done, p.tuples_total
+			FROM pg_stat_progress_create_index p
+			JOIN pg_class t ON t.oid = p.relid
+			JOIN pg_namespace n ON n.oid = t.relnamespace
+			LEFT JOIN pg_class i ON i.oid = p.index_relid
+			WHERE n.nspname = $1
+			ORDER BY t.relname`,
+			pgSchema,
+		)
+		if err != nil {
+			if ctx.Err() == nil {
+				zlog.Warn("unable to read index creation progress", zap.Error(err))
+			}
 			continue
 		}
-		table := t
-		idxDefs := idxs
 
-		llg.Go(func() error {
-			for _, indexDef := range idxDefs {
-				err = createIndex(sqlxDB, indexDef)
-				if err != nil {
-					errCh <- err
-				} else {
-					logCh <- fmt.Sprintf("created index for table %s indexDef %s", table, indexDef)
-				}
+		for rows.Next() {
+			var table, index, phase string
+			var blocksDone, blocksTotal, tuplesDone, tuplesTotal int64
+			if err := rows.Scan(&table, &index, &phase, &blocksDone, &blocksTotal, &tuplesDone, &tuplesTotal); err != nil {
+				zlog.Warn("unable to read index creation progress", zap.Error(err))
+				break
 			}
-			return nil
-		})
+
+			fields := []zap.Field{zap.String("table", table), zap.String("index", index), zap.String("phase", phase)}
+			if blocksTotal > 0 {
+				fields = append(fields, zap.String("blocks", fmt.Sprintf("%d/%d (%.1f%%)", blocksDone, blocksTotal, 100*float64(blocksDone)/float64(blocksTotal))))
+			}
+			if tuplesTotal > 0 {
+				fields = append(fields, zap.String("tuples", fmt.Sprintf("%d/%d (%.1f%%)", tuplesDone, tuplesTotal, 100*float64(tuplesDone)/float64(tuplesTotal))))
+			}
+			zlog.Info("index creation progress", fields...)
+		}
+		rows.Close()
 	}
+}
 
-	if err := llg.Wait(); err != nil {
-		return err
+// reportCreatedIndexes prints the indexes that failed, if any, and returns an error
+// listing them.
+func reportCreatedIndexes(results []*createIndexResult, tableCount int) error {
+	var failed []*createIndexResult
+	for _, result := range results {
+		if result.err != nil {
+			failed = append(failed, result)
+		}
 	}
 
-	return nil
-}
+	zlog.Info("index creation done", zap.Int("tables", tableCount), zap.Int("created", len(results)-len(failed)), zap.Int("failed", len(failed)))
+	if len(failed) == 0 {
+		return nil
+	}
 
-func createIndex(sqlxDB *sqlx.DB, indexDef string) error {
-	rows, err := sqlxDB.Query(indexDef)
-	if rows != nil {
-		defer rows.Close()
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tINDEX\tDURATION\tERROR")
+	names := make([]string, len(failed))
+	for i, result := range failed {
+		names[i] = result.index.Name
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.table, result.index.Name, result.duration.Round(time.Millisecond), result.err)
 	}
+	w.Flush()
 
-	return err
+	return fmt.Errorf("%d of %d indexes failed: %s", len(failed), len(results), strings.Join(names, ", "))
 }
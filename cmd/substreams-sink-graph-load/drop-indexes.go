@@ -2,21 +2,43 @@ package main
 
 import (
 	"fmt"
-	"github.com/jmoiron/sqlx"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	. "github.com/streamingfast/cli"
+	"github.com/streamingfast/cli/sflags"
 	"github.com/streamingfast/substreams-graph-load/postgres"
 	"github.com/streamingfast/substreams-graph-load/schema"
 	"go.uber.org/zap"
-	"strings"
 )
 
 var dropIndexesCmd = Command(
 	dropIndexesRun,
-	"drop-index <deployment-hash|sgdx_schema> <psql-dsn> <graphql-schema>",
+	"drop-index <deployment> <psql-dsn|graph-node-config> <graphql-schema>",
 	"Delete all indexes of a database given a schema name or a deployment hash", ExactArgs(3),
-	Flags(func(flags *pflag.FlagSet) {}),
+	Flags(func(flags *pflag.FlagSet) {
+		flags.Bool("dry-run", false, "Print the DDL of the indexes and the DROP statements without writing the backup nor dropping anything")
+		flags.StringSlice("include", nil, "Only drop the indexes whose name matches one of these glob patterns, like 'attr_*', all of them when empty")
+		flags.StringSlice("exclude", nil, "Never drop the indexes whose name matches one of these glob patterns, on top of the indexes backing a constraint which are never dropped")
+		flags.String("backup-dir", ".", "Folder where the DDL of the dropped indexes is written before dropping them")
+		flags.String("password-file", "", "File holding the Postgres password, for DSNs without one, instead of the pgpass file (PGPASSFILE or ~/.pgpass)")
+	}),
+	Description(`
+		Before dropping anything, the definition of every index about to be dropped is
+		written to '<backup-dir>/<deployment>-<schema>-<timestamp>.ddl', a file that
+		'create-index' accepts as is to create them back. If the backup cannot be
+		written, nothing is dropped.
+
+		Only the indexes of the tables of <graphql-schema> are dropped. Indexes backing
+		a constraint, like the primary key or the exclusion constraint on block_range,
+		are always kept, whatever the --include and --exclude patterns. The command
+		exits with an error if any of them failed to drop.
+	`),
 )
 
 func dropIndexesRun(cmd *cobra.Command, args []string) error {
@@ -25,34 +47,21 @@ func dropIndexesRun(cmd *cobra.Command, args []string) error {
 	schemaOrHash := args[0]
 	psqlDSN := args[1]
 	graphqlSchema := args[2]
-	zlog.Debug("psql DSN", zap.String("dsn", psqlDSN))
-
-	postgresDSN, err := postgres.ParseDSN(psqlDSN)
-	if err != nil {
-		return fmt.Errorf("invalid postgres DSN %q: %w", psqlDSN, err)
-	}
-
-	var pgSchema string
-	var sqlxDB *sqlx.DB
-	switch {
-	case strings.HasPrefix(schemaOrHash, "sgd"):
-		pgSchema = schemaOrHash
-		zlog.Debug("postgresql schema", zap.String("sgd", pgSchema))
-	case strings.HasPrefix(schemaOrHash, "Qm"):
-		sqlxDB, err = postgres.CreatePostgresDB(ctx, postgresDSN)
-		sqlxDB.SetMaxOpenConns(postgres.MAX_CONNECTIONS)
-		if err != nil {
-			return fmt.Errorf("creating postgres db: %w", err)
-		}
-		pgSchema, err = schema.GetSubgraphSchema(ctx, sqlxDB, schemaOrHash)
-		if err != nil {
-			return fmt.Errorf("unable to retrieve specs: %q", err)
+	dryRun := sflags.MustGetBool(cmd, "dry-run")
+	include := sflags.MustGetStringSlice(cmd, "include")
+	exclude := sflags.MustGetStringSlice(cmd, "exclude")
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid index name pattern %q: %w", pattern, err)
 		}
+	}
 
-		zlog.Debug("postgresql schema from deployment hash", zap.String("deployment_hash", schemaOrHash), zap.String("sgd", pgSchema))
-	default:
-		return fmt.Errorf("invalid value for first parameter: %q, should be either a postgresql schema (ex: sgd1) or a deployment Qm hash", schemaOrHash)
+	deployment, err := openDeployment(cmd, psqlDSN, schemaOrHash, 2)
+	if err != nil {
+		return err
 	}
+	defer deployment.Close()
+	pool, pgSchema := deployment.Pool, deployment.Schema
 
 	zlog.Debug("graphql schema", zap.String("path", graphqlSchema))
 	graphqlEntities, err := schema.GetEntitiesFromSchema(graphqlSchema)
@@ -66,66 +75,103 @@ func dropIndexesRun(cmd *cobra.Command, args []string) error {
 		graphqlSchemaTables[elem.Name] = true
 	}
 
-	query := fmt.Sprintf("SELECT tablename, indexname FROM pg_indexes WHERE schemaname = '%s' ORDER BY tablename, indexname;", pgSchema)
-	rows, err := sqlxDB.Query(query)
+	indexes, err := postgres.ListIndexes(ctx, pool, pgSchema)
 	if err != nil {
-		return fmt.Errorf("fetching database index data")
+		return err
 	}
 
-	var tableName string
-	var indexName string
-	indexNames := make(map[string][]string)
-
-	defer rows.Close()
-
-	for rows.Next() {
-		err = rows.Scan(&tableName, &indexName)
-		if err != nil {
-			return fmt.Errorf("scanning row: %w", err)
-		}
-		zlog.Debug("scanned row", zap.String("table_name", tableName), zap.String("index_name", indexName))
+	var candidates []*postgres.Index
+	for _, index := range indexes {
+		zlog.Debug("found index", zap.String("table_name", index.Table), zap.String("index_name", index.Name))
 
 		// only delete indexes for the tables that are part of the schema
-		if ok := graphqlSchemaTables[tableName]; ok {
-			if strings.Contains(indexName, "pkey") || strings.Contains(indexName, "block_range_excl") {
-				continue
-			}
-
-			indexNames[tableName] = append(indexNames[tableName], indexName)
+		if !graphqlSchemaTables[index.Table] {
+			continue
 		}
+		if !indexSelected(index, include, exclude) {
+			zlog.Debug("skipping index", zap.String("table", index.Table), zap.String("idx", index.Name))
+			continue
+		}
+		candidates = append(candidates, index)
 	}
 
-	if len(indexNames) == 0 {
+	if len(candidates) == 0 {
 		zlog.Info("no indexes to delete")
 		return nil
 	}
 
-	err = rows.Err()
-	if err != nil {
-		return fmt.Errorf("scanning rows: %w", err)
+	now := time.Now().UTC()
+	backup := indexesBackup(deployment.Hash, pgSchema, candidates, now)
+	if dryRun {
+		fmt.Print(backup)
+		fmt.Println()
+		for _, candidate := range candidates {
+			fmt.Printf("%s;\n", dropIndexStatement(pgSchema, candidate.Name).String())
+		}
+		return nil
+	}
+
+	backupPath := filepath.Join(sflags.MustGetString(cmd, "backup-dir"), indexesBackupFilename(deployment.Hash, pgSchema, now))
+	if err := os.WriteFile(backupPath, []byte(backup), 0644); err != nil {
+		return fmt.Errorf("writing indexes backup, no index dropped: %w", err)
+	}
+	zlog.Info("indexes backed up", zap.String("path", backupPath), zap.Int("index_count", len(candidates)))
+
+	var failed []string
+	for _, candidate := range candidates {
+		if _, err := dropIndexStatement(pgSchema, candidate.Name).Exec(ctx, pool); err != nil {
+			zlog.Error("failed to drop index", zap.String("table", candidate.Table), zap.String("idx", candidate.Name), zap.Error(err))
+			failed = append(failed, candidate.Name)
+			continue
+		}
+		zlog.Info("dropped index", zap.String("table", candidate.Table), zap.String("idx", candidate.Name))
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d indexes failed to drop: %s", len(failed), len(candidates), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// indexSelected returns true if the index does not back a constraint and its name
+// matches one of the include patterns, or there are none, and none of the exclude
+// patterns. Dropping an index backing a constraint fails, whatever its name.
+func indexSelected(index *postgres.Index, include, exclude []string) bool {
+	if index.Constraint {
+		return false
 	}
 
-	for table, idxNames := range indexNames {
-		for _, idx := range idxNames {
-			// indexes that are part of constraints will not be dropped
-			err := dropIndex(sqlxDB, pgSchema, idx)
-			if err != nil {
-				zlog.Error("failed to drop index", zap.String("table", table), zap.String("idx", idx))
-			} else {
-				zlog.Info("dropped index", zap.String("table", table), zap.String("idx", idx))
+	name := index.Name
+	matchesAny := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			// Patterns were validated, the error can only be path.ErrBadPattern
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
 			}
 		}
+		return false
+	}
 
+	if len(include) > 0 && !matchesAny(include) {
+		return false
 	}
+	return !matchesAny(exclude)
+}
 
-	return nil
+func indexesBackupFilename(deploymentHash, pgSchema string, now time.Time) string {
+	return fmt.Sprintf("%s-%s-%s.ddl", deploymentHash, pgSchema, now.Format("20060102T150405Z"))
 }
 
-func dropIndex(sqlxDB *sqlx.DB, pgSchema string, idx string) error {
-	rows, err := sqlxDB.Query(fmt.Sprintf("DROP INDEX IF EXISTS %s.%s;", pgSchema, idx))
-	if rows != nil {
-		defer rows.Close()
+func indexesBackup(deploymentHash, pgSchema string, candidates []*postgres.Index, now time.Time) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "-- indexes of %s (%s) dropped by 'graphload drop-index' at %s\n", deploymentHash, pgSchema, now.Format(time.RFC3339))
+	for _, candidate := range candidates {
+		sb.WriteString(candidate.Def)
+		sb.WriteString(";\n")
 	}
+	return sb.String()
+}
 
-	return err
+func dropIndexStatement(pgSchema string, idx string) *postgres.Statement {
+	return postgres.NewStatement("DROP INDEX IF EXISTS ").Ident(pgSchema, idx)
 }
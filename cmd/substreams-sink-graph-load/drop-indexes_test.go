@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/streamingfast/substreams-graph-load/postgres"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexSelected(t *testing.T) {
+	pkey := &postgres.Index{Table: "pool", Name: "pool_pkey", Constraint: true}
+	excl := &postgres.Index{Table: "pool", Name: "pool_id_block_range_excl", Constraint: true}
+	attr := &postgres.Index{Table: "pool", Name: "attr_0_1_pool_owner"}
+	foo := &postgres.Index{Table: "pool", Name: "foo_pool"}
+
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		expected map[*postgres.Index]bool
+	}{
+		{"no patterns", nil, nil, map[*postgres.Index]bool{pkey: false, excl: false, attr: true, foo: true}},
+		{"exclude keeps constraints", nil, []string{"foo*"}, map[*postgres.Index]bool{pkey: false, excl: false, attr: true, foo: false}},
+		{"include cannot select constraints", []string{"*pkey", "*excl"}, nil, map[*postgres.Index]bool{pkey: false, excl: false, attr: false, foo: false}},
+		{"include", []string{"attr_*"}, nil, map[*postgres.Index]bool{pkey: false, excl: false, attr: true, foo: false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for index, expected := range test.expected {
+				assert.Equal(t, expected, indexSelected(index, test.include, test.exclude), index.Name)
+			}
+		})
+	}
+}
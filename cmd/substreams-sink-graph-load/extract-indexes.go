@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"github.com/jmoiron/sqlx"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	. "github.com/streamingfast/cli"
@@ -15,11 +14,12 @@ import (
 
 var extractIndexesCmd = Command(
 	extractIndexesRun,
-	"extract-index <deployment-hash|sgdx_schema> <psql-dsn> <graphql-schema>",
+	"extract-index <deployment> <psql-dsn|graph-node-config> <graphql-schema>",
 	"Extract all indexes of a database given a schema name or a deployment hash",
 	ExactArgs(3),
 	Flags(func(flags *pflag.FlagSet) {
 		flags.Bool("save", false, "save contents to a ddl file")
+		flags.String("password-file", "", "File holding the Postgres password, for DSNs without one, instead of the pgpass file (PGPASSFILE or ~/.pgpass)")
 	}),
 )
 
@@ -64,33 +64,12 @@ func extractIndexesRun(cmd *cobra.Command, args []string) error {
 	schemaOrHash := args[0]
 	psqlDSN := args[1]
 	graphqlSchema := args[2]
-	zlog.Debug("psql DSN", zap.String("dsn", psqlDSN))
-
-	postgresDSN, err := postgres.ParseDSN(psqlDSN)
+	deployment, err := openDeployment(cmd, psqlDSN, schemaOrHash, 2)
 	if err != nil {
-		return fmt.Errorf("invalid postgres DSN %q: %w", psqlDSN, err)
-	}
-
-	var pgSchema string
-	var sqlxDB *sqlx.DB
-	switch {
-	case strings.HasPrefix(schemaOrHash, "sgd"):
-		pgSchema = schemaOrHash
-		zlog.Debug("postgresql schema", zap.String("sgd", pgSchema))
-	case strings.HasPrefix(schemaOrHash, "Qm"):
-		sqlxDB, err = postgres.CreatePostgresDB(ctx, postgresDSN)
-		if err != nil {
-			return fmt.Errorf("creating postgres db: %w", err)
-		}
-		pgSchema, err = schema.GetSubgraphSchema(ctx, sqlxDB, schemaOrHash)
-		if err != nil {
-			return fmt.Errorf("unable to retrieve specs: %q", err)
-		}
-
-		zlog.Debug("postgresql schema from deployment hash", zap.String("deployment_hash", schemaOrHash), zap.String("sgd", pgSchema))
-	default:
-		return fmt.Errorf("invalid value for first parameter: %q, should be either a postgresql schema (ex: sgd1) or a deployment Qm hash", schemaOrHash)
+		return err
 	}
+	defer deployment.Close()
+	pgSchema := deployment.Schema
 
 	zlog.Debug("graphql schema", zap.String("path", graphqlSchema))
 	graphqlEntities, err := schema.GetEntitiesFromSchema(graphqlSchema)
@@ -103,39 +82,23 @@ func extractIndexesRun(cmd *cobra.Command, args []string) error {
 		graphqlSchemaTables[elem.Name] = true
 	}
 
-	query := fmt.Sprintf("SELECT tablename, indexname, indexdef FROM pg_indexes WHERE schemaname = '%s' ORDER BY tablename, indexname;", pgSchema)
-	rows, err := sqlxDB.Query(query)
+	indexes, err := postgres.ListIndexes(ctx, deployment.Pool, pgSchema)
 	if err != nil {
-		return fmt.Errorf("fetching database index data")
+		return err
 	}
 
 	databaseIndexData := &DatabaseIndexData{
 		data: make(map[string][]*indexData),
 	}
-	var tableName string
-	var indexName string
-	var indexDef string
-
-	defer rows.Close()
-
-	for rows.Next() {
-		err = rows.Scan(&tableName, &indexName, &indexDef)
-		if err != nil {
-			return fmt.Errorf("scanning row: %w", err)
-		}
-		zlog.Debug("scanned row", zap.String("table_name", tableName), zap.String("index_name", indexName), zap.String("index_def", indexDef))
+	for _, index := range indexes {
+		zlog.Debug("found index", zap.String("table_name", index.Table), zap.String("index_name", index.Name), zap.String("index_def", index.Def))
 
 		// only extract indexes for the tables that are part of the schema
-		if ok := graphqlSchemaTables[tableName]; ok {
-			databaseIndexData.data[tableName] = append(databaseIndexData.data[tableName], &indexData{indexName: indexName, indexDef: indexDef + ";"})
+		if ok := graphqlSchemaTables[index.Table]; ok {
+			databaseIndexData.data[index.Table] = append(databaseIndexData.data[index.Table], &indexData{indexName: index.Name, indexDef: index.Def + ";"})
 		}
 	}
 
-	err = rows.Err()
-	if err != nil {
-		return fmt.Errorf("scanning rows: %w", err)
-	}
-
 	databaseIndexData.PrintOutput()
 
 	if mustGetBool(cmd, "save") {
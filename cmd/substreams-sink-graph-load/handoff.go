@@ -1,79 +1,215 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/jackc/pgx/v4/pgxpool"
-	_ "github.com/lib/pq"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	. "github.com/streamingfast/cli"
+	"github.com/streamingfast/cli/sflags"
 
 	"github.com/streamingfast/substreams-graph-load/postgres"
+	"github.com/streamingfast/substreams-graph-load/sinker"
 	"go.uber.org/zap"
 )
 
 var handoffCmd = Command(handoffE,
-	"handoff <deployment-hash> <block_hash> <block_num> <psql-dsn>",
-	"informs the graph-node instance that the deployment <deployment-hash> has been processed up to a certain block, so you can reassign indexing",
-	ExactArgs(4),
-	Flags(func(flags *pflag.FlagSet) {}),
+	"handoff <deployment> [<block_hash> <block_num>] <psql-dsn|graph-node-config>",
+	"informs the graph-node instance that the deployment <deployment> has been processed up to a certain block, so you can reassign indexing",
+	RangeArgs(2, 4),
+	Flags(func(flags *pflag.FlagSet) {
+		flags.Bool("force", false, "Skip the check that graph-node is not indexing the deployment, that is unassigned or paused")
+		flags.String("last-block-from", "", "Read the block number and hash from the 'last_block.txt' file written by 'run' in this destination folder, instead of the <block_hash> and <block_num> arguments")
+		flags.String("password-file", "", "File holding the Postgres password, for DSNs without one, instead of the pgpass file (PGPASSFILE or ~/.pgpass)")
+	}),
+	Description(`
+		Sets the head block of the deployment to <block_num> and <block_hash>, and its
+		entity count to the number of live entities of its tables, counted from the
+		database. The deployment row is printed before and after the update.
+
+		The graph-node metadata layout is detected from the database: the head block
+		is written to 'subgraphs.subgraph_deployment' for releases storing it there,
+		or to 'subgraphs.head' for later ones. Any other layout is refused.
+	`),
 )
 
 func handoffE(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
 
-	deploymentHash := args[0]
-	if !strings.HasPrefix(deploymentHash, "Qm") {
-		return fmt.Errorf("invalid deployment-hash %q: should start with 'Qm'", deploymentHash)
+	blockNum, blockHash, err := handoffBlock(cmd, args)
+	if err != nil {
+		return err
+	}
+	blockHashBytes, err := hex.DecodeString(blockHash)
+	if err != nil {
+		return fmt.Errorf("invalid block_hash %q: %w", blockHash, err)
 	}
-	blockHash := strings.TrimPrefix(args[1], strings.ToLower("0x"))
-	blockNum, err := strconv.ParseUint(args[2], 10, 64)
+
+	deployment, err := openDeployment(cmd, args[len(args)-1], args[0], 4)
 	if err != nil {
-		return fmt.Errorf("invalid block_num %q: %w", args[2], err)
+		return err
 	}
+	defer deployment.Close()
+	pool, pgSchema, deploymentHash := deployment.Pool, deployment.Schema, deployment.Hash
 
-	psqlDSN := args[3]
-	postgresDSN, err := postgres.ParseDSN(psqlDSN)
+	layout, err := postgres.DetectMetadataLayout(ctx, pool)
 	if err != nil {
-		return fmt.Errorf("invalid postgres DSN %q: %w", psqlDSN, err)
+		return err
 	}
+	zlog.Info("detected graph-node metadata layout", zap.String("layout", layout.Name), zap.String("last_migration", layout.Migration))
 
-	pool, err := pgxpool.Connect(ctx, fmt.Sprintf("%s pool_min_conns=%d pool_max_conns=%d", postgresDSN.DSN(), 2, 3))
+	lock, err := lockDeployment(cmd, deployment)
 	if err != nil {
-		return fmt.Errorf("connecting to postgres: %w", err)
+		return err
 	}
+	defer lock.Release(context.Background())
 
-	query := fmt.Sprintf(`UPDATE subgraphs.subgraph_deployment set latest_ethereum_block_hash='%s',latest_ethereum_block_number=%d,entity_count=%d,firehose_cursor='' where deployment='%s'`,
-		blockHash,
-		blockNum,
-		1000000,
-		deploymentHash)
+	zlog.Info("counting entities", zap.String("deployment", deploymentHash), zap.String("schema", pgSchema))
+	entityCount, err := countEntities(ctx, pool, pgSchema)
+	if err != nil {
+		return fmt.Errorf("counting entities of %q: %w", pgSchema, err)
+	}
 
-	zlog.Info("Setting block latest ethereum block", zap.String("block_hash", blockHash), zap.Uint64("block_num", blockNum), zap.String("deployment", deploymentHash))
+	zlog.Info("setting deployment head block", zap.String("block_hash", blockHash), zap.Uint64("block_num", blockNum), zap.Int64("entity_count", entityCount), zap.String("deployment", deploymentHash))
 
-	conn, err := pool.Acquire(ctx)
+	tx, err := pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("pool acquire: %w", err)
+		return fmt.Errorf("begin transaction: %w", err)
 	}
-	defer conn.Release()
+	defer tx.Rollback(ctx)
 
-	ret := conn.Conn().PgConn().Exec(ctx, query)
-	res, err := ret.ReadAll()
+	before, err := layout.ReadHead(ctx, tx, deploymentHash, true)
 	if err != nil {
 		return err
 	}
 
-	if len(res) != 1 {
-		return fmt.Errorf("invalid return from postgres: expecting single result, got %d", len(res))
+	if err := layout.WriteHead(ctx, tx, deploymentHash, blockHashBytes, blockNum, entityCount); err != nil {
+		return err
+	}
+
+	after, err := layout.ReadHead(ctx, tx, deploymentHash, false)
+	if err != nil {
+		return err
 	}
 
-	if res[0].Err != nil {
-		return res[0].Err
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
 	}
 
-	zlog.Info("complete", zap.Int64("rows_affected", res[0].CommandTag.RowsAffected()))
+	printDeploymentHeads(deploymentHash, before, after)
+	zlog.Info("complete")
 	return nil
 }
+
+// handoffBlock returns the block number and hash, without '0x' prefix, from the
+// arguments or from the 'last_block.txt' file of '--last-block-from'.
+func handoffBlock(cmd *cobra.Command, args []string) (blockNum uint64, blockHash string, err error) {
+	lastBlockFrom := sflags.MustGetString(cmd, "last-block-from")
+	if lastBlockFrom != "" {
+		if len(args) != 2 {
+			return 0, "", fmt.Errorf("the <block_hash> and <block_num> arguments cannot be used with '--last-block-from'")
+		}
+
+		blockNum, blockHash, err = sinker.ReadLastBlock(cmd.Context(), lastBlockFrom)
+		if err != nil {
+			return 0, "", fmt.Errorf("reading last block from %q: %w", lastBlockFrom, err)
+		}
+		zlog.Info("read last block", zap.String("from", lastBlockFrom), zap.Uint64("block_num", blockNum), zap.String("block_hash", blockHash))
+	} else {
+		if len(args) != 4 {
+			return 0, "", fmt.Errorf("missing <block_hash> and <block_num> arguments, or use '--last-block-from'")
+		}
+
+		blockHash = args[1]
+		blockNum, err = strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return 0, "", fmt.Errorf("invalid block_num %q: %w", args[2], err)
+		}
+	}
+
+	return blockNum, strings.TrimPrefix(strings.ToLower(blockHash), "0x"), nil
+}
+
+// countEntities counts the live entities of the deployment the way graph-node does:
+// the rows whose block range is still open for mutable entities, all rows for
+// immutable ones. Tables whose name ends with '$', like 'poi2$', are not entities.
+func countEntities(ctx context.Context, pool *pgxpool.Pool, pgSchema string) (int64, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT table_name, column_name = 'block$'
+		FROM information_schema.columns
+		WHERE table_schema = $1 AND column_name IN ('block_range', 'block$') AND table_name NOT LIKE '%$'
+		ORDER BY table_name`,
+		pgSchema,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("listing tables: %w", err)
+	}
+
+	type entityTable struct {
+		name      string
+		immutable bool
+	}
+	var tables []entityTable
+	for rows.Next() {
+		var table entityTable
+		if err := rows.Scan(&table.name, &table.immutable); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("listing tables: %w", err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("listing tables: %w", err)
+	}
+
+	var total int64
+	for _, table := range tables {
+		query := postgres.NewStatement("SELECT count(*) FROM ").Ident(pgSchema, table.name)
+		if !table.immutable {
+			query.SQL(" WHERE upper_inf(block_range)")
+		}
+
+		var count int64
+		if err := query.QueryRow(ctx, pool).Scan(&count); err != nil {
+			return 0, fmt.Errorf("counting %q: %w", table.name, err)
+		}
+		zlog.Debug("counted entities", zap.String("table", table.name), zap.Int64("count", count))
+		total += count
+	}
+
+	return total, nil
+}
+
+func printDeploymentHeads(deploymentHash string, before, after *postgres.DeploymentHead) {
+	value := func(in *string) string {
+		if in == nil {
+			return "NULL"
+		}
+		if *in == "" {
+			return "''"
+		}
+		if len(*in) > 24 {
+			return (*in)[:24] + "..."
+		}
+		return *in
+	}
+
+	fmt.Printf("\nDeployment %s\n", deploymentHash)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tBLOCK NUMBER\tBLOCK HASH\tENTITY COUNT\tCURSOR")
+	for _, row := range []struct {
+		name string
+		head *postgres.DeploymentHead
+	}{{"before", before}, {"after", after}} {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", row.name, value(row.head.BlockNumber), value(row.head.BlockHash), value(row.head.EntityCount), value(row.head.Cursor))
+	}
+	w.Flush()
+}
@@ -4,207 +4,439 @@ import (
 	"context"
 	"encoding/csv"
 	"fmt"
-	"regexp"
+	"io"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	_ "github.com/lib/pq"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	. "github.com/streamingfast/cli"
+	"github.com/streamingfast/cli/sflags"
 	"github.com/streamingfast/dstore"
 
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/compression"
 	"github.com/streamingfast/substreams-graph-load/postgres"
 	"github.com/streamingfast/substreams-graph-load/schema"
 	"go.uber.org/zap"
 )
 
 var injectCSVCmd = Command(injectCSVE,
-	"inject-csv (deployment-hash|sgdx-schema) <input-path> <entity> <graphql-schema> <psql-dsn> <start-block> <stop-block>",
-	"Injects generated CSV entities for <subgraph-name>'s deployment version <version> into the database pointed by <psql-dsn> argument. Can be run in parallel for multiple entities up to the same stop-block. Watch out, the start-block must be aligned with the range size of the csv files or the module inital block",
-	ExactArgs(7),
-	Flags(func(flags *pflag.FlagSet) {}),
+	"inject-csv <deployment> <input-path> [<entity>] <graphql-schema> <psql-dsn|graph-node-config> <start-block> <stop-block>",
+	"Injects generated CSV entities for <subgraph-name>'s deployment version <version> into the database pointed by <psql-dsn|graph-node-config> argument. A single 'inject-csv' can run per deployment, use '--all-entities' to inject multiple entities concurrently up to the same stop-block. Watch out, the start-block must be aligned with the range size of the csv files or the module inital block",
+	Description(`
+		Each CSV file is recorded as injected in the "progress$" table of the deployment schema,
+		in the same transaction as its COPY. When restarted, files already injected are skipped,
+		use '--reset-progress' to forget them and inject every file again.
+
+		Before loading anything, the CSV header and the field types of <graphql-schema> are
+		checked against the columns of the table, the differences are printed and nothing is
+		injected if there are any.
+
+		With '--all-entities', every entity of <graphql-schema> (poi2$ included) is injected and
+		the <entity> argument is omitted. Files are loaded concurrently, across tables and across
+		the files of a table, using at most '--connections' COPY at a time. A per-table summary
+		is printed at the end and the command fails if any table failed.
+	`),
+	RangeArgs(6, 7),
+	Flags(func(flags *pflag.FlagSet) {
+		flags.Bool("reset-progress", false, "Forget the files recorded as injected for the injected entities and inject all of them")
+		flags.Bool("all-entities", false, "Inject every entity of <graphql-schema>, poi2$ included, instead of the <entity> argument")
+		flags.Bool("force", false, "Skip the check that graph-node is not indexing the deployment, that is unassigned or paused")
+		flags.Int("connections", 4, "Maximum number of COPY running concurrently, each using its own database connection")
+		flags.Duration("progress-interval", 30*time.Second, "Interval at which the injection throughput is logged")
+		flags.String("password-file", "", "File holding the Postgres password, for DSNs without one, instead of the pgpass file (PGPASSFILE or ~/.pgpass)")
+	}),
 )
 
 func injectCSVE(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
 
-	schemaOrHash := args[0]
-
-	inputPath := args[1]
-	entity := args[2]
+	connections := sflags.MustGetInt(cmd, "connections")
+	if connections <= 0 {
+		return fmt.Errorf("--connections must be >0, got %d", connections)
+	}
 
-	graphqlSchema := args[3]
-	psqlDSN := args[4]
-	startBlock, err := strconv.ParseUint(args[5], 10, 64)
+	// Each COPY holds a connection, the extra ones are for the deployment lock and the
+	// progress queries
+	target, err := resolveInjectTarget(cmd, args, connections+3)
 	if err != nil {
-		return fmt.Errorf("invalid start block %q: %w", args[5], err)
+		return err
 	}
-	stopBlock, err := strconv.ParseUint(args[6], 10, 64)
+	defer target.deployment.Close()
+	pool, pgSchema, inputStore, entities := target.deployment.Pool, target.pgSchema, target.inputStore, target.entities
+	startBlock, stopBlock := target.startBlock, target.stopBlock
+
+	lock, err := lockDeployment(cmd, target.deployment)
 	if err != nil {
-		return fmt.Errorf("invalid stop block %q: %w", args[6], err)
+		return err
 	}
+	defer lock.Release(context.Background())
 
-	postgresDSN, err := postgres.ParseDSN(psqlDSN)
-	if err != nil {
-		return fmt.Errorf("invalid postgres DSN %q: %w", psqlDSN, err)
+	copySlots := make(chan struct{}, connections)
+	fillers := make([]*TableFiller, len(entities))
+	for i, ent := range entities {
+		zlog.Debug("table filler", zap.String("pg_schema", pgSchema), zap.String("table_name", ent.Name), zap.Uint64("start_block", startBlock), zap.Uint64("stop_block", stopBlock))
+		fillers[i] = NewTableFiller(pool, pgSchema, ent, startBlock, stopBlock, inputStore, copySlots)
 	}
 
-	var pgSchema string
-	switch {
-	case strings.HasPrefix(schemaOrHash, "sgd"):
-		pgSchema = schemaOrHash
-	case strings.HasPrefix(schemaOrHash, "Qm"):
-		sqlxDB, err := postgres.CreatePostgresDB(ctx, postgresDSN)
-		if err != nil {
-			return fmt.Errorf("creating postgres db: %w", err)
-		}
-		pgSchema, err = schema.GetSubgraphSchema(ctx, sqlxDB, schemaOrHash)
+	t0 := time.Now()
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	go logInjectProgress(progressCtx, fillers, t0, sflags.MustGetDuration(cmd, "progress-interval"))
+
+	resetProgress := sflags.MustGetBool(cmd, "reset-progress")
+	errs := make([]error, len(fillers))
+	var wg sync.WaitGroup
+	for i, filler := range fillers {
+		wg.Add(1)
+		go func(i int, filler *TableFiller) {
+			defer wg.Done()
+
+			if resetProgress {
+				if err := filler.ResetProgress(ctx); err != nil {
+					errs[i] = fmt.Errorf("table filler %q: %w", filler.tblName, err)
+					return
+				}
+			}
+
+			if err := filler.Run(ctx); err != nil {
+				errs[i] = fmt.Errorf("table filler %q: %w", filler.tblName, err)
+				zlog.Error("table failed", zap.String("table", filler.tblName), zap.Error(err))
+			}
+		}(i, filler)
+	}
+	wg.Wait()
+	stopProgress()
+
+	elapsed := time.Since(t0)
+	if len(fillers) > 1 {
+		printInjectSummary(fillers, errs, elapsed)
+	}
+
+	rows, bytes := injectTotals(fillers)
+	zlog.Info("injection done",
+		zap.Duration("total", elapsed),
+		zap.Uint64("rows", rows),
+		zap.Uint64("bytes", bytes),
+		zap.Float64("rows_per_sec", perSecond(float64(rows), elapsed)),
+		zap.Float64("mb_per_sec", perSecond(float64(bytes)/1_000_000, elapsed)),
+	)
+
+	var failed []string
+	for i, err := range errs {
 		if err != nil {
-			return fmt.Errorf("unable to retrieve specs: %q", err)
+			failed = append(failed, fillers[i].tblName)
 		}
-	default:
-		return fmt.Errorf("invalid value for first parameter: %q, should be either a postgresql schema (ex: sgd1) or a deployment Qm hash", schemaOrHash)
 	}
+	switch {
+	case len(failed) == 0:
+		return nil
+	case len(fillers) == 1:
+		return errs[0]
+	}
+	return fmt.Errorf("%d of %d tables failed: %s", len(failed), len(fillers), strings.Join(failed, ", "))
+}
 
-	zlog.Info("connecting to input store")
-	inputStore, err := dstore.NewStore(inputPath, "", "", false)
+// injectTarget is what 'inject-csv' and 'verify-injection' operate on, resolved from
+// their common arguments.
+type injectTarget struct {
+	pgSchema   string
+	deployment *postgres.Deployment
+	inputStore dstore.Store
+	entities   []*schema.EntityDesc
+	startBlock uint64
+	stopBlock  uint64
+}
+
+// resolveInjectTarget resolves the arguments '<deployment> <input-path>
+// [<entity>] <graphql-schema> <psql-dsn|graph-node-config> <start-block> <stop-block>', <entity> being
+// omitted with the '--all-entities' flag. The deployment is opened with a pool of at most
+// maxConns connections and must be closed once done.
+func resolveInjectTarget(cmd *cobra.Command, args []string, maxConns int) (*injectTarget, error) {
+	allEntities := sflags.MustGetBool(cmd, "all-entities")
+	if allEntities && len(args) != 6 {
+		return nil, fmt.Errorf("the <entity> argument cannot be used with '--all-entities'")
+	}
+	if !allEntities && len(args) != 7 {
+		return nil, fmt.Errorf("missing <entity> argument, or use '--all-entities'")
+	}
+
+	schemaOrHash := args[0]
+	inputPath := args[1]
+
+	var entity string
+	rest := args[2:]
+	if !allEntities {
+		entity = rest[0]
+		rest = rest[1:]
+	}
+
+	graphqlSchema := rest[0]
+	psqlDSN := rest[1]
+	startBlock, err := strconv.ParseUint(rest[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start block %q: %w", rest[2], err)
+	}
+	stopBlock, err := strconv.ParseUint(rest[3], 10, 64)
 	if err != nil {
-		return fmt.Errorf("unable to create input store: %w", err)
+		return nil, fmt.Errorf("invalid stop block %q: %w", rest[3], err)
 	}
 
-	pool, err := pgxpool.Connect(ctx, fmt.Sprintf("%s pool_min_conns=%d pool_max_conns=%d", postgresDSN.DSN(), 2, 3))
+	zlog.Info("connecting to input store")
+	inputStore, err := dstore.NewStore(inputPath, "", "", false)
 	if err != nil {
-		return fmt.Errorf("connecting to postgres: %w", err)
+		return nil, fmt.Errorf("unable to create input store: %w", err)
 	}
 
 	graphqlEntities, err := schema.GetEntitiesFromSchema(graphqlSchema)
 	if err != nil {
-		return fmt.Errorf("reading schema from %q: %w", graphqlSchema, err)
+		return nil, fmt.Errorf("reading schema from %q: %w", graphqlSchema, err)
 	}
 
-	nonNullableFields := []string{"id"}
+	var entities []*schema.EntityDesc
 	for _, ent := range graphqlEntities {
-		if ent.Name != entity {
-			continue
+		if allEntities || ent.Name == entity {
+			entities = append(entities, ent)
 		}
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("cannot find entity %q in schema %q", entity, graphqlSchema)
+	}
 
-		for _, f := range ent.Fields {
-			if f.Name == "id" {
-				continue
-			}
-			if f.Name == "block_range" || f.Name == "block$" {
-				nonNullableFields = append(nonNullableFields, f.Name)
-				continue
-			}
-			if !f.Nullable {
-				nonNullableFields = append(nonNullableFields, f.Name)
-			}
-		}
+	deployment, err := openDeployment(cmd, psqlDSN, schemaOrHash, maxConns)
+	if err != nil {
+		return nil, err
 	}
 
-	t0 := time.Now()
+	return &injectTarget{
+		pgSchema:   deployment.Schema,
+		deployment: deployment,
+		inputStore: inputStore,
+		entities:   entities,
+		startBlock: startBlock,
+		stopBlock:  stopBlock,
+	}, nil
+}
 
-	tableName := entity
-	zlog.Debug("table filler", zap.String("pg_schema", pgSchema), zap.String("table_name", tableName), zap.Uint64("start_block", startBlock), zap.Uint64("stop_block", stopBlock))
-	filler := NewTableFiller(pool, pgSchema, tableName, startBlock, stopBlock, nonNullableFields, inputStore)
-	theTableName := tableName
-	if err := filler.Run(ctx); err != nil {
-		return fmt.Errorf("table filler %q: %w", theTableName, err)
+// nonNullableFields returns the columns COPY must not turn into NULL, 'id' and the
+// block columns included.
+func nonNullableFields(ent *schema.EntityDesc) []string {
+	out := []string{"id"}
+	for _, f := range ent.Fields {
+		if f.Name == "id" {
+			continue
+		}
+		if f.Name == "block_range" || f.Name == "block$" {
+			out = append(out, f.Name)
+			continue
+		}
+		if !f.Nullable {
+			out = append(out, f.Name)
+		}
 	}
-
-	zlog.Info("table done", zap.Duration("total", time.Since(t0)))
-	return nil
+	return out
 }
 
 type TableFiller struct {
 	pqSchema          string
 	tblName           string
+	entityDesc        *schema.EntityDesc
 	nonNullableFields []string
 
 	in            dstore.Store
 	startBlockNum uint64
 	stopBlockNum  uint64
 	pool          *pgxpool.Pool
+	copySlots     chan struct{}
+
+	stats tableFillerStats
+}
+
+// tableFillerStats is updated concurrently while the table is filled.
+type tableFillerStats struct {
+	files           atomic.Int64
+	skippedFiles    atomic.Int64
+	injectedFiles   atomic.Int64
+	appliedClosures atomic.Int64
+	rows            atomic.Uint64
+	bytes           atomic.Uint64
 }
 
-func NewTableFiller(pool *pgxpool.Pool, pqSchema, tblName string, startBlockNum, stopBlockNum uint64, nonNullableFields []string, inStore dstore.Store) *TableFiller {
+// NewTableFiller creates the filler of a table, running at most one COPY per slot
+// of copySlots at a time, the slots being shared with the fillers of other tables.
+func NewTableFiller(pool *pgxpool.Pool, pqSchema string, entityDesc *schema.EntityDesc, startBlockNum, stopBlockNum uint64, inStore dstore.Store, copySlots chan struct{}) *TableFiller {
 	return &TableFiller{
-		tblName:           tblName,
+		tblName:           entityDesc.Name,
 		pqSchema:          pqSchema,
+		entityDesc:        entityDesc,
 		pool:              pool,
-		nonNullableFields: nonNullableFields,
+		nonNullableFields: nonNullableFields(entityDesc),
 		startBlockNum:     startBlockNum,
 		stopBlockNum:      stopBlockNum,
 		in:                inStore,
+		copySlots:         copySlots,
+	}
+}
+
+// checkColumns compares the CSV header and the types of the GraphQL schema with the
+// columns of the table, printing their differences and failing if there are any.
+func (t *TableFiller) checkColumns(ctx context.Context, header []string) error {
+	query := `
+	SELECT column_name, data_type, udt_name, column_default IS NOT NULL OR is_identity = 'YES'
+	FROM information_schema.columns
+	WHERE table_schema = $1 AND table_name = $2
+	ORDER BY ordinal_position`
+	rows, err := t.pool.Query(ctx, query, t.pqSchema, t.tblName)
+	if err != nil {
+		return fmt.Errorf("querying columns of table %s.%s: %w", t.pqSchema, t.tblName, err)
+	}
+	defer rows.Close()
+
+	var columns []*schema.TableColumn
+	for rows.Next() {
+		col := &schema.TableColumn{}
+		if err := rows.Scan(&col.Name, &col.DataType, &col.UDTName, &col.HasDefault); err != nil {
+			return fmt.Errorf("unable to retrieve result row: %w", err)
+		}
+		columns = append(columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("querying columns of table %s.%s: %w", t.pqSchema, t.tblName, err)
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("table %s.%s does not exist", t.pqSchema, t.tblName)
+	}
+
+	diff := schema.DiffColumns(t.entityDesc, header, columns)
+	if diff.Empty() {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Columns of table %s.%s do not match its CSV files and GraphQL schema:\n%s", t.pqSchema, t.tblName, diff)
+	return fmt.Errorf("columns of table %s.%s do not match, %d missing from table, %d missing from CSV files, %d mistyped", t.pqSchema, t.tblName, len(diff.Missing), len(diff.Extra), len(diff.Mistyped))
+}
+
+// progressTable records, per table, the CSV files already injected. Each file is
+// recorded in the transaction of its COPY so an interrupted injection resumes from
+// the first file that was not committed.
+const progressTable = "progress$"
+
+func (t *TableFiller) setupProgress(ctx context.Context) error {
+	conn, err := t.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to acquire conn: %w", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Serializes the creation of the table between the fillers of the entities injected
+	// concurrently with '--all-entities', CREATE TABLE IF NOT EXISTS is not safe against
+	// concurrent creations
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1, hashtext($2))", postgres.AdvisoryLockProgressTable, postgres.QuoteIdentifier(t.pqSchema, progressTable)); err != nil {
+		return fmt.Errorf("locking progress table: %w", err)
+	}
+
+	query := postgres.NewStatement("CREATE TABLE IF NOT EXISTS ").Ident(t.pqSchema, progressTable).SQL(` (
+		table_name text NOT NULL,
+		filename text NOT NULL,
+		row_count bigint NOT NULL,
+		injected_at timestamptz NOT NULL,
+		PRIMARY KEY (table_name, filename)
+	)`)
+	if _, err := query.Exec(ctx, tx); err != nil {
+		return fmt.Errorf("creating progress table: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ResetProgress forgets the files recorded as injected for the table, they are all
+// injected again by the next run.
+func (t *TableFiller) ResetProgress(ctx context.Context) error {
+	if err := t.setupProgress(ctx); err != nil {
+		return err
+	}
+
+	query := postgres.NewStatement("DELETE FROM ").Ident(t.pqSchema, progressTable).SQL(" WHERE table_name = ").Bind(t.tblName)
+	tag, err := query.Exec(ctx, t.pool)
+	if err != nil {
+		return fmt.Errorf("resetting progress: %w", err)
+	}
+
+	zlog.Info("progress reset", zap.String("table", t.tblName), zap.Int64("forgotten_file_count", tag.RowsAffected()))
+	return nil
+}
+
+// pruneFiles returns the filenames not recorded as injected yet, in their original order.
+func (t *TableFiller) pruneFiles(ctx context.Context, filenames []string) (out []string, err error) {
+	query := postgres.NewStatement("SELECT filename FROM ").Ident(t.pqSchema, progressTable).SQL(" WHERE table_name = ").Bind(t.tblName)
+	rows, err := query.Query(ctx, t.pool)
+	if err != nil {
+		return nil, fmt.Errorf("querying progress: %w", err)
+	}
+	defer rows.Close()
+
+	injected := map[string]bool{}
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, fmt.Errorf("unable to retrieve result row: %w", err)
+		}
+		injected[filename] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("querying progress: %w", err)
 	}
+
+	for _, filename := range filenames {
+		if !injected[filename] {
+			out = append(out, filename)
+		}
+	}
+	return out, nil
 }
 
-type sortedFilenames []string
-
-func (p sortedFilenames) Len() int           { return len(p) }
-func (p sortedFilenames) Less(i, j int) bool { return p[i] > p[j] }
-func (p sortedFilenames) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
-
-//func (t *TblShard) pruneFiles(ctx context.Context, filenames []string) (out sortedFilenames, err error) {
-//	conn, err := t.pool.Acquire(ctx)
-//	if err != nil {
-//		return nil, fmt.Errorf("unable to acquire conn: %w", err)
-//	}
-//	defer conn.Release()
-//	filesToPrune := map[string]bool{}
-//	for _, filename := range filenames {
-//		filesToPrune[filename] = true
-//	}
-//
-//	result, err := conn.Query(ctx, fmt.Sprintf("SELECT * FROM %s.progress$ WHERE (table_name=$1)", t.pqSchema), t.tblName)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	for result.Next() {
-//		values, err := result.Values()
-//		if err != nil {
-//			return nil, fmt.Errorf("unable to retrieve result row: %w", err)
-//		}
-//		injectedFilename := values[0].(string)
-//		if _, found := filesToPrune[injectedFilename]; found {
-//			delete(filesToPrune, injectedFilename)
-//		}
-//	}
-//	for filename := range filesToPrune {
-//		out = append(out, filename)
-//	}
-//	sort.Sort(out)
-//	return out, nil
-//}
-
-//func (t *TableFiller) markProgress(ctx context.Context, filename string, timestamp time.Time) error {
-//	conn, err := t.pool.Acquire(ctx)
-//	if err != nil {
-//		return fmt.Errorf("unable to acquire conn: %w", err)
-//	}
-//	defer conn.Release()
-//
-//	query := fmt.Sprintf("INSERT INTO %s.progress$ (filename, table_name, injected_at) VALUES ($1, $2, $3)", t.pqSchema)
-//	_, err = conn.Exec(ctx, query, filename, t.tblName, timestamp)
-//	if err != nil {
-//		return err
-//	}
-//	return nil
-//}
+func (t *TableFiller) markProgress(ctx context.Context, tx pgx.Tx, filename string, rowCount int64) error {
+	query := postgres.NewStatement("INSERT INTO ").Ident(t.pqSchema, progressTable).
+		SQL(" (table_name, filename, row_count, injected_at) VALUES (").
+		Bind(t.tblName).SQL(", ").Bind(filename).SQL(", ").Bind(rowCount).SQL(", now())")
+	if _, err := query.Exec(ctx, tx); err != nil {
+		return fmt.Errorf("marking progress of %q: %w", filename, err)
+	}
+	return nil
+}
 
 func s(str string) *string {
 	return &str
 }
 
-func extractFieldsFromFirstLine(ctx context.Context, filename string, store dstore.Store) ([]string, error) {
+// openCSV opens filename from store, decompressing it according to its extension.
+func openCSV(ctx context.Context, filename string, store dstore.Store) (io.ReadCloser, error) {
 	fl, err := store.OpenObject(ctx, filename)
 	if err != nil {
 		return nil, fmt.Errorf("opening csv: %w", err)
 	}
+
+	return compression.NewReader(fl, compression.FromFilename(filename))
+}
+
+func extractFieldsFromFirstLine(ctx context.Context, filename string, store dstore.Store) ([]string, error) {
+	fl, err := openCSV(ctx, filename, store)
+	if err != nil {
+		return nil, err
+	}
 	defer fl.Close()
 
 	r := csv.NewReader(fl)
@@ -239,43 +471,146 @@ func (t *TableFiller) Run(ctx context.Context) error {
 		return fmt.Errorf("extracting fields from first csv line: %w", err)
 	}
 
-	//prunedFilenames, err := t.pruneFiles(ctx, loadFiles)
-	//if err != nil {
-	//	return fmt.Errorf("unable to prune filename list: %w", err)
-	//}
+	if err := t.checkColumns(ctx, dbFields); err != nil {
+		return err
+	}
+
+	if err := t.setupProgress(ctx); err != nil {
+		return err
+	}
+
+	prunedFilenames, err := t.pruneFiles(ctx, loadFiles)
+	if err != nil {
+		return fmt.Errorf("unable to prune filename list: %w", err)
+	}
+
+	closureFiles, err := closureFilesToApply(t.in, t.tblName, t.stopBlockNum, t.startBlockNum)
+	if err != nil {
+		return fmt.Errorf("listing closure files: %w", err)
+	}
+	prunedClosureFiles, err := t.pruneFiles(ctx, closureFiles)
+	if err != nil {
+		return fmt.Errorf("unable to prune closure filename list: %w", err)
+	}
 
 	zlog.Info("files to load",
 		zap.String("table", t.tblName),
 		zap.Int("file_count", len(loadFiles)),
-		//		zap.Int("pruned_file_count", len(prunedFilenames)),
+		zap.Int("already_injected_file_count", len(loadFiles)-len(prunedFilenames)),
+		zap.Int("closure_file_count", len(closureFiles)),
+		zap.Int("already_applied_closure_file_count", len(closureFiles)-len(prunedClosureFiles)),
 	)
-	prunedFilenames := loadFiles
-
+	closureFiles = prunedClosureFiles
+	t.stats.files.Store(int64(len(loadFiles)))
+	t.stats.skippedFiles.Store(int64(len(loadFiles) - len(prunedFilenames)))
+
+	// Closures of an incremental 'tocsv' run close rows exported by the previous one
+	// and must be applied once the rows before their range are loaded and before
+	// loading the rows of their own range, the files in between are loaded concurrently.
+	var batch []string
 	for _, filename := range prunedFilenames {
-		zlog.Info("opening file", zap.String("file", filename))
+		fileStartBlock, _, err := bundler.BlockRangeFromFilename(filename)
+		if err != nil {
+			return err
+		}
+		for len(closureFiles) > 0 {
+			closureStartBlock, _, err := bundler.BlockRangeFromFilename(closureFiles[0])
+			if err != nil {
+				return err
+			}
+			if closureStartBlock > fileStartBlock {
+				break
+			}
+
+			if err := t.injectFiles(ctx, batch, dbFields); err != nil {
+				return err
+			}
+			batch = nil
 
-		if err := t.injectFile(ctx, filename, dbFields, t.nonNullableFields); err != nil {
-			return fmt.Errorf("failed to inject file %q: %w", filename, err)
+			if err := t.applyClosures(ctx, closureFiles[0]); err != nil {
+				return fmt.Errorf("failed to apply closures %q: %w", closureFiles[0], err)
+			}
+			closureFiles = closureFiles[1:]
 		}
 
-		// FIXME: set up a way to mark progress
-		//
-		//if err := t.markProgress(ctx, filename, time.Now()); err != nil {
-		//	return fmt.Errorf("failed to mark progress file %q: %w", filename, err)
-		//}
+		batch = append(batch, filename)
+	}
+	if err := t.injectFiles(ctx, batch, dbFields); err != nil {
+		return err
+	}
+
+	// Closures whose range has no file left to load, resuming after they were written
+	for _, filename := range closureFiles {
+		if err := t.applyClosures(ctx, filename); err != nil {
+			return fmt.Errorf("failed to apply closures %q: %w", filename, err)
+		}
 	}
 
 	return nil
 }
 
+// injectFiles loads the files concurrently, each one once a COPY slot is available,
+// and stops at the first failure.
+func (t *TableFiller) injectFiles(ctx context.Context, filenames []string, dbFields []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var firstErr error
+	setErr := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	for _, filename := range filenames {
+		if err := t.acquireSlot(ctx); err != nil {
+			setErr(err)
+			break
+		}
+
+		wg.Add(1)
+		go func(filename string) {
+			defer wg.Done()
+			defer t.releaseSlot()
+
+			zlog.Info("opening file", zap.String("file", filename))
+			if err := t.injectFile(ctx, filename, dbFields, t.nonNullableFields); err != nil {
+				setErr(fmt.Errorf("failed to inject file %q: %w", filename, err))
+			}
+		}(filename)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+func (t *TableFiller) acquireSlot(ctx context.Context) error {
+	select {
+	case t.copySlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *TableFiller) releaseSlot() {
+	<-t.copySlots
+}
+
 func (t *TableFiller) injectFile(ctx context.Context, filename string, dbFields, nonNullableFields []string) error {
-	fl, err := t.in.OpenObject(ctx, filename)
+	fl, err := openCSV(ctx, filename, t.in)
 	if err != nil {
-		return fmt.Errorf("opening csv: %w", err)
+		return err
 	}
 	defer fl.Close()
+	in := &countingReader{Reader: fl}
 
-	query := fmt.Sprintf(`COPY %s.%s ("%s") FROM STDIN WITH (FORMAT CSV, HEADER, FORCE_NOT_NULL ("%s"))`, t.pqSchema, t.tblName, strings.Join(dbFields, `","`), strings.Join(nonNullableFields, `","`))
+	query := postgres.CopyFromCSV(t.pqSchema, t.tblName, dbFields, nonNullableFields)
 	zlog.Info("loading file into sql", zap.String("filename", filename), zap.String("table_name", t.tblName), zap.Strings("db_fields", dbFields), zap.Strings("non_nullable_fields", nonNullableFields))
 
 	t0 := time.Now()
@@ -286,25 +621,132 @@ func (t *TableFiller) injectFile(ctx context.Context, filename string, dbFields,
 	}
 	defer conn.Release()
 
-	tag, err := conn.Conn().PgConn().CopyFrom(ctx, fl, query)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Conn().PgConn().CopyFrom(ctx, in, query.String())
 	if err != nil {
 		return fmt.Errorf("failed COPY FROM for %q: %w", t.tblName, err)
 	}
 	count := tag.RowsAffected()
+
+	if err := t.markProgress(ctx, tx, filename, count); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("committing COPY FROM for %q: %w", t.tblName, err)
+	}
+	t.stats.injectedFiles.Add(1)
+	t.stats.rows.Add(uint64(count))
+	t.stats.bytes.Add(in.count)
+
 	elapsed := time.Since(t0)
 	zlog.Info("loaded file into sql",
 		zap.String("filename", filename),
 		zap.String("table_name", t.tblName),
 		zap.Int64("rows_affected", count),
+		zap.Uint64("bytes", in.count),
 		zap.Duration("elapsed", elapsed),
 	)
 
 	return nil
 }
 
+// applyClosures ends the block range of the open rows listed in filename, written
+// by an incremental 'tocsv' run for the rows exported as open by the previous run.
+func (t *TableFiller) applyClosures(ctx context.Context, filename string) error {
+	fl, err := openCSV(ctx, filename, t.in)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+
+	if err := t.acquireSlot(ctx); err != nil {
+		return err
+	}
+	defer t.releaseSlot()
+
+	t0 := time.Now()
+
+	conn, err := t.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("pool acquire: %w", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	createQuery := postgres.NewStatement(`CREATE TEMPORARY TABLE "closures$" ON COMMIT DROP AS SELECT id, 0 AS "lower", 0 AS "upper" FROM `).
+		Ident(t.pqSchema, t.tblName).
+		SQL(" WITH NO DATA")
+	if _, err := createQuery.Exec(ctx, tx); err != nil {
+		return fmt.Errorf("creating closures table: %w", err)
+	}
+
+	copyTag, err := tx.Conn().PgConn().CopyFrom(ctx, fl, `COPY "closures$" (id, "lower", "upper") FROM STDIN WITH (FORMAT CSV, HEADER)`)
+	if err != nil {
+		return fmt.Errorf("failed COPY FROM for closures: %w", err)
+	}
+
+	updateQuery := postgres.NewStatement("UPDATE ").
+		Ident(t.pqSchema, t.tblName).
+		SQL(` t SET block_range = int4range(lower(t.block_range), c."upper") FROM "closures$" c WHERE t.id = c.id AND lower(t.block_range) = c."lower" AND upper_inf(t.block_range)`)
+	updateTag, err := updateQuery.Exec(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("closing rows: %w", err)
+	}
+	if updateTag.RowsAffected() != copyTag.RowsAffected() {
+		return fmt.Errorf("closed %d rows but %q lists %d, was the previous range injected?", updateTag.RowsAffected(), filename, copyTag.RowsAffected())
+	}
+
+	if err := t.markProgress(ctx, tx, filename, updateTag.RowsAffected()); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("committing closures: %w", err)
+	}
+	t.stats.appliedClosures.Add(1)
+
+	zlog.Info("applied closures",
+		zap.String("filename", filename),
+		zap.String("table_name", t.tblName),
+		zap.Int64("rows_affected", updateTag.RowsAffected()),
+		zap.Duration("elapsed", time.Since(t0)),
+	)
+	return nil
+}
+
+// closureFilesToApply lists the closure files of tableName written by incremental
+// 'tocsv' runs starting in [startBlockNum, stopBlockNum).
+func closureFilesToApply(inputStore dstore.Store, tableName string, stopBlockNum, startBlockNum uint64) (out []string, err error) {
+	files, err := injectFilesToLoad(inputStore, "closures/"+tableName, stopBlockNum, startBlockNum)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, filename := range files {
+		fileStartBlock, _, err := bundler.BlockRangeFromFilename(filename)
+		if err != nil {
+			return nil, err
+		}
+		if fileStartBlock >= startBlockNum {
+			out = append(out, filename)
+		}
+	}
+	return out, nil
+}
+
 func injectFilesToLoad(inputStore dstore.Store, tableName string, stopBlockNum, desiredStartBlockNum uint64) (out []string, err error) {
 	err = inputStore.Walk(context.Background(), tableName+"/", func(filename string) (err error) {
-		startBlockNum, endBlockNum, err := getBlockRange(filename)
+		startBlockNum, endBlockNum, err := bundler.BlockRangeFromFilename(filename)
 		if err != nil {
 			return fmt.Errorf("fail reading block range in %q: %w", filename, err)
 		}
@@ -326,15 +768,100 @@ func injectFilesToLoad(inputStore dstore.Store, tableName string, stopBlockNum,
 	return
 }
 
-var blockRangeRegex = regexp.MustCompile(`(\d{10})-(\d{10})`)
+type countingReader struct {
+	io.Reader
+	count uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += uint64(n)
+	return n, err
+}
+
+func injectTotals(fillers []*TableFiller) (rows, bytes uint64) {
+	for _, filler := range fillers {
+		rows += filler.stats.rows.Load()
+		bytes += filler.stats.bytes.Load()
+	}
+	return
+}
+
+func perSecond(value float64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return value / elapsed.Seconds()
+}
+
+// logInjectProgress logs the aggregate throughput of the fillers every interval
+// until ctx is done. Rows and bytes are counted once their file is committed.
+func logInjectProgress(ctx context.Context, fillers []*TableFiller, startedAt time.Time, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var files, doneFiles int64
+		for _, filler := range fillers {
+			files += filler.stats.files.Load()
+			doneFiles += filler.stats.skippedFiles.Load() + filler.stats.injectedFiles.Load()
+		}
 
-func getBlockRange(filename string) (uint64, uint64, error) {
-	match := blockRangeRegex.FindStringSubmatch(filename)
-	if match == nil {
-		return 0, 0, fmt.Errorf("no block range in filename: %s", filename)
+		rows, bytes := injectTotals(fillers)
+		elapsed := time.Since(startedAt)
+		zlog.Info("injection progress",
+			zap.Int64("done_files", doneFiles),
+			zap.Int64("files", files),
+			zap.Uint64("rows", rows),
+			zap.Uint64("bytes", bytes),
+			zap.Float64("rows_per_sec", perSecond(float64(rows), elapsed)),
+			zap.Float64("mb_per_sec", perSecond(float64(bytes)/1_000_000, elapsed)),
+			zap.Duration("elapsed", elapsed),
+		)
 	}
+}
+
+func printInjectSummary(fillers []*TableFiller, errs []error, elapsed time.Duration) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tSTATUS\tFILES\tSKIPPED\tINJECTED\tCLOSURES\tROWS\tMB\tERROR")
+	for i, filler := range fillers {
+		status, errMessage := "ok", ""
+		if errs[i] != nil {
+			status, errMessage = "failed", errs[i].Error()
+		}
 
-	startBlock, _ := strconv.ParseUint(match[1], 10, 64)
-	stopBlock, _ := strconv.ParseUint(match[2], 10, 64)
-	return startBlock, stopBlock, nil
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%.1f\t%s\n",
+			filler.tblName,
+			status,
+			filler.stats.files.Load(),
+			filler.stats.skippedFiles.Load(),
+			filler.stats.injectedFiles.Load(),
+			filler.stats.appliedClosures.Load(),
+			filler.stats.rows.Load(),
+			float64(filler.stats.bytes.Load())/1_000_000,
+			errMessage,
+		)
+	}
+
+	rows, bytes := injectTotals(fillers)
+	fmt.Fprintf(w, "TOTAL\t\t\t\t\t\t%d\t%.1f\t\n", rows, float64(bytes)/1_000_000)
+	w.Flush()
+
+	fmt.Printf("\nInjected %d rows (%.1f MB) in %s, %.0f rows/s, %.1f MB/s\n",
+		rows,
+		float64(bytes)/1_000_000,
+		elapsed.Round(time.Second),
+		perSecond(float64(rows), elapsed),
+		perSecond(float64(bytes)/1_000_000, elapsed),
+	)
 }
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"strings"
 
-	_ "github.com/lib/pq"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	. "github.com/streamingfast/cli"
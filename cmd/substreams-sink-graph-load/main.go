@@ -28,11 +28,16 @@ func main() {
 		SinkRunCmd,
 		injectCSVCmd,
 		toCSVCmd,
+		poiCmd,
+		convertCmd,
 		handoffCmd,
 		listEntitiesCmd,
 		extractIndexesCmd,
 		createIndexesCmd,
 		dropIndexesCmd,
+		verifyInjectionCmd,
+		pipelineCmd,
+		prepareCmd,
 
 		ConfigureViper("SINK_GRAPHCSV"),
 		ConfigureVersion(version),
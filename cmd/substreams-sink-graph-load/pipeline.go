@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	. "github.com/streamingfast/cli"
+	"github.com/streamingfast/cli/sflags"
+	"go.uber.org/zap"
+
+	"github.com/streamingfast/substreams-graph-load/pipeline"
+	"github.com/streamingfast/substreams-graph-load/postgres"
+)
+
+var pipelineCmd = Command(pipelineE,
+	"pipeline <job-config>",
+	"Runs all the phases of a load, as configured by the YAML <job-config>, resuming at the first phase not completed",
+	ExactArgs(1),
+	Flags(func(flags *pflag.FlagSet) {
+		flags.String("state-file", "", "File recording the completed phases, defaults to '<job-config>.state.json'")
+		flags.String("from-phase", "", "Run this phase and all the following ones, even if already completed")
+		flags.String("only-phase", "", "Run only this phase, even if already completed")
+		flags.Bool("reset-state", false, "Forget the completed phases, required to run the pipeline again after <job-config> changed")
+		flags.Bool("dry-run", false, "Print the commands of the phases to run, without running them")
+	}),
+	Description(`
+		The phases are, in order: run, tocsv, drop-index, inject-csv, handoff and create-index.
+		Each of them runs the graphload command of the same name, with the arguments
+		derived from <job-config>. A phase can be excluded with 'skip: true' in its
+		section of <job-config>, and extra flags passed to its command with 'flags'.
+
+		The completion of each phase is recorded in the state file. When a phase fails,
+		running the pipeline again resumes at that phase. Phases can be rerun with
+		--from-phase or --only-phase.
+	`),
+)
+
+func pipelineE(cmd *cobra.Command, args []string) error {
+	configFile := args[0]
+	config, err := pipeline.LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	stateFile := sflags.MustGetString(cmd, "state-file")
+	if stateFile == "" {
+		stateFile = configFile + ".state.json"
+	}
+
+	fromPhase, onlyPhase, err := pipelinePhaseFlags(cmd)
+	if err != nil {
+		return err
+	}
+
+	state, err := pipeline.LoadState(stateFile)
+	if err != nil {
+		return err
+	}
+	if state == nil || sflags.MustGetBool(cmd, "reset-state") {
+		state = pipeline.NewState(config)
+	}
+	if state.ConfigDigest != config.Digest() {
+		return fmt.Errorf("job config %q changed since the phases recorded in %q were completed, use --reset-state to run the pipeline with the new config", configFile, stateFile)
+	}
+
+	if onlyPhase != "" && config.Skipped(onlyPhase) {
+		return fmt.Errorf("phase %q is skipped by job config %q", onlyPhase, configFile)
+	}
+
+	phases := pipeline.SelectPhases(config, state, fromPhase, onlyPhase)
+	if len(phases) == 0 {
+		zlog.Info("no phase to run, all completed", zap.String("state_file", stateFile))
+		return nil
+	}
+
+	if err := config.CheckFiles(phases); err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("finding graphload executable: %w", err)
+	}
+
+	if sflags.MustGetBool(cmd, "dry-run") {
+		for _, phase := range phases {
+			// The command lines are shown, they must not show the database password
+			args := config.Args(phase)
+			for i, arg := range args {
+				args[i] = postgres.RedactDSN(arg)
+			}
+			fmt.Printf("%s %s\n", executable, strings.Join(args, " "))
+		}
+		return nil
+	}
+
+	zlog.Info("running pipeline", zap.Stringer("phases", phasesList(phases)), zap.String("state_file", stateFile))
+	for _, phase := range phases {
+		zlog.Info("starting phase", zap.String("phase", string(phase)))
+		start := time.Now()
+
+		phaseCmd := exec.CommandContext(cmd.Context(), executable, config.Args(phase)...)
+		phaseCmd.Stdin = os.Stdin
+		phaseCmd.Stdout = os.Stdout
+		phaseCmd.Stderr = os.Stderr
+		if err := phaseCmd.Run(); err != nil {
+			return fmt.Errorf("phase %q failed, run the pipeline again to resume at this phase: %w", phase, err)
+		}
+
+		state.MarkCompleted(phase, time.Since(start))
+		if err := state.Save(stateFile); err != nil {
+			return fmt.Errorf("phase %q completed but recording it failed: %w", phase, err)
+		}
+		zlog.Info("phase completed", zap.String("phase", string(phase)), zap.Duration("elapsed", time.Since(start)))
+	}
+
+	zlog.Info("pipeline completed", zap.String("state_file", stateFile))
+	return nil
+}
+
+func pipelinePhaseFlags(cmd *cobra.Command) (from, only pipeline.Phase, err error) {
+	fromFlag := sflags.MustGetString(cmd, "from-phase")
+	onlyFlag := sflags.MustGetString(cmd, "only-phase")
+	if fromFlag != "" && onlyFlag != "" {
+		return "", "", fmt.Errorf("--from-phase and --only-phase are mutually exclusive")
+	}
+
+	if fromFlag != "" {
+		if from, err = pipeline.ParsePhase(fromFlag); err != nil {
+			return "", "", fmt.Errorf("--from-phase: %w", err)
+		}
+	}
+	if onlyFlag != "" {
+		if only, err = pipeline.ParsePhase(onlyFlag); err != nil {
+			return "", "", fmt.Errorf("--only-phase: %w", err)
+		}
+	}
+	return from, only, nil
+}
+
+type phasesList []pipeline.Phase
+
+func (l phasesList) String() string {
+	names := make([]string, len(l))
+	for i, phase := range l {
+		names[i] = string(phase)
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/streamingfast/cli"
+	. "github.com/streamingfast/cli"
+	"github.com/streamingfast/cli/sflags"
+	"github.com/streamingfast/shutter"
+	"github.com/streamingfast/substreams-graph-load/poiprocessor"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	"github.com/streamingfast/substreams-graph-load/sinker"
+	"go.uber.org/zap"
+)
+
+var poiCmd = Command(poiE,
+	"poi (--entities|--graphql-schema) <source_folder> <stop_block>",
+	"Recompute the POI from the entity bundles written by 'run' and write (or verify) the poi2$ bundles",
+	Description(`
+		Replay the entity changes of every <source_folder>/<entity> bundle, merged by block number,
+		through the proof of indexing and write the resulting <source_folder>/poi2$ bundles, identical
+		to the ones 'run' writes. With '--verify', the existing poi2$ bundles are checked against the
+		recomputed values instead, the first mismatch is reported.
+
+		Arguments:
+		- <source_folder>: Folder containing one folder per entity with jsonl files, created with 'run' command.
+		- <stop_block>: Exclusive block where the POI computation stops, usually the 'run' stop block.
+	`),
+	ExactArgs(2),
+	Flags(func(flags *pflag.FlagSet) {
+		flags.Uint64("bundle-size", 1000, "Size of output bundle, in blocks")
+		flags.Uint64("start-block", 0, "Start replaying at this block instead of the first entity bundle, must be aligned with the bundle size")
+		flags.BytesHex("start-poi", nil, "When a start-block is given, the last POI processed before that block, derived from the poi2$ bundles found in <source_folder> if not provided")
+		flags.String("entities", "", "Comma-separated list of entities to process (alternative to providing the subgraph manifest)")
+		flags.String("graphql-schema", "", "Path to graphql schema to read the list of entities automatically (alternative to setting 'entities' value)")
+		flags.String("working-dir", "./workdir", "Path to local folder used as working directory")
+		flags.String("chain-id", "ethereum/mainnet", "ID of the chain to appear in POI table")
+		flags.Bool("verify", false, "Verify the existing poi2$ bundles against the recomputed POI instead of writing them")
+	}),
+)
+
+func poiE(cmd *cobra.Command, args []string) error {
+	app := shutter.New()
+
+	ctx, cancelApp := context.WithCancel(cmd.Context())
+	app.OnTerminating(func(_ error) {
+		cancelApp()
+	})
+
+	sourceFolder := args[0]
+	stopBlock, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("stopBlock must be a uint64, got %q", args[1])
+	}
+
+	bundleSize := sflags.MustGetUint64(cmd, "bundle-size")
+	entities, err := entitiesFromFlags(cmd)
+	if err != nil {
+		return err
+	}
+
+	startBlock, startBlockProvided := sflags.MustGetUint64Provided(cmd, "start-block")
+	var startPOI []byte
+	if startBlockProvided {
+		if startBlock%bundleSize != 0 {
+			return fmt.Errorf("provided startBlock %d, is not aligned with the bundleSize boundary %d", startBlock, bundleSize)
+		}
+
+		startPOI = sflags.MustGetBytesHex(cmd, "start-poi")
+		if len(startPOI) == 0 {
+			startPOI, err = sinker.LastPOIBefore(ctx, sourceFolder, startBlock)
+			if err != nil {
+				return fmt.Errorf("cannot derive start-poi from existing %s bundles, provide it with '--start-poi': %w", schema.PoiEntityName, err)
+			}
+		}
+	} else {
+		startBlock, err = poiprocessor.FirstBundleStartBlock(ctx, sourceFolder, entities[0])
+		if err != nil {
+			return fmt.Errorf("finding start block from %q bundles: %w", entities[0], err)
+		}
+	}
+
+	poiProc, err := poiprocessor.New(
+		sourceFolder,
+		sflags.MustGetString(cmd, "working-dir"),
+		entities,
+		startBlock,
+		stopBlock,
+		bundleSize,
+		uint64(10*1024),
+		sflags.MustGetString(cmd, "chain-id"),
+		startPOI,
+		sflags.MustGetBool(cmd, "verify"),
+		zlog,
+		tracer,
+	)
+	if err != nil {
+		return err
+	}
+
+	poiProc.OnTerminating(app.Shutdown)
+	app.OnTerminating(func(err error) {
+		poiProc.Shutdown(err)
+	})
+
+	go poiProc.Run(ctx)
+	zlog.Info("ready, waiting for signal to quit")
+
+	signalHandler, isSignaled, _ := cli.SetupSignalHandler(0*time.Second, zlog)
+	select {
+	case <-signalHandler:
+		go app.Shutdown(nil)
+		break
+	case <-app.Terminating():
+		zlog.Info("run terminating", zap.Bool("from_signal", isSignaled.Load()), zap.Bool("with_error", app.Err() != nil))
+		break
+	}
+
+	zlog.Info("waiting for run termination")
+	select {
+	case <-app.Terminated():
+	case <-time.After(30 * time.Second):
+		zlog.Warn("application did not terminate within 30s")
+	}
+
+	if err := app.Err(); err != nil {
+		zlog.Error("unsuccessful termination", zap.Error(err))
+		return err
+	}
+
+	zlog.Info("run terminated gracefully")
+	return nil
+}
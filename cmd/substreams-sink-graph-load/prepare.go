@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	. "github.com/streamingfast/cli"
+	"github.com/streamingfast/cli/sflags"
+	"go.uber.org/zap"
+
+	"github.com/streamingfast/substreams-graph-load/postgres"
+	"github.com/streamingfast/substreams-graph-load/schema"
+)
+
+var prepareCmd = Command(prepareE,
+	"prepare <deployment> <psql-dsn|graph-node-config> <graphql-schema>",
+	"Empties the tables of the deployment and resets its head block, so it is ready for injection",
+	ExactArgs(3),
+	Flags(func(flags *pflag.FlagSet) {
+		flags.Bool("dry-run", false, "Print the SQL statements without executing them")
+		flags.Bool("force", false, "Skip the check that graph-node is not indexing the deployment, that is unassigned or paused")
+		flags.String("password-file", "", "File holding the Postgres password, for DSNs without one, instead of the pgpass file (PGPASSFILE or ~/.pgpass)")
+	}),
+	Description(`
+		Truncates every entity table of <graphql-schema>, poi2$ and the progress$ table
+		of inject-csv, then clears the head block, entity count and cursor of the
+		deployment, in a single transaction. This replaces 'graphman rewind', and works
+		for subgraphs starting at block 0.
+
+		graph-node must not be indexing the deployment: unless --force is set, the
+		command refuses to run if the deployment is assigned and not paused.
+	`),
+)
+
+func prepareE(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
+	psqlDSN := args[1]
+	graphqlSchema := args[2]
+	dryRun := sflags.MustGetBool(cmd, "dry-run")
+
+	entities, err := schema.GetEntitiesFromSchema(graphqlSchema)
+	if err != nil {
+		return fmt.Errorf("reading schema from %q: %w", graphqlSchema, err)
+	}
+
+	deployment, err := openDeployment(cmd, psqlDSN, args[0], 3)
+	if err != nil {
+		return err
+	}
+	defer deployment.Close()
+	pool, pgSchema, deploymentHash := deployment.Pool, deployment.Schema, deployment.Hash
+
+	layout, err := postgres.DetectMetadataLayout(ctx, pool)
+	if err != nil {
+		return err
+	}
+
+	tables, err := tablesToTruncate(ctx, pool, pgSchema, entities)
+	if err != nil {
+		return err
+	}
+
+	truncate := postgres.NewStatement("TRUNCATE TABLE ")
+	for i, table := range tables {
+		if i > 0 {
+			truncate.SQL(", ")
+		}
+		truncate.Ident(pgSchema, table)
+	}
+	resetHead := layout.ResetHeadQuery()
+
+	if dryRun {
+		fmt.Printf("BEGIN;\n%s;\n", truncate.String())
+		fmt.Printf("-- $1 = '%s'\n%s;\nCOMMIT;\n", deploymentHash, strings.TrimSpace(resetHead))
+		return nil
+	}
+
+	lock, err := lockDeployment(cmd, deployment)
+	if err != nil {
+		return err
+	}
+	defer lock.Release(context.Background())
+
+	zlog.Info("preparing deployment", zap.String("deployment", deploymentHash), zap.String("schema", pgSchema), zap.Int("table_count", len(tables)), zap.String("metadata_layout", layout.Name))
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := truncate.Exec(ctx, tx); err != nil {
+		return fmt.Errorf("truncating tables of %q: %w", pgSchema, err)
+	}
+	if err := layout.ResetHead(ctx, tx, deploymentHash); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	zlog.Info("deployment prepared", zap.String("deployment", deploymentHash), zap.String("schema", pgSchema), zap.Strings("tables", tables))
+	return nil
+}
+
+// tablesToTruncate returns the entity tables, which must all exist, followed by poi2$
+// and progress$ when they exist.
+func tablesToTruncate(ctx context.Context, pool *pgxpool.Pool, pgSchema string, entities []*schema.EntityDesc) (out []string, err error) {
+	exists := func(table string) (bool, error) {
+		var found bool
+		if err := pool.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", postgres.QuoteIdentifier(pgSchema, table)).Scan(&found); err != nil {
+			return false, fmt.Errorf("looking up table %q: %w", table, err)
+		}
+		return found, nil
+	}
+
+	var missing []string
+	for _, ent := range entities {
+		if ent.Name == schema.PoiEntityName {
+			continue
+		}
+
+		found, err := exists(ent.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			missing = append(missing, ent.Name)
+			continue
+		}
+		out = append(out, ent.Name)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("tables %s of the GraphQL schema do not exist in %q, is it the schema of this deployment?", strings.Join(missing, ", "), pgSchema)
+	}
+
+	// progress$ is created by inject-csv, its records must go with the rows injected
+	for _, table := range []string{schema.PoiEntityName, "progress$"} {
+		found, err := exists(table)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			out = append(out, table)
+		}
+	}
+
+	return out, nil
+}
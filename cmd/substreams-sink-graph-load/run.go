@@ -14,6 +14,8 @@ import (
 	. "github.com/streamingfast/cli"
 	"github.com/streamingfast/cli/sflags"
 	"github.com/streamingfast/shutter"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
 	"github.com/streamingfast/substreams-graph-load/schema"
 	"github.com/streamingfast/substreams-graph-load/sinker"
 	sink "github.com/streamingfast/substreams-sink"
@@ -46,11 +48,15 @@ var SinkRunCmd = Command(sinkRunE,
 
 		flags.Uint64("bundle-size", 1000, "Size of output bundle, in blocks")
 		flags.String("start-block", "", "Start processing at this block instead of the substreams initial block")
-		flags.BytesHex("start-poi", nil, "When a start-block is given, you must provide the last POI processed before that block")
+		flags.BytesHex("start-poi", nil, "When a start-block is given, the last POI processed before that block, derived from the poi2$ bundles found in <destination-folder> if not provided")
 		flags.String("entities", "", "Comma-separated list of entities to process (alternative to providing the subgraph manifest)")
 		flags.String("graphql-schema", "", "Path to graphql schema to read the list of entities automatically (alternative to setting 'entities' value)")
 		flags.String("working-dir", "./workdir", "Path to local folder used as working directory")
 		flags.String("chain-id", "ethereum/mainnet", "ID of the chain to appear in POI table")
+		flags.Bool("no-resume", false, "Ignore the state persisted in <destination-folder> by a previous run and start from '--start-block'")
+		flags.String("compression", "gzip", "Compression of the entity bundles, one of 'none', 'gzip' or 'zstd', readers detect it from the files extension")
+		flags.String("file-type", string(writer.FileTypeJSONL), "File type of the entity bundles, one of 'jsonl' or 'binpb' (length-delimited protobuf), readers detect it from the files extension")
+		flags.Int("segments", 1, "Split the block range in this many bundle-aligned segments streamed concurrently, the POI is computed from the entity bundles once all segments completed")
 	}),
 )
 
@@ -71,8 +77,76 @@ func sinkRunE(cmd *cobra.Command, args []string) error {
 	outputModuleName := args[3]
 	stopBlock := args[4]
 	bundleSize := sflags.MustGetUint64(cmd, "bundle-size")
+	bundleCompression, err := compression.Parse(sflags.MustGetString(cmd, "compression"))
+	if err != nil {
+		return err
+	}
+	fileType, err := writer.ParseFileType(sflags.MustGetString(cmd, "file-type"))
+	if err != nil {
+		return err
+	}
+	segmentCount := sflags.MustGetInt(cmd, "segments")
+	if segmentCount < 1 {
+		return fmt.Errorf("segments must be >0, got %d", segmentCount)
+	}
 
 	startBlock := sflags.MustGetString(cmd, "start-block") // empty string by default makes valid ':endBlock' range
+
+	var state *sinker.State
+	if !sflags.MustGetBool(cmd, "no-resume") {
+		var err error
+		state, err = sinker.LoadState(ctx, destFolder, sinker.StateFilename)
+		if err != nil {
+			return fmt.Errorf("loading state: %w", err)
+		}
+	}
+
+	if state != nil && segmentCount > 1 {
+		return fmt.Errorf("a state from a previous run was found in %q, it cannot be resumed with '--segments' (use '--no-resume' to ignore it)", destFolder)
+	}
+
+	var startCursor *sink.Cursor
+	if state != nil {
+		if startBlock != "" {
+			return fmt.Errorf("a state from a previous run was found in %q, cannot use '--start-block' when resuming (use '--no-resume' to ignore it)", destFolder)
+		}
+		if strings.HasPrefix(stopBlock, "+") {
+			return fmt.Errorf("a relative stop block %q cannot be used when resuming from a previous run", stopBlock)
+		}
+		// A completed run saves its state at the stop block, which may not be aligned
+		if stopUint, err := strconv.ParseUint(stopBlock, 10, 64); err == nil {
+			if state.BlockNum == stopUint {
+				zlog.Info("previous run already completed the range, nothing to do (use '--no-resume' to run it again)", zap.String("dest_folder", destFolder), zap.Uint64("stop_block", stopUint))
+				return nil
+			}
+			if state.BlockNum > stopUint {
+				return fmt.Errorf("previous run already went up to block %d, past stop block %d (use '--no-resume' to run the range again)", state.BlockNum, stopUint)
+			}
+		}
+		if state.BundleSize != bundleSize {
+			return fmt.Errorf("state from previous run was produced with bundle size %d, cannot resume with bundle size %d", state.BundleSize, bundleSize)
+		}
+		if err := state.CheckFormat(fileType, bundleCompression); err != nil {
+			return err
+		}
+		if state.BlockNum%bundleSize != 0 {
+			return fmt.Errorf("previous run ended at block %d which is not aligned with the bundleSize boundary %d, cannot resume from it", state.BlockNum, bundleSize)
+		}
+
+		c, err := sink.NewCursor(state.Cursor)
+		if err != nil {
+			return fmt.Errorf("invalid cursor in state: %w", err)
+		}
+		startCursor = c
+		startBlock = strconv.FormatUint(state.BlockNum, 10)
+
+		zlog.Info("resuming from previous run state",
+			zap.Uint64("block_num", state.BlockNum),
+			zap.Stringer("cursor_block", startCursor.Block()),
+			zap.String("last_poi", hex.EncodeToString(state.LastPOI)),
+		)
+	}
+
 	if startBlock != "" {
 		startUint, err := strconv.ParseUint(startBlock, 10, 64)
 		if err != nil {
@@ -86,16 +160,20 @@ func sinkRunE(cmd *cobra.Command, args []string) error {
 	blockRange := startBlock + ":" + stopBlock
 
 	var startPOI []byte
-	if startBlock != "" {
-		startPOIStr := sflags.MustGetString(cmd, "start-poi")
-		if startPOIStr == "" {
-			return fmt.Errorf("when providing a start-block, you must also provide the start-poi")
-		}
-		s, err := hex.DecodeString(startPOIStr)
-		if err != nil {
-			return fmt.Errorf("cannot decode startPOI %q: %w", startPOIStr, err)
+	if state != nil {
+		startPOI = state.LastPOI
+	} else if startBlock != "" {
+		startPOI = sflags.MustGetBytesHex(cmd, "start-poi")
+		if len(startPOI) == 0 {
+			startUint, _ := strconv.ParseUint(startBlock, 10, 64)
+
+			var err error
+			startPOI, err = sinker.LastPOIBefore(ctx, destFolder, startUint)
+			if err != nil {
+				return fmt.Errorf("cannot derive start-poi from existing %s bundles, provide it with '--start-poi': %w", schema.PoiEntityName, err)
+			}
+			zlog.Info("derived start POI from existing bundles", zap.Uint64("start_block", startUint), zap.String("start_poi", hex.EncodeToString(startPOI)))
 		}
-		startPOI = s
 	}
 
 	sink, err := sink.NewFromViper(
@@ -120,26 +198,35 @@ func sinkRunE(cmd *cobra.Command, args []string) error {
 	workingDir := sflags.MustGetString(cmd, "working-dir")
 	chainID := sflags.MustGetString(cmd, "chain-id")
 
-	graphqlSchemaFilename := sflags.MustGetString(cmd, "graphql-schema")
+	entities, err := entitiesFromFlags(cmd)
+	if err != nil {
+		return err
+	}
 
-	var entities []string
-	entitiesList := sflags.MustGetString(cmd, "entities")
-	if entitiesList != "" {
-		if graphqlSchemaFilename != "" {
-			return fmt.Errorf("you must only use one of these flags: '--entities' or '--graphql-schema'")
+	var entitySink runner
+	if segmentCount > 1 {
+		if sink.BlockRange() == nil || sink.BlockRange().EndBlock() == nil {
+			return fmt.Errorf("sink must have a stop block defined")
 		}
-		entities = strings.Split(entitiesList, ",")
+
+		entitySink, err = newSegmentedRun(ctx, cmd, sink.BlockRange(), segmentCount, &segmentedRunConfig{
+			destFolder:       destFolder,
+			workingDir:       workingDir,
+			endpoint:         endpoint,
+			manifestPath:     manifestPath,
+			outputModuleName: outputModuleName,
+			entities:         entities,
+			bundleSize:       bundleSize,
+			bufferSize:       bufferSize,
+			chainID:          chainID,
+			startPOI:         startPOI,
+			compression:      bundleCompression,
+			fileType:         fileType,
+			noResume:         sflags.MustGetBool(cmd, "no-resume"),
+		})
 	} else {
-		if graphqlSchemaFilename == "" {
-			return fmt.Errorf("you must set one of these flags: '--entities' or '--graphql-schema'")
-		}
-		entities, err = schema.GetEntityNamesFromSchema(graphqlSchemaFilename)
-		if err != nil {
-			return err
-		}
+		entitySink, err = sinker.New(sink, destFolder, workingDir, entities, bundleSize, bufferSize, chainID, startPOI, startCursor, zlog, tracer, sinker.WithCompression(bundleCompression), sinker.WithFileType(fileType))
 	}
-
-	entitySink, err := sinker.New(sink, destFolder, workingDir, entities, bundleSize, bufferSize, chainID, startPOI, zlog, tracer)
 	if err != nil {
 		return fmt.Errorf("unable to setup entity sinker: %w", err)
 	}
@@ -180,3 +267,10 @@ func sinkRunE(cmd *cobra.Command, args []string) error {
 	zlog.Info("run terminated gracefully")
 	return nil
 }
+
+type runner interface {
+	Run(ctx context.Context)
+	OnTerminating(f func(error))
+	Shutdown(err error)
+	Terminated() <-chan struct{}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/shutter"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
+	"github.com/streamingfast/substreams-graph-load/poiprocessor"
+	"github.com/streamingfast/substreams-graph-load/sinker"
+	sink "github.com/streamingfast/substreams-sink"
+	"go.uber.org/zap"
+)
+
+// segmentedRun streams every segment of the block range concurrently, each with its
+// own sink writing into the same destination folder, then recomputes the POI over
+// the whole range from the entity bundles once all segments completed.
+type segmentedRun struct {
+	*shutter.Shutter
+
+	sinks        []*sinker.EntitiesSink
+	poiProcessor *poiprocessor.Processor
+	logger       *zap.Logger
+
+	destFolder string
+	// lastStateFilename is the state file of the last segment, whose cursor is the
+	// last block of the whole range.
+	lastStateFilename string
+	stopBlock         uint64
+}
+
+type segmentedRunConfig struct {
+	destFolder       string
+	workingDir       string
+	endpoint         string
+	manifestPath     string
+	outputModuleName string
+	entities         []string
+	bundleSize       uint64
+	bufferSize       uint64
+	chainID          string
+	startPOI         []byte
+	compression      compression.Type
+	fileType         writer.FileType
+	// noResume ignores the segment states of a previous run, every segment restarting
+	// from its start block
+	noResume bool
+}
+
+func newSegmentedRun(ctx context.Context, cmd *cobra.Command, blockRange *bstream.Range, segmentCount int, config *segmentedRunConfig) (*segmentedRun, error) {
+	startBlock := blockRange.StartBlock()
+	stopBlock := *blockRange.EndBlock()
+
+	segments, err := sinker.PlanSegments(startBlock, stopBlock, config.bundleSize, segmentCount)
+	if err != nil {
+		return nil, fmt.Errorf("planning segments: %w", err)
+	}
+
+	lastSegment := segments[len(segments)-1]
+	r := &segmentedRun{
+		Shutter:           shutter.New(),
+		logger:            zlog,
+		destFolder:        config.destFolder,
+		lastStateFilename: sinker.SegmentStateFilename(lastSegment.StartBlock(), *lastSegment.EndBlock()),
+		stopBlock:         stopBlock,
+	}
+
+	for _, segment := range segments {
+		segmentStop := *segment.EndBlock()
+		logger := zlog.With(zap.Stringer("segment", segment))
+
+		segmentStart, startCursor, completed, err := resumeSegment(ctx, config, segment)
+		if err != nil {
+			return nil, err
+		}
+		if completed {
+			logger.Info("segment already completed by a previous run, skipping it")
+			continue
+		}
+		if segmentStart != segment.StartBlock() {
+			logger.Info("resuming segment from previous run state", zap.Uint64("block_num", segmentStart))
+		}
+
+		segmentSink, err := sink.NewFromViper(
+			cmd,
+			sink.IgnoreOutputModuleType,
+			config.endpoint, config.manifestPath, config.outputModuleName,
+			strconv.FormatUint(segmentStart, 10)+":"+strconv.FormatUint(segmentStop, 10),
+			logger,
+			tracer,
+			sink.WithFinalBlocksOnly(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup sinker for segment %s: %w", segment, err)
+		}
+
+		entitySink, err := sinker.New(
+			segmentSink,
+			config.destFolder,
+			config.workingDir,
+			config.entities,
+			config.bundleSize,
+			config.bufferSize,
+			config.chainID,
+			nil,
+			startCursor,
+			logger,
+			tracer,
+			sinker.WithSegment(segment),
+			sinker.WithCompression(config.compression),
+			sinker.WithFileType(config.fileType),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup entity sinker for segment %s: %w", segment, err)
+		}
+
+		r.sinks = append(r.sinks, entitySink)
+	}
+
+	r.poiProcessor, err = poiprocessor.New(
+		config.destFolder,
+		config.workingDir,
+		config.entities,
+		startBlock,
+		stopBlock,
+		config.bundleSize,
+		config.bufferSize,
+		config.chainID,
+		config.startPOI,
+		false,
+		zlog,
+		tracer,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// resumeSegment returns the block and cursor the segment starts from, the ones of the
+// state of a previous run unless config.noResume is set, and whether that run already
+// completed it.
+func resumeSegment(ctx context.Context, config *segmentedRunConfig, segment *bstream.Range) (startBlock uint64, startCursor *sink.Cursor, completed bool, err error) {
+	startBlock, startCursor = segment.StartBlock(), sink.NewBlankCursor()
+	if config.noResume {
+		return startBlock, startCursor, false, nil
+	}
+
+	segmentStop := *segment.EndBlock()
+	state, err := sinker.LoadState(ctx, config.destFolder, sinker.SegmentStateFilename(segment.StartBlock(), segmentStop))
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("loading segment %s state: %w", segment, err)
+	}
+	if state == nil {
+		return startBlock, startCursor, false, nil
+	}
+
+	if state.BundleSize != config.bundleSize {
+		return 0, nil, false, fmt.Errorf("segment %s state was produced with bundle size %d, cannot resume with bundle size %d", segment, state.BundleSize, config.bundleSize)
+	}
+	if err := state.CheckFormat(config.fileType, config.compression); err != nil {
+		return 0, nil, false, fmt.Errorf("segment %s: %w", segment, err)
+	}
+	if state.BlockNum >= segmentStop {
+		return 0, nil, true, nil
+	}
+
+	startCursor, err = sink.NewCursor(state.Cursor)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("invalid cursor in segment %s state: %w", segment, err)
+	}
+	return state.BlockNum, startCursor, false, nil
+}
+
+func (r *segmentedRun) Run(ctx context.Context) {
+	r.OnTerminating(func(err error) {
+		for _, s := range r.sinks {
+			s.Shutdown(err)
+		}
+		r.poiProcessor.Shutdown(err)
+	})
+
+	r.logger.Info("streaming segments", zap.Int("segment_count", len(r.sinks)))
+
+	var wg sync.WaitGroup
+	for _, s := range r.sinks {
+		entitySink := s
+		entitySink.OnTerminating(func(err error) {
+			if err != nil {
+				r.Shutdown(fmt.Errorf("segment %s: %w", entitySink.BlockRange(), err))
+			}
+		})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			go entitySink.Run(ctx)
+			<-entitySink.Terminated()
+		}()
+	}
+	wg.Wait()
+
+	if r.IsTerminating() {
+		return
+	}
+
+	r.logger.Info("all segments completed, computing POI over the whole range")
+	r.poiProcessor.Run(ctx)
+	if err := r.poiProcessor.Err(); err != nil {
+		r.Shutdown(err)
+		return
+	}
+
+	r.Shutdown(r.writeLastBlock(ctx))
+}
+
+// writeLastBlock writes `last_block.txt` from the cursor persisted by the last segment,
+// only once every segment and the POI completed so that 'handoff' never trusts the
+// last block of a run that failed.
+func (r *segmentedRun) writeLastBlock(ctx context.Context) error {
+	state, err := sinker.LoadState(ctx, r.destFolder, r.lastStateFilename)
+	if err != nil {
+		return fmt.Errorf("loading last segment state: %w", err)
+	}
+	if state == nil || state.BlockNum < r.stopBlock {
+		return fmt.Errorf("last segment did not reach stop block %d, not writing %s", r.stopBlock, sinker.LastBlockFilename)
+	}
+
+	cursor, err := sink.NewCursor(state.Cursor)
+	if err != nil {
+		return fmt.Errorf("invalid cursor in last segment state: %w", err)
+	}
+	if cursor.IsBlank() {
+		return fmt.Errorf("last segment state has no cursor, not writing %s", sinker.LastBlockFilename)
+	}
+
+	if err := sinker.WriteLastBlock(ctx, r.destFolder, cursor.Block().Num(), cursor.Block().ID()); err != nil {
+		return err
+	}
+	r.logger.Info("all segments and POI completed, last block written", zap.Stringer("last_block", cursor.Block()))
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
+	"github.com/streamingfast/substreams-graph-load/sinker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeSegment(t *testing.T) {
+	ctx := context.Background()
+	destFolder := t.TempDir()
+
+	completed := bstream.NewRangeExcludingEnd(0, 1000)
+	unstarted := bstream.NewRangeExcludingEnd(1000, 2000)
+	state := `{"cursor": "", "block_num": 1000, "bundle_size": 100, "file_type": "jsonl", "compression": "gzip"}`
+	require.NoError(t, os.WriteFile(filepath.Join(destFolder, sinker.SegmentStateFilename(0, 1000)), []byte(state), 0644))
+
+	config := &segmentedRunConfig{destFolder: destFolder, bundleSize: 100, fileType: writer.FileTypeJSONL, compression: compression.Gzip}
+
+	_, _, done, err := resumeSegment(ctx, config, completed)
+	require.NoError(t, err)
+	assert.True(t, done)
+
+	startBlock, startCursor, done, err := resumeSegment(ctx, config, unstarted)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, uint64(1000), startBlock)
+	assert.True(t, startCursor.IsBlank())
+
+	// With --no-resume, the segment completed by the previous run restarts from its start
+	config.noResume = true
+	startBlock, startCursor, done, err = resumeSegment(ctx, config, completed)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, uint64(0), startBlock)
+	assert.True(t, startCursor.IsBlank())
+}
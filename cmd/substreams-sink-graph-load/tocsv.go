@@ -3,7 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -12,14 +16,16 @@ import (
 	. "github.com/streamingfast/cli"
 	"github.com/streamingfast/cli/sflags"
 	"github.com/streamingfast/shutter"
+	"github.com/streamingfast/substreams-graph-load/compression"
 	"github.com/streamingfast/substreams-graph-load/csvprocessor"
+	"github.com/streamingfast/substreams-graph-load/schema"
 	"github.com/streamingfast/substreams-graph-load/sinker"
 	sink "github.com/streamingfast/substreams-sink"
 	"go.uber.org/zap"
 )
 
 var toCSVCmd = Command(toCSVE,
-	"tocsv <source_folder> <destination_folder> <entity> <stop_block>",
+	"tocsv <source_folder> <destination_folder> [<entity>] <stop_block>",
 	"Create CSV files ready for insertion into postgresql",
 	Description(`
 		Process <source_folder>/<entity> to create CSV files ready for insertion into PostgreSQL to
@@ -28,17 +34,48 @@ var toCSVCmd = Command(toCSVE,
 		Arguments:
 		- <source_folder>: Folder containing one folder per entity with jsonl files, created with 'run' command.
 		- <destination_folder>: Folder where CSV files will be created (a subfolder named as the entity will be automatically appended)
-		- <entity>: Name of the entity (ex: 'transfers') that will be processed. You need to run one instance of 'tocsv' per entity.
+		- <entity>: Name of the entity (ex: 'transfers') that will be processed, omitted when using '--all-entities' or '--entities'.
 		- <stop_block>: Where you want to stop creating CSV (usually, very close to chain HEAD)
+
+		With '--all-entities', every entity of the GraphQL schema (poi2$ included) is processed by
+		this process, or only the ones listed with '--entities', '--workers' of them at a time. A
+		summary is printed once all of them terminated and the command fails if any of them failed.
+
+		For mutable entities, a snapshot of the entities still open at <stop_block> is written to
+		<destination_folder>/snapshots/<entity>. A later run with '--start-block' set to that stop
+		block loads it and only processes the new range. Rows it closes that were already exported
+		as open rows are written to <destination_folder>/closures/<entity> instead, 'inject-csv'
+		applies them before loading the rows of the new range.
 	`),
-	ExactArgs(4),
+	RangeArgs(3, 4),
 	Flags(func(flags *pflag.FlagSet) {
 		sink.AddFlagsToSet(flags)
 		flags.Uint64("bundle-size", 1000, "Size of output bundle, in blocks")
+		flags.Uint64("start-block", 0, "Continue a previous 'tocsv' run that stopped at this block, loading the snapshot of open entities it wrote and processing only the entity changes from this block")
 		flags.String("graphql-schema", "schema.graphql", "Path to graphql schema")
+		flags.Bool("all-entities", false, "Process every entity of the GraphQL schema, poi2$ included, instead of the <entity> argument")
+		flags.String("entities", "", "Comma-separated list of entities to process instead of the <entity> argument")
+		flags.Int("workers", 4, "Number of entities processed concurrently with '--all-entities' or '--entities'")
+		flags.String("compression", "none", "Compression of the CSV files, one of 'none', 'gzip' or 'zstd' ('inject-csv' decompresses them while streaming)")
+		flags.String("entity-store", string(csvprocessor.EntityStoreMemory), "Where live mutable entities are kept while processing, one of 'memory' or 'disk' (embedded key-value store)")
+		flags.String("entity-store-dir", "", "Folder under which the 'disk' entity store keeps its data, removed once done (defaults to the OS temporary folder)")
+		flags.Uint64("entity-store-memory-threshold", 0, "With the 'memory' entity store, a budget in MiB shared by the entities processed concurrently by all workers, the entities of the one growing past it are moved to disk, 0 to never move them")
 	}),
 )
 
+var (
+	errToCSVSkipped     = fmt.Errorf("not started, terminating")
+	errToCSVInterrupted = fmt.Errorf("interrupted, terminating")
+)
+
+// toCSVResult is the outcome of processing one entity.
+type toCSVResult struct {
+	entity   string
+	err      error
+	duration time.Duration
+	stats    csvprocessor.Stats
+}
+
 func toCSVE(cmd *cobra.Command, args []string) error {
 	app := shutter.New()
 
@@ -49,41 +86,145 @@ func toCSVE(cmd *cobra.Command, args []string) error {
 
 	sink.RegisterMetrics()
 	sinker.RegisterMetrics()
+	csvprocessor.RegisterMetrics()
 
 	sourceFolder := args[0]
 	destFolder := args[1]
-	entity := args[2]
 
-	stopBlock, err := strconv.ParseUint(args[3], 10, 64)
+	stopBlockArg := args[len(args)-1]
+	stopBlock, err := strconv.ParseUint(stopBlockArg, 10, 64)
 	if err != nil {
-		return fmt.Errorf("stopBlock must be a uint64, got %q", args[3])
+		return fmt.Errorf("stopBlock must be a uint64, got %q", stopBlockArg)
 	}
 
 	bundleSize := sflags.MustGetUint64(cmd, "bundle-size")
 	graphqlSchemaFilename := sflags.MustGetString(cmd, "graphql-schema")
+	outputCompression, err := compression.Parse(sflags.MustGetString(cmd, "compression"))
+	if err != nil {
+		return err
+	}
 
-	csvProc, err := csvprocessor.New(
-		sourceFolder,
-		destFolder,
-		entity,
-		stopBlock,
-		bundleSize,
-		graphqlSchemaFilename,
-		zlog,
-		tracer,
-	)
+	entityStoreType, err := csvprocessor.ParseEntityStoreType(sflags.MustGetString(cmd, "entity-store"))
+	if err != nil {
+		return err
+	}
+	entityStoreDir := sflags.MustGetString(cmd, "entity-store-dir")
+	// Shared by the processors of all workers, bounding their total memory
+	entityStoreMemoryBudget := csvprocessor.NewMemoryBudget(sflags.MustGetUint64(cmd, "entity-store-memory-threshold") * 1024 * 1024)
+	startBlock := sflags.MustGetUint64(cmd, "start-block")
 
+	workers := sflags.MustGetInt(cmd, "workers")
+	if workers <= 0 {
+		return fmt.Errorf("--workers must be >0, got %d", workers)
+	}
+
+	entityDescs, err := toCSVEntities(cmd, args, graphqlSchemaFilename)
 	if err != nil {
 		return err
 	}
 
-	csvProc.OnTerminating(app.Shutdown)
+	results := make([]*toCSVResult, len(entityDescs))
+	for i, desc := range entityDescs {
+		results[i] = &toCSVResult{entity: desc.Name}
+	}
+
+	var lock sync.Mutex
+	running := map[string]*csvprocessor.Processor{}
 	app.OnTerminating(func(err error) {
-		csvProc.Shutdown(err)
+		// A signal terminates without error, the entities it stops are not complete
+		if err == nil {
+			err = errToCSVInterrupted
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, csvProc := range running {
+			csvProc.Shutdown(err)
+		}
 	})
 
-	go csvProc.Run(ctx)
-	zlog.Info("ready, waiting for signal to quit")
+	processEntity := func(desc *schema.EntityDesc, result *toCSVResult) error {
+		entityStore, err := csvprocessor.NewEntityStore(entityStoreType, entityStoreDir, entityStoreMemoryBudget, zlog)
+		if err != nil {
+			return err
+		}
+
+		csvProc, err := csvprocessor.New(
+			sourceFolder,
+			destFolder,
+			desc,
+			stopBlock,
+			bundleSize,
+			outputCompression,
+			zlog.With(zap.String("entity", desc.Name)),
+			tracer,
+			csvprocessor.WithEntityStore(entityStore),
+			csvprocessor.WithStartBlock(startBlock),
+		)
+		if err != nil {
+			entityStore.Close()
+			return err
+		}
+
+		lock.Lock()
+		if app.IsTerminating() {
+			lock.Unlock()
+			entityStore.Close()
+			return errToCSVSkipped
+		}
+		running[desc.Name] = csvProc
+		lock.Unlock()
+
+		csvProc.Run(ctx)
+
+		lock.Lock()
+		delete(running, desc.Name)
+		lock.Unlock()
+
+		result.stats = csvProc.Stats()
+		return csvProc.Err()
+	}
+
+	// Closed once every worker is done, the results are not written anymore
+	workersDone := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		queue := make(chan int)
+		for i := 0; i < workers && i < len(entityDescs); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for idx := range queue {
+					desc, result := entityDescs[idx], results[idx]
+
+					zlog.Info("processing entity", zap.String("entity", desc.Name))
+					t0 := time.Now()
+					result.err = processEntity(desc, result)
+					result.duration = time.Since(t0)
+
+					if result.err != nil {
+						zlog.Error("entity failed", zap.String("entity", desc.Name), zap.Duration("elapsed", result.duration), zap.Error(result.err))
+						continue
+					}
+					zlog.Info("entity completed", zap.String("entity", desc.Name), zap.Duration("elapsed", result.duration), zap.Uint64("row_count", result.stats.RowCount))
+				}
+			}()
+		}
+
+		for idx := range entityDescs {
+			if app.IsTerminating() {
+				results[idx].err = errToCSVSkipped
+				continue
+			}
+			queue <- idx
+		}
+		close(queue)
+		wg.Wait()
+		close(workersDone)
+
+		app.Shutdown(toCSVError(results))
+	}()
+	zlog.Info("ready, waiting for signal to quit", zap.Int("entity_count", len(entityDescs)), zap.Int("workers", workers))
 
 	signalHandler, isSignaled, _ := cli.SetupSignalHandler(0*time.Second, zlog)
 	select {
@@ -97,12 +238,18 @@ func toCSVE(cmd *cobra.Command, args []string) error {
 
 	zlog.Info("waiting for run termination")
 	select {
-	case <-app.Terminated():
+	case <-workersDone:
 	case <-time.After(30 * time.Second):
-		zlog.Warn("application did not terminate within 30s")
+		// The results are still being written, they cannot be reported
+		return fmt.Errorf("entities did not terminate within 30s")
 	}
 
-	if err := app.Err(); err != nil {
+	if len(entityDescs) > 1 {
+		printToCSVSummary(results)
+	}
+
+	// Computed from the results, app.Err() is nil when terminated by a signal
+	if err := toCSVError(results); err != nil {
 		zlog.Error("unsuccessful termination", zap.Error(err))
 		return err
 	}
@@ -110,3 +257,99 @@ func toCSVE(cmd *cobra.Command, args []string) error {
 	zlog.Info("run terminated gracefully")
 	return nil
 }
+
+// toCSVEntities resolves the entities to process from the <entity> argument, or the
+// '--all-entities' and '--entities' flags when it is omitted.
+func toCSVEntities(cmd *cobra.Command, args []string, graphqlSchemaFilename string) ([]*schema.EntityDesc, error) {
+	allEntities := sflags.MustGetBool(cmd, "all-entities")
+	entitiesList := sflags.MustGetString(cmd, "entities")
+
+	var names []string
+	switch {
+	case allEntities && entitiesList != "":
+		return nil, fmt.Errorf("you must only use one of these flags: '--all-entities' or '--entities'")
+	case allEntities || entitiesList != "":
+		if len(args) != 3 {
+			return nil, fmt.Errorf("the <entity> argument cannot be used with '--all-entities' or '--entities'")
+		}
+		if entitiesList != "" {
+			names = strings.Split(entitiesList, ",")
+		}
+	default:
+		if len(args) != 4 {
+			return nil, fmt.Errorf("missing <entity> argument, or use '--all-entities' or '--entities'")
+		}
+		names = []string{args[2]}
+	}
+
+	entities, err := schema.GetEntitiesFromSchema(graphqlSchemaFilename)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema from %q: %w", graphqlSchemaFilename, err)
+	}
+	if allEntities {
+		return entities, nil
+	}
+
+	var out []*schema.EntityDesc
+	for _, name := range names {
+		var found *schema.EntityDesc
+		for _, ent := range entities {
+			if ent.Name == name {
+				found = ent
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("cannot find entity %q in schema %q", name, graphqlSchemaFilename)
+		}
+		out = append(out, found)
+	}
+	return out, nil
+}
+
+// toCSVError returns the error of the run from the results of its entities, the ones
+// skipped or interrupted by a termination counting as failed.
+func toCSVError(results []*toCSVResult) error {
+	var failed []string
+	for _, result := range results {
+		if result.err != nil {
+			failed = append(failed, result.entity)
+		}
+	}
+
+	switch {
+	case len(failed) == 0:
+		return nil
+	case len(results) == 1:
+		return results[0].err
+	}
+	return fmt.Errorf("%d of %d entities failed: %s", len(failed), len(results), strings.Join(failed, ", "))
+}
+
+func printToCSVSummary(results []*toCSVResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTITY\tSTATUS\tDURATION\tENTITY FILES\tROWS\tCLOSURES\tOPEN ENTITIES\tERROR")
+	for _, result := range results {
+		status, errMessage := "ok", ""
+		switch {
+		case result.err == errToCSVSkipped:
+			status = "skipped"
+		case result.err == errToCSVInterrupted:
+			status = "interrupted"
+		case result.err != nil:
+			status, errMessage = "failed", result.err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\n",
+			result.entity,
+			status,
+			result.duration.Round(time.Millisecond),
+			result.stats.EntityFileCount,
+			result.stats.RowCount,
+			result.stats.ClosureCount,
+			result.stats.OpenEntityCount,
+			errMessage,
+		)
+	}
+	w.Flush()
+}
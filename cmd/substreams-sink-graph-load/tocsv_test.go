@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToCSVError(t *testing.T) {
+	assert.NoError(t, toCSVError([]*toCSVResult{{entity: "pool"}, {entity: "token"}}))
+
+	failure := errors.New("boom")
+	assert.Equal(t, failure, toCSVError([]*toCSVResult{{entity: "pool", err: failure}}))
+
+	// A signal terminates the app without error, skipped and interrupted entities still fail the run
+	assert.EqualError(t, toCSVError([]*toCSVResult{
+		{entity: "pool"},
+		{entity: "token", err: errToCSVInterrupted},
+		{entity: "swap", err: errToCSVSkipped},
+	}), "2 of 3 entities failed: token, swap")
+}
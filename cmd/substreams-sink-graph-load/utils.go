@@ -8,6 +8,10 @@ import (
 	"strings"
 
 	"github.com/spf13/viper"
+	"github.com/streamingfast/cli/sflags"
+	"github.com/streamingfast/substreams-graph-load/postgres"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	"go.uber.org/zap"
 
 	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
 )
@@ -80,3 +84,50 @@ func mustGetBool(cmd *cobra.Command, flagName string) bool {
 	}
 	return val
 }
+
+// entitiesFromFlags resolves the entities to process from either the '--entities'
+// or the '--graphql-schema' flag, exactly one of them must be set.
+func entitiesFromFlags(cmd *cobra.Command) ([]string, error) {
+	graphqlSchemaFilename := sflags.MustGetString(cmd, "graphql-schema")
+
+	entitiesList := sflags.MustGetString(cmd, "entities")
+	if entitiesList != "" {
+		if graphqlSchemaFilename != "" {
+			return nil, fmt.Errorf("you must only use one of these flags: '--entities' or '--graphql-schema'")
+		}
+		return strings.Split(entitiesList, ","), nil
+	}
+
+	if graphqlSchemaFilename == "" {
+		return nil, fmt.Errorf("you must set one of these flags: '--entities' or '--graphql-schema'")
+	}
+	return schema.GetEntityNamesFromSchema(graphqlSchemaFilename)
+}
+
+// lockDeployment takes the advisory lock of the deployment on its shard, after checking
+// on the primary that graph-node is not indexing it unless '--force' is set. The
+// returned lock must be released once done writing to the deployment.
+func lockDeployment(cmd *cobra.Command, deployment *postgres.Deployment) (*postgres.DeploymentLock, error) {
+	ctx := cmd.Context()
+
+	if sflags.MustGetBool(cmd, "force") {
+		zlog.Warn("not checking that graph-node is not indexing the deployment, as requested by --force", zap.String("schema", deployment.Schema))
+	} else {
+		// The head tables identifying the layout are on the shard, assignments on the primary
+		layout, err := postgres.DetectMetadataLayout(ctx, deployment.Pool)
+		if err != nil {
+			return nil, err
+		}
+		if err := postgres.CheckNotIndexing(ctx, deployment.Primary(), layout, deployment.Schema); err != nil {
+			return nil, err
+		}
+	}
+
+	return postgres.LockDeployment(ctx, deployment.Pool, deployment.Schema)
+}
+
+// openDeployment opens the deployment with postgres.OpenDeployment, the password of
+// DSNs without one being read from '--password-file' when set.
+func openDeployment(cmd *cobra.Command, dsnOrConfig string, ref string, maxConns int) (*postgres.Deployment, error) {
+	return postgres.OpenDeployment(cmd.Context(), dsnOrConfig, ref, maxConns, sflags.MustGetString(cmd, "password-file"))
+}
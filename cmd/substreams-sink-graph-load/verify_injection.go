@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	. "github.com/streamingfast/cli"
+	"github.com/streamingfast/cli/sflags"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/postgres"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	"github.com/streamingfast/substreams-graph-load/verify"
+	"go.uber.org/zap"
+)
+
+var verifyInjectionCmd = Command(verifyInjectionE,
+	"verify-injection <deployment> <input-path> [<entity>] <graphql-schema> <psql-dsn|graph-node-config> <start-block> <stop-block>",
+	"Verifies that the tables of the deployment match the CSV files injected with 'inject-csv'",
+	Description(`
+		Counts the rows of each table per block range, by the first block of their block range,
+		and compares them with the rows of the CSV files, taking the same arguments as
+		'inject-csv'. Block ranges are the size of the CSV files. Only the rows whose first
+		block is in [<start-block>, <stop-block>) are compared, the CSV files past <stop-block>
+		are read too as they hold the rows closed after it.
+
+		With '--deep', a digest of the content of every row, normalized according to the
+		GraphQL schema, is also computed on both sides. For the block ranges whose digests
+		differ, the first differing IDs are reported. Rows open in the CSV files and closed
+		since, at or after <stop-block>, by the injection of a following range are considered
+		identical.
+
+		The command fails if any table does not match.
+	`),
+	RangeArgs(6, 7),
+	Flags(func(flags *pflag.FlagSet) {
+		flags.Bool("all-entities", false, "Verify every entity of <graphql-schema>, poi2$ included, instead of the <entity> argument")
+		flags.Bool("deep", false, "Also compare a digest of the content of every row, reporting the first differing IDs")
+		flags.Int("max-differences", 10, "Maximum number of differing block ranges, and rows with '--deep', reported per table")
+		flags.Int("connections", 4, "Number of tables verified concurrently, each using its own database connection")
+		flags.String("password-file", "", "File holding the Postgres password, for DSNs without one, instead of the pgpass file (PGPASSFILE or ~/.pgpass)")
+	}),
+)
+
+func verifyInjectionE(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
+	connections := sflags.MustGetInt(cmd, "connections")
+	if connections <= 0 {
+		return fmt.Errorf("--connections must be >0, got %d", connections)
+	}
+	maxDifferences := sflags.MustGetInt(cmd, "max-differences")
+	if maxDifferences <= 0 {
+		return fmt.Errorf("--max-differences must be >0, got %d", maxDifferences)
+	}
+
+	target, err := resolveInjectTarget(cmd, args, connections)
+	if err != nil {
+		return err
+	}
+	defer target.deployment.Close()
+	pool := target.deployment.Pool
+
+	verifiers := make([]*tableVerifier, len(target.entities))
+	for i, ent := range target.entities {
+		verifiers[i] = &tableVerifier{
+			pool:           pool,
+			pgSchema:       target.pgSchema,
+			entityDesc:     ent,
+			in:             target.inputStore,
+			startBlock:     target.startBlock,
+			stopBlock:      target.stopBlock,
+			deep:           sflags.MustGetBool(cmd, "deep"),
+			maxDifferences: maxDifferences,
+		}
+	}
+
+	slots := make(chan struct{}, connections)
+	var wg sync.WaitGroup
+	for _, verifier := range verifiers {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(verifier *tableVerifier) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			zlog.Info("verifying table", zap.String("table", verifier.entityDesc.Name))
+			verifier.err = verifier.Run(ctx)
+			if verifier.err != nil {
+				zlog.Error("table verification failed", zap.String("table", verifier.entityDesc.Name), zap.Error(verifier.err))
+			}
+		}(verifier)
+	}
+	wg.Wait()
+
+	printVerificationReport(verifiers)
+
+	var failed []string
+	for _, verifier := range verifiers {
+		if !verifier.Matches() {
+			failed = append(failed, verifier.entityDesc.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d tables do not match their CSV files: %s", len(failed), len(verifiers), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+type tableVerifier struct {
+	pool           *pgxpool.Pool
+	pgSchema       string
+	entityDesc     *schema.EntityDesc
+	in             dstore.Store
+	startBlock     uint64
+	stopBlock      uint64
+	deep           bool
+	maxDifferences int
+
+	files    []string
+	digester *verify.RowDigester
+	csvStats *verify.TableStats
+	dbStats  *verify.TableStats
+
+	rangeDiffs []*verify.RangeDiff
+	rowDiffs   []*verify.RowDiff
+	err        error
+}
+
+func (v *tableVerifier) Matches() bool {
+	return v.err == nil && len(v.rangeDiffs) == 0
+}
+
+func (v *tableVerifier) Run(ctx context.Context) error {
+	if err := v.readCSVStats(ctx); err != nil {
+		return err
+	}
+
+	var err error
+	v.dbStats = verify.NewTableStats(v.csvStats.RangeSize())
+	if v.deep {
+		err = v.readDBRows(ctx, v.startBlock, v.stopBlock, func(row *verify.Row) {
+			v.dbStats.Add(row)
+		})
+	} else {
+		err = v.countDBRows(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	v.rangeDiffs = verify.CompareRanges(v.csvStats, v.dbStats, v.deep)
+	if !v.deep {
+		return nil
+	}
+
+	// Every differing range holds at least one differing row, so no more ranges than
+	// reported rows are compared
+	rangeDiffs := v.rangeDiffs
+	if len(rangeDiffs) > v.maxDifferences {
+		rangeDiffs = rangeDiffs[:v.maxDifferences]
+	}
+	rangeStarts := make([]uint64, len(rangeDiffs))
+	for i, rangeDiff := range rangeDiffs {
+		rangeStarts[i] = rangeDiff.Start
+	}
+
+	csvRows, err := v.readCSVRangeRows(ctx, rangeStarts)
+	if err != nil {
+		return fmt.Errorf("reading rows of differing ranges: %w", err)
+	}
+
+	for _, rangeStart := range rangeStarts {
+		if len(v.rowDiffs) >= v.maxDifferences {
+			break
+		}
+
+		rowDiffs, err := v.diffRange(ctx, rangeStart, csvRows[rangeStart])
+		if err != nil {
+			return fmt.Errorf("comparing rows of range starting at %d: %w", rangeStart, err)
+		}
+		v.rowDiffs = append(v.rowDiffs, rowDiffs...)
+	}
+	return nil
+}
+
+// readCSVStats lists the CSV files of the table and aggregates the stats of their
+// rows whose first block is in [startBlock, stopBlock), the rows the database is
+// compared against.
+func (v *tableVerifier) readCSVStats(ctx context.Context) error {
+	// Rows are written to the file of the block closing them, the ones opened before
+	// the stop block and closed after it are in the files past the stop block
+	files, err := injectFilesToLoad(v.in, v.entityDesc.Name, 0, v.startBlock)
+	if err != nil {
+		return fmt.Errorf("listing files: %w", err)
+	}
+
+	// Rows are counted per range of the size of the files, by their first block
+	var rangeSize uint64 = 1
+	var filesInRange int
+	for _, filename := range files {
+		fileStartBlock, fileEndBlock, err := bundler.BlockRangeFromFilename(filename)
+		if err != nil {
+			return err
+		}
+		if fileStartBlock < v.stopBlock {
+			filesInRange++
+		}
+		if size := fileEndBlock - fileStartBlock + 1; size > rangeSize {
+			rangeSize = size
+		}
+	}
+	if filesInRange == 0 {
+		return fmt.Errorf("no file to verify")
+	}
+	v.files = files
+
+	header, err := extractFieldsFromFirstLine(ctx, files[0], v.in)
+	if err != nil {
+		return fmt.Errorf("extracting fields from first csv line: %w", err)
+	}
+	v.digester, err = verify.NewRowDigester(v.entityDesc, header, v.stopBlock)
+	if err != nil {
+		return err
+	}
+
+	v.csvStats = verify.NewTableStats(rangeSize)
+	return v.readCSVRows(ctx, files, func(values []*string) error {
+		lower, err := v.digester.LowerBlock(values)
+		if err != nil {
+			return err
+		}
+		if lower < v.startBlock || lower >= v.stopBlock {
+			return nil
+		}
+
+		if !v.deep {
+			v.csvStats.Count(v.csvStats.RangeStart(lower), 1)
+			return nil
+		}
+
+		row, err := v.digester.Digest(values)
+		if err != nil {
+			return err
+		}
+		v.csvStats.Add(row)
+		return nil
+	})
+}
+
+// readCSVRangeRows reads the CSV files once and returns the rows of the ranges
+// starting at rangeStarts, by range start.
+func (v *tableVerifier) readCSVRangeRows(ctx context.Context, rangeStarts []uint64) (map[uint64][]*verify.Row, error) {
+	out := make(map[uint64][]*verify.Row, len(rangeStarts))
+	if len(rangeStarts) == 0 {
+		return out, nil
+	}
+
+	firstStart := rangeStarts[0]
+	for _, rangeStart := range rangeStarts {
+		out[rangeStart] = nil
+		firstStart = min(firstStart, rangeStart)
+	}
+	firstStart = max(firstStart, v.startBlock)
+
+	// Rows are written to the file of the block closing them, so they are in the files
+	// of their range or after
+	var files []string
+	for _, filename := range v.files {
+		_, fileEndBlock, err := bundler.BlockRangeFromFilename(filename)
+		if err != nil {
+			return nil, err
+		}
+		if fileEndBlock >= firstStart {
+			files = append(files, filename)
+		}
+	}
+
+	err := v.readCSVRows(ctx, files, func(values []*string) error {
+		lower, err := v.digester.LowerBlock(values)
+		if err != nil {
+			return err
+		}
+		// The first and last ranges are bounded by the blocks verified, like the stats
+		if lower < v.startBlock || lower >= v.stopBlock {
+			return nil
+		}
+		rangeStart := v.csvStats.RangeStart(lower)
+		if _, found := out[rangeStart]; !found {
+			return nil
+		}
+
+		row, err := v.digester.Digest(values)
+		if err != nil {
+			return err
+		}
+		out[rangeStart] = append(out[rangeStart], row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// diffRange compares the rows of the range starting at rangeStart one by one, csvRows
+// being the ones of the CSV files.
+func (v *tableVerifier) diffRange(ctx context.Context, rangeStart uint64, csvRows []*verify.Row) ([]*verify.RowDiff, error) {
+	// The first and last ranges are bounded by the blocks verified, like the stats
+	rangeStop := min(rangeStart+v.csvStats.RangeSize(), v.stopBlock)
+	rangeStart = max(rangeStart, v.startBlock)
+
+	var dbRows []*verify.Row
+	err := v.readDBRows(ctx, rangeStart, rangeStop, func(row *verify.Row) {
+		dbRows = append(dbRows, row)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return verify.DiffRows(csvRows, dbRows, v.maxDifferences-len(v.rowDiffs)), nil
+}
+
+func (v *tableVerifier) readCSVRows(ctx context.Context, files []string, f func(values []*string) error) error {
+	for _, filename := range files {
+		if err := v.readCSVFile(ctx, filename, f); err != nil {
+			return fmt.Errorf("reading %q: %w", filename, err)
+		}
+	}
+	return nil
+}
+
+func (v *tableVerifier) readCSVFile(ctx context.Context, filename string, f func(values []*string) error) error {
+	fl, err := openCSV(ctx, filename, v.in)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+
+	r := csv.NewReader(fl)
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	if strings.Join(header, ",") != strings.Join(v.digester.Header(), ",") {
+		return fmt.Errorf("header %q differs from the one of the first file %q", header, v.digester.Header())
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		values, err := v.digester.CSVValues(record)
+		if err != nil {
+			return err
+		}
+		if err := f(values); err != nil {
+			return err
+		}
+	}
+}
+
+// blockColumn returns the expression of the first block of the rows.
+func (v *tableVerifier) blockColumn() string {
+	if v.digester.Header()[1] == "block$" {
+		return postgres.QuoteIdentifier("block$")
+	}
+	return "lower(block_range)"
+}
+
+func (v *tableVerifier) countDBRows(ctx context.Context) error {
+	blockColumn := v.blockColumn()
+	rangeSize := v.dbStats.RangeSize()
+	query := postgres.NewStatement("SELECT ").SQL(blockColumn).SQL(" / ").Bind(rangeSize).SQL("::int8 * ").Bind(rangeSize).SQL("::int8, count(*) FROM ").
+		Ident(v.pgSchema, v.entityDesc.Name).
+		SQL(" WHERE ").SQL(blockColumn).SQL(" >= ").Bind(v.startBlock).SQL("::int8 AND ").SQL(blockColumn).SQL(" < ").Bind(v.stopBlock).SQL("::int8").
+		SQL(" GROUP BY 1")
+	rows, err := query.Query(ctx, v.pool)
+	if err != nil {
+		return fmt.Errorf("counting rows: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rangeStart, count int64
+		if err := rows.Scan(&rangeStart, &count); err != nil {
+			return fmt.Errorf("unable to retrieve result row: %w", err)
+		}
+		v.dbStats.Count(uint64(rangeStart), uint64(count))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("counting rows: %w", err)
+	}
+	return nil
+}
+
+// readDBRows calls f with the rows whose first block is in [startBlock, stopBlock).
+func (v *tableVerifier) readDBRows(ctx context.Context, startBlock, stopBlock uint64, f func(row *verify.Row)) error {
+	header := v.digester.Header()
+	blockColumn := v.blockColumn()
+	query := postgres.NewStatement("SELECT ")
+	for i, name := range header {
+		if i > 0 {
+			query.SQL(", ")
+		}
+		query.Ident(name).SQL("::text")
+	}
+	query.SQL(" FROM ").Ident(v.pgSchema, v.entityDesc.Name).
+		SQL(" WHERE ").SQL(blockColumn).SQL(" >= ").Bind(startBlock).SQL("::int8 AND ").SQL(blockColumn).SQL(" < ").Bind(stopBlock).SQL("::int8")
+	rows, err := query.Query(ctx, v.pool)
+	if err != nil {
+		return fmt.Errorf("reading rows: %w", err)
+	}
+	defer rows.Close()
+
+	values := make([]*string, len(header))
+	dest := make([]any, len(header))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("unable to retrieve result row: %w", err)
+		}
+
+		row, err := v.digester.Digest(values)
+		if err != nil {
+			return err
+		}
+		f(row)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reading rows: %w", err)
+	}
+	return nil
+}
+
+func printVerificationReport(verifiers []*tableVerifier) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tSTATUS\tCSV ROWS\tDB ROWS\tDIFFERING RANGES\tERROR")
+	for _, v := range verifiers {
+		status, errMessage := "ok", ""
+		switch {
+		case v.err != nil:
+			status, errMessage = "failed", v.err.Error()
+		case len(v.rangeDiffs) > 0:
+			status = "mismatch"
+		}
+
+		var csvRows, dbRows uint64
+		if v.csvStats != nil {
+			csvRows = v.csvStats.Total()
+		}
+		if v.dbStats != nil {
+			dbRows = v.dbStats.Total()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", v.entityDesc.Name, status, csvRows, dbRows, len(v.rangeDiffs), errMessage)
+	}
+	w.Flush()
+
+	for _, v := range verifiers {
+		if v.err != nil || len(v.rangeDiffs) == 0 {
+			continue
+		}
+
+		fmt.Printf("\nTable %s:\n", v.entityDesc.Name)
+		for i, rangeDiff := range v.rangeDiffs {
+			if i == v.maxDifferences {
+				fmt.Printf("  ... %d more differing ranges\n", len(v.rangeDiffs)-i)
+				break
+			}
+
+			contentDiffers := ""
+			if rangeDiff.DigestDiffers && rangeDiff.CSVCount == rangeDiff.DBCount {
+				contentDiffers = ", content differs"
+			}
+			fmt.Printf("  blocks [%d, %d]: %d rows in CSV files, %d in database%s\n",
+				max(rangeDiff.Start, v.startBlock),
+				min(rangeDiff.Start+v.csvStats.RangeSize(), v.stopBlock)-1,
+				rangeDiff.CSVCount,
+				rangeDiff.DBCount,
+				contentDiffers,
+			)
+		}
+
+		for _, rowDiff := range v.rowDiffs {
+			fmt.Printf("  id %s (block %d): %s\n", rowDiff.ID, rowDiff.LowerBlock, rowDiff.Kind)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	"github.com/streamingfast/substreams-graph-load/verify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableVerifier_ReadCSVStats(t *testing.T) {
+	ctx := context.Background()
+	store, err := dstore.NewStore(t.TempDir(), "", "", false)
+	require.NoError(t, err)
+
+	// Rows are in the file of the block closing them, open ones in the last file
+	files := map[string]string{
+		"pool/0000000000-0000000099.csv": "a,\"[10,50)\"\n",
+		"pool/0000000100-0000000199.csv": "b,\"[50,150)\"\nc,\"[120,180)\"\n",
+		"pool/0000000200-0000000299.csv": "d,\"[210,250)\"\n",
+		"pool/0000000300-0000000399.csv": "e,\"[250,350)\"\nf,\"[310,320)\"\ng,\"[320,)\"\n",
+	}
+	for filename, rows := range files {
+		require.NoError(t, store.WriteObject(ctx, filename, strings.NewReader("id,block_range\n"+rows)))
+	}
+
+	for _, deep := range []bool{false, true} {
+		v := &tableVerifier{
+			entityDesc: &schema.EntityDesc{
+				Name:   "pool",
+				Fields: map[string]*schema.Field{"id": {Name: "id", Type: schema.FieldTypeID}},
+			},
+			in:         store,
+			startBlock: 100,
+			stopBlock:  300,
+			deep:       deep,
+		}
+		require.NoError(t, v.readCSVStats(ctx))
+
+		// b opened before the start block, f and g at or after the stop block, e
+		// opened before the stop block is in a file past it
+		expected := verify.NewTableStats(100)
+		expected.Count(100, 1)
+		expected.Count(200, 2)
+		assert.Equal(t, uint64(3), v.csvStats.Total(), "deep %t", deep)
+		assert.Empty(t, verify.CompareRanges(v.csvStats, expected, false), "deep %t", deep)
+
+		if !deep {
+			continue
+		}
+
+		// The rows of every requested range are read in a single pass over the files
+		rows, err := v.readCSVRangeRows(ctx, []uint64{200, 100})
+		require.NoError(t, err)
+		ids := map[uint64][]string{}
+		for rangeStart, rangeRows := range rows {
+			for _, row := range rangeRows {
+				ids[rangeStart] = append(ids[rangeStart], row.ID)
+			}
+		}
+		assert.Equal(t, map[uint64][]string{100: {"c"}, 200: {"d", "e"}}, ids)
+	}
+}
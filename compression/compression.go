@@ -0,0 +1,150 @@
+package compression
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/streamingfast/dstore"
+)
+
+// Type is the compression applied to the files written in a store, it is
+// reflected in the files extension.
+type Type string
+
+const (
+	None Type = "none"
+	Gzip Type = "gzip"
+	Zstd Type = "zstd"
+)
+
+func Parse(in string) (Type, error) {
+	switch Type(in) {
+	case "", None:
+		return None, nil
+	case Gzip, Zstd:
+		return Type(in), nil
+	}
+
+	return "", fmt.Errorf("invalid compression %q, must be one of %q, %q or %q", in, None, Gzip, Zstd)
+}
+
+// Suffix returns the suffix appended to the extension of compressed files.
+func (t Type) Suffix() string {
+	switch t {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// Extension returns the extension of the files of type fileExtension (e.g.
+// `jsonl`) compressed with this compression.
+func (t Type) Extension(fileExtension string) string {
+	return fileExtension + t.Suffix()
+}
+
+// FromFilename returns the compression of filename based on its extension, None
+// if it is not compressed.
+func FromFilename(filename string) Type {
+	switch {
+	case strings.HasSuffix(filename, Gzip.Suffix()):
+		return Gzip
+	case strings.HasSuffix(filename, Zstd.Suffix()):
+		return Zstd
+	}
+	return None
+}
+
+// NewStore returns a store reading and writing files of type fileExtension
+// compressed with t.
+func NewStore(baseURL string, fileExtension string, t Type, overwrite bool) (dstore.Store, error) {
+	return dstore.NewStore(baseURL, t.Extension(fileExtension), string(t), overwrite)
+}
+
+// Detect returns the extension, among fileExtensions, and the compression of the
+// first file of one of them found in baseURL, found is false when there is none. The
+// walk stops at that file, a folder is expected to hold a single file type and
+// compression, which 'run' enforces when resuming.
+func Detect(ctx context.Context, baseURL string, fileExtensions ...string) (fileExtension string, t Type, found bool, err error) {
+	rawStore, err := dstore.NewStore(baseURL, "", "", false)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	err = rawStore.Walk(ctx, "", func(filename string) error {
+		// Some stores keep walking after StopIteration, ignore the following files
+		if found {
+			return dstore.StopIteration
+		}
+
+		for _, candidateExtension := range fileExtensions {
+			for _, candidate := range []Type{None, Gzip, Zstd} {
+				if strings.HasSuffix(filename, "."+candidate.Extension(candidateExtension)) {
+					fileExtension, t, found = candidateExtension, candidate, true
+					return dstore.StopIteration
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", false, fmt.Errorf("walking %q: %w", baseURL, err)
+	}
+
+	return fileExtension, t, found, nil
+}
+
+// DetectStore returns a store reading the files of type fileExtension found in
+// baseURL, with the compression inferred from their extension. When baseURL holds
+// no such file, fallback is used.
+func DetectStore(ctx context.Context, baseURL string, fileExtension string, fallback Type) (dstore.Store, Type, error) {
+	_, t, found, err := Detect(ctx, baseURL, fileExtension)
+	if err != nil {
+		return nil, "", err
+	}
+	if !found {
+		t = fallback
+	}
+
+	store, err := NewStore(baseURL, fileExtension, t, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return store, t, nil
+}
+
+// NewReader returns a reader decompressing reader according to t, closing it
+// closes reader.
+func NewReader(reader io.ReadCloser, t Type) (io.ReadCloser, error) {
+	switch t {
+	case Gzip:
+		gzipReader, err := dstore.NewGZipReadCloser(reader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create gzip reader: %w", err)
+		}
+		return gzipReader, nil
+	case Zstd:
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create zstd reader: %w", err)
+		}
+		return &zstdReadCloser{Decoder: zstdReader, underlying: reader}, nil
+	}
+
+	return reader, nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+	underlying io.Closer
+}
+
+func (r *zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return r.underlying.Close()
+}
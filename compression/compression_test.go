@@ -0,0 +1,107 @@
+package compression
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for in, expected := range map[string]Type{"": None, "none": None, "gzip": Gzip, "zstd": Zstd} {
+		actual, err := Parse(in)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+
+	_, err := Parse("lz4")
+	assert.Error(t, err)
+}
+
+func TestDetectStore(t *testing.T) {
+	ctx := context.Background()
+
+	for _, compression := range []Type{None, Gzip, Zstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			folder := t.TempDir()
+
+			store, err := NewStore(folder, "jsonl", compression, false)
+			require.NoError(t, err)
+			require.NoError(t, store.WriteObject(ctx, "0000000000-0000000999", strings.NewReader("line\n")))
+
+			detected, detectedType, err := DetectStore(ctx, folder, "jsonl", None)
+			require.NoError(t, err)
+			assert.Equal(t, compression, detectedType)
+
+			var filenames []string
+			require.NoError(t, detected.Walk(ctx, "", func(filename string) error {
+				filenames = append(filenames, filename)
+				return nil
+			}))
+			assert.Equal(t, []string{"0000000000-0000000999"}, filenames)
+
+			reader, err := detected.OpenObject(ctx, "0000000000-0000000999")
+			require.NoError(t, err)
+			defer reader.Close()
+
+			content, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, "line\n", string(content))
+		})
+	}
+}
+
+func TestDetectStore_Fallback(t *testing.T) {
+	_, detectedType, err := DetectStore(context.Background(), filepath.Join(t.TempDir(), "missing"), "jsonl", Zstd)
+	require.NoError(t, err)
+	assert.Equal(t, Zstd, detectedType)
+}
+
+func TestDetect(t *testing.T) {
+	folder := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(folder, "0000000000-0000000999.binpb.zst"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(folder, "state.json"), nil, 0644))
+
+	fileExtension, detectedType, found, err := Detect(context.Background(), folder, "jsonl", "binpb")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "binpb", fileExtension)
+	assert.Equal(t, Zstd, detectedType)
+
+	_, _, found, err = Detect(context.Background(), folder, "jsonl")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestNewReader(t *testing.T) {
+	ctx := context.Background()
+
+	for _, compression := range []Type{None, Gzip, Zstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			folder := t.TempDir()
+
+			store, err := NewStore(folder, "csv", compression, false)
+			require.NoError(t, err)
+			require.NoError(t, store.WriteObject(ctx, "0000000000-0000000999", strings.NewReader("id,block_range\n")))
+
+			filename := "0000000000-0000000999." + compression.Extension("csv")
+			assert.Equal(t, compression, FromFilename(filename))
+
+			file, err := os.Open(filepath.Join(folder, filename))
+			require.NoError(t, err)
+
+			reader, err := NewReader(file, FromFilename(filename))
+			require.NoError(t, err)
+			defer reader.Close()
+
+			content, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, "id,block_range\n", string(content))
+		})
+	}
+}
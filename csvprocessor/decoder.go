@@ -0,0 +1,252 @@
+package csvprocessor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+)
+
+// newChangesDecoder returns the decoder of the entity changes of a bundle file. JSONL
+// lines are scanned straight into the protobuf structs by decodeEntityChangeJSON,
+// other file types use the decoder of the bundler.
+func newChangesDecoder(reader io.Reader, fileType writer.FileType) (bundler.Decoder, error) {
+	if fileType == writer.FileTypeJSONL {
+		return &jsonlDecoder{reader: bufio.NewReader(reader)}, nil
+	}
+	return bundler.NewDecoder(reader, fileType)
+}
+
+type jsonlDecoder struct {
+	reader *bufio.Reader
+}
+
+func (d *jsonlDecoder) Decode() (*graphload.EntityChangeAtBlockNum, error) {
+	line, err := d.reader.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("unable to read newline: %w", err)
+	}
+
+	change := &graphload.EntityChangeAtBlockNum{}
+	if err := decodeEntityChangeJSON(line, change); err != nil {
+		return nil, fmt.Errorf("unable to decode line: %w", err)
+	}
+	return change, nil
+}
+
+// decodeEntityChangeJSON decodes an entity change line as written by `run`, like
+// EntityChangeAtBlockNum.UnmarshalJSON, without going through encoding/json: the line
+// is scanned straight into the protobuf structs, without any intermediate
+// representation, and unknown keys are ignored.
+func decodeEntityChangeJSON(data []byte, e *graphload.EntityChangeAtBlockNum) error {
+	*e = graphload.EntityChangeAtBlockNum{}
+
+	s := &jsonScanner{data: data}
+	if s.null() {
+		return s.end()
+	}
+
+	err := s.object(func(key []byte) (err error) {
+		switch string(key) {
+		case "entity_change":
+			e.EntityChange, err = s.entityChange()
+		case "block_num":
+			e.BlockNum, err = s.uint64()
+		case "index":
+			e.Index, err = s.uint64()
+		default:
+			err = s.skip()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.end()
+}
+
+func (s *jsonScanner) entityChange() (*pbentity.EntityChange, error) {
+	if s.null() {
+		return nil, nil
+	}
+
+	change := &pbentity.EntityChange{}
+	err := s.object(func(key []byte) (err error) {
+		switch string(key) {
+		case "entity":
+			change.Entity, err = s.string()
+		case "id":
+			change.Id, err = s.string()
+		case "ordinal":
+			change.Ordinal, err = s.uint64()
+		case "operation":
+			change.Operation, err = s.operation()
+		case "fields":
+			change.Fields, err = s.fields()
+		default:
+			err = s.skip()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return change, nil
+}
+
+func (s *jsonScanner) operation() (pbentity.EntityChange_Operation, error) {
+	if s.peek() != '"' {
+		operation, err := s.int32()
+		return pbentity.EntityChange_Operation(operation), err
+	}
+
+	name, err := s.rawString()
+	if err != nil {
+		return 0, err
+	}
+	operation, found := pbentity.EntityChange_Operation_value[string(name)]
+	if !found {
+		return 0, fmt.Errorf("unknown operation %q", name)
+	}
+	return pbentity.EntityChange_Operation(operation), nil
+}
+
+func (s *jsonScanner) fields() (fields []*pbentity.Field, err error) {
+	if s.null() {
+		return nil, nil
+	}
+
+	err = s.array(func() error {
+		field := &pbentity.Field{}
+		err := s.object(func(key []byte) (err error) {
+			switch string(key) {
+			case "name":
+				field.Name, err = s.string()
+			case "new_value":
+				if field.NewValue, err = s.value(); err != nil {
+					err = fmt.Errorf("field %q new value: %w", field.Name, err)
+				}
+			case "old_value":
+				if field.OldValue, err = s.value(); err != nil {
+					err = fmt.Errorf("field %q old value: %w", field.Name, err)
+				}
+			default:
+				err = s.skip()
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		fields = append(fields, field)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+// value decodes a `pbentity.Value`, nil for null, untyped for a null `Typed`.
+func (s *jsonScanner) value() (*pbentity.Value, error) {
+	if s.null() {
+		return nil, nil
+	}
+
+	out := &pbentity.Value{}
+	typedSet := false
+	err := s.object(func(key []byte) error {
+		if string(key) != "Typed" {
+			return s.skip()
+		}
+		if s.null() {
+			return nil
+		}
+
+		typedSet = true
+		return s.object(func(variant []byte) (err error) {
+			switch string(variant) {
+			case "Int32":
+				var v int32
+				v, err = s.int32()
+				out.Typed = &pbentity.Value_Int32{Int32: v}
+			case "Bigdecimal":
+				var v string
+				v, err = s.string()
+				out.Typed = &pbentity.Value_Bigdecimal{Bigdecimal: v}
+			case "Bigint":
+				var v string
+				v, err = s.string()
+				out.Typed = &pbentity.Value_Bigint{Bigint: v}
+			case "String_":
+				var v string
+				v, err = s.string()
+				out.Typed = &pbentity.Value_String_{String_: v}
+			case "Bytes":
+				var v string
+				v, err = s.string()
+				out.Typed = &pbentity.Value_Bytes{Bytes: v}
+			case "Bool":
+				var v bool
+				v, err = s.bool()
+				out.Typed = &pbentity.Value_Bool{Bool: v}
+			case "Array":
+				var v *pbentity.Array
+				v, err = s.arrayValue()
+				out.Typed = &pbentity.Value_Array{Array: v}
+			default:
+				err = fmt.Errorf("unknown value type %q", variant)
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if typedSet && out.Typed == nil {
+		return nil, fmt.Errorf("unknown value type")
+	}
+
+	return out, nil
+}
+
+func (s *jsonScanner) arrayValue() (*pbentity.Array, error) {
+	array := &pbentity.Array{}
+	if s.null() {
+		return array, nil
+	}
+
+	err := s.object(func(key []byte) error {
+		if string(key) != "value" {
+			return s.skip()
+		}
+		if s.null() {
+			return nil
+		}
+
+		return s.array(func() error {
+			elem, err := s.value()
+			if err != nil {
+				return fmt.Errorf("array element %d: %w", len(array.Value), err)
+			}
+			array.Value = append(array.Value, elem)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return array, nil
+}
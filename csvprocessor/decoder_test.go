@@ -0,0 +1,153 @@
+package csvprocessor
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// decodeTestLines are entity change lines decoded the same by decodeEntityChangeJSON
+// and encoding/json, through EntityChangeAtBlockNum.UnmarshalJSON.
+var decodeTestLines = []string{
+	`{"entity_change":{"entity":"Pool","id":"0xabc","ordinal":7,"operation":2,"fields":[` +
+		`{"name":"int","new_value":{"Typed":{"Int32":-2147483648}},"old_value":{"Typed":{"Int32":2147483647}}},` +
+		`{"name":"bigint","new_value":{"Typed":{"Bigint":"-123456789012345678901234567890"}}},` +
+		`{"name":"bigdecimal","new_value":{"Typed":{"Bigdecimal":"1.5e-10"}}},` +
+		`{"name":"string","new_value":{"Typed":{"String_":"héllo \"q\" \\ \/ \b\f\n\r\t 😀 <>&"}}},` +
+		`{"name":"bytes","new_value":{"Typed":{"Bytes":"AQID"}}},` +
+		`{"name":"bool","new_value":{"Typed":{"Bool":true}},"old_value":{"Typed":{"Bool":false}}},` +
+		`{"name":"untyped","new_value":{"Typed":null}},` +
+		`{"name":"null","new_value":null,"old_value":null}` +
+		`]},"block_num":12,"index":3}`,
+	// Nested arrays, empty and null ones included
+	`{"entity_change":{"id":"a","fields":[{"name":"matrix","new_value":{"Typed":{"Array":{"value":[` +
+		`{"Typed":{"Array":{"value":[{"Typed":{"Int32":1}},{"Typed":{"Array":{"value":[{"Typed":{"String_":"deep"}}]}}}]}}},` +
+		`{"Typed":{"Array":{"value":[]}}},` +
+		`{"Typed":{"Array":{"value":null}}},` +
+		`{"Typed":{"Array":{}}},` +
+		`null` +
+		`]}}}}]},"block_num":1}`,
+	// Unknown keys at every level, whatever their value
+	`{"unknown":[1,{"a":null},"x\"y",-2.5e3,true,false,[[]]],"entity_change":{"extra":{"b":[{}]},"entity":"Pool","id":"a",` +
+		`"fields":[{"extra":1,"name":"v","new_value":{"other":"x","Typed":{"Bool":true}}},` +
+		`{"name":"arr","new_value":{"Typed":{"Array":{"extra":null,"value":[{"Typed":{"Int32":0}}]}}}}],"ordinal":0},"index":0,"block_num":18446744073709551615}`,
+	// Spaces everywhere, and a line without entity change
+	" { \"block_num\" : 5 , \"entity_change\" : { \"id\" : \"a\" , \"fields\" : [ ] } } \n",
+	`{"block_num":5,"entity_change":null,"index":2}`,
+	`null`,
+}
+
+func decodeWithEncodingJSON(data []byte) (*graphload.EntityChangeAtBlockNum, error) {
+	out := &graphload.EntityChangeAtBlockNum{}
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func assertSameEntityChange(t testing.TB, expected, actual *graphload.EntityChangeAtBlockNum, msgAndArgs ...any) {
+	assert.Equal(t, expected.BlockNum, actual.BlockNum, msgAndArgs...)
+	assert.Equal(t, expected.Index, actual.Index, msgAndArgs...)
+	assert.True(t, proto.Equal(expected.EntityChange, actual.EntityChange), "expected %s, got %s: %v", expected.EntityChange, actual.EntityChange, msgAndArgs)
+}
+
+func TestDecodeEntityChangeJSON_MatchesEncodingJSON(t *testing.T) {
+	lines := append([]string{}, decodeTestLines...)
+	for _, change := range []*graphload.EntityChangeAtBlockNum{testEntityChange(10, "0xabc"), testEntityChange(11, "é\"\\\n ")} {
+		data, err := json.Marshal(change)
+		require.NoError(t, err)
+		lines = append(lines, string(data))
+	}
+
+	for _, line := range lines {
+		expected, err := decodeWithEncodingJSON([]byte(line))
+		require.NoError(t, err, line)
+
+		actual := &graphload.EntityChangeAtBlockNum{}
+		require.NoError(t, decodeEntityChangeJSON([]byte(line), actual), line)
+		assertSameEntityChange(t, expected, actual, line)
+	}
+}
+
+func TestDecodeEntityChangeJSON(t *testing.T) {
+	// Operations may also be written by name
+	out := &graphload.EntityChangeAtBlockNum{}
+	require.NoError(t, decodeEntityChangeJSON([]byte(`{"entity_change":{"id":"a","operation":"OPERATION_CREATE"}}`), out))
+	assert.Equal(t, pbentity.EntityChange_OPERATION_CREATE, out.EntityChange.Operation)
+
+	for _, line := range []string{
+		``,
+		`{"block_num":1`,
+		`{"block_num":1}{}`,
+		`{"block_num":-1}`,
+		`{"block_num":1.5}`,
+		`{"block_num":18446744073709551616}`,
+		`{"entity_change":{"id":"unterminated}}`,
+		`{"entity_change":{"fields":[null]}}`,
+		`{"entity_change":{"fields":[{"name":"int","new_value":{"Typed":{"Int32":2147483648}}}]}}`,
+		`{"entity_change":{"fields":[{"name":"int","new_value":{"Typed":{"Int64":1}}}]}}`,
+		`{"entity_change":{"fields":[{"name":"int","new_value":{"Typed":{}}}]}}`,
+		`{"entity_change":{"operation":"OPERATION_UNKNOWN_TO_US"}}`,
+		`{"block_num":1,}`,
+	} {
+		assert.Error(t, decodeEntityChangeJSON([]byte(line), &graphload.EntityChangeAtBlockNum{}), line)
+	}
+}
+
+func TestNewChangesDecoder(t *testing.T) {
+	changes := []*graphload.EntityChangeAtBlockNum{testEntityChange(10, "0xabc"), testEntityChange(11, "0xdef")}
+
+	for _, fileType := range writer.FileTypes {
+		var data bytes.Buffer
+		encoder, err := bundler.NewEncoder(fileType)
+		require.NoError(t, err)
+		for _, change := range changes {
+			line, err := encoder(change)
+			require.NoError(t, err)
+			data.Write(line)
+		}
+
+		decoder, err := newChangesDecoder(&data, fileType)
+		require.NoError(t, err)
+		for _, expected := range changes {
+			actual, err := decoder.Decode()
+			require.NoError(t, err, fileType)
+			assertSameEntityChange(t, expected, actual, fileType)
+		}
+		_, err = decoder.Decode()
+		assert.Equal(t, io.EOF, err, fileType)
+	}
+}
+
+// FuzzDecodeEntityChangeJSON checks that decodeEntityChangeJSON never panics, and that
+// it decodes what encoding/json accepts, once written back the way `run` writes it,
+// to the same entity change.
+func FuzzDecodeEntityChangeJSON(f *testing.F) {
+	for _, line := range decodeTestLines {
+		f.Add([]byte(line))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeEntityChangeJSON(data, &graphload.EntityChangeAtBlockNum{})
+
+		expected, err := decodeWithEncodingJSON(data)
+		if err != nil {
+			return
+		}
+		canonical, err := json.Marshal(expected)
+		require.NoError(t, err)
+
+		actual := &graphload.EntityChangeAtBlockNum{}
+		require.NoError(t, decodeEntityChangeJSON(canonical, actual), string(canonical))
+		assertSameEntityChange(t, expected, actual, string(canonical))
+	})
+}
@@ -3,21 +3,28 @@ package csvprocessor
 import (
 	"fmt"
 
+	graphload "github.com/streamingfast/substreams-graph-load"
 	"github.com/streamingfast/substreams-graph-load/schema"
 	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
 )
 
-const FieldTypeBigint = "Bigint"
-const FieldTypeString = "String_"
-const FieldTypeBigdecimal = "Bigdecimal"
-const FieldTypeBytes = "Bytes"
-const FieldTypeInt = "Int32"
-const FieldTypeFloat = "Float"
-const FieldTypeBoolean = "Boolean"
+// nullValue marks a field explicitly set to null by an entity change, as opposed to
+// a nil value for a field the change did not touch.
+var nullValue = &pbentity.Value{}
 
 type Entity struct {
 	StartBlock uint64
-	Fields     map[string]interface{}
+	ID         string
+	// Values holds the field values, indexed like the entity descriptor's
+	// OrderedFields(), nil for fields never set.
+	Values []*pbentity.Value
+
+	// exported is set on entities loaded from a snapshot, whose current version was
+	// already exported as an open row by the run that wrote the snapshot
+	exported bool
+
+	// size is the estimated size of the entity when held by a memory entity store
+	size uint64
 }
 
 func blockRange(start, stop uint64) string {
@@ -30,110 +37,171 @@ func blockRange(start, stop uint64) string {
 
 func (e *Entity) Update(newEnt *Entity) {
 	e.StartBlock = newEnt.StartBlock
-	for k, v := range newEnt.Fields {
-		e.Fields[k] = v
+	e.exported = false
+	for i, v := range newEnt.Values {
+		if v != nil {
+			e.Values[i] = v
+		}
 	}
 }
 
 func (e *Entity) ValidateFields(desc *schema.EntityDesc) error {
-	for _, field := range desc.OrderedFields() {
-		if !field.Nullable && e.Fields[field.Name] == nil {
-			return fmt.Errorf("field %q cannot be nil on entity %s at ID %s", field.Name, field.Type, e.Fields["id"])
+	for i, field := range desc.OrderedFields() {
+		if field.Name == "id" {
+			continue
+		}
+		if !field.Nullable && isNull(e.Values[i]) {
+			return fmt.Errorf("field %q cannot be nil on entity %s at ID %s", field.Name, field.Type, e.ID)
 		}
 	}
 
 	return nil
 }
 
-func newEntity(in *EntityChangeAtBlockNum, desc *schema.EntityDesc) (*Entity, error) {
+func isNull(v *pbentity.Value) bool {
+	return v == nil || v.Typed == nil
+}
+
+// entityDecoder maps entity changes to entities holding typed values checked
+// against the entity descriptor, caching the position of each field by its raw name.
+type entityDecoder struct {
+	desc    *schema.EntityDesc
+	fields  []*schema.Field
+	indexes map[string]int
+}
+
+func newEntityDecoder(desc *schema.EntityDesc) *entityDecoder {
+	return &entityDecoder{
+		desc:    desc,
+		fields:  desc.OrderedFields(),
+		indexes: make(map[string]int),
+	}
+}
+
+func (d *entityDecoder) fieldIndex(name string) (int, error) {
+	if i, found := d.indexes[name]; found {
+		return i, nil
+	}
+
+	normalizedName := schema.NormalizeField(name)
+	for i, f := range d.fields {
+		if f.Name == normalizedName {
+			d.indexes[name] = i
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid field %q not part of entity", normalizedName)
+}
+
+func (d *entityDecoder) decode(in *graphload.EntityChangeAtBlockNum) (*Entity, error) {
+	if in.EntityChange == nil {
+		return nil, fmt.Errorf("missing entity change")
+	}
 	if in.EntityChange.Operation == pbentity.EntityChange_OPERATION_DELETE {
 		return nil, nil
 	}
 
 	e := &Entity{
 		StartBlock: in.BlockNum,
+		ID:         in.EntityChange.Id,
+		Values:     make([]*pbentity.Value, len(d.fields)),
 	}
-	e.Fields = map[string]interface{}{
-		"id": in.EntityChange.ID,
-	}
+
 	for _, f := range in.EntityChange.Fields {
-		normalizedName := schema.NormalizeField(f.Name)
-		fieldDesc, ok := desc.Fields[normalizedName]
-		if !ok {
-			return nil, fmt.Errorf("invalid field %q not part of entity", normalizedName)
+		i, err := d.fieldIndex(f.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		field := d.fields[i]
+		if err := checkValue(f.NewValue, field); err != nil {
+			return nil, fmt.Errorf("invalid field %q: %w", field.Name, err)
 		}
 
-		var expectedTypedField string
-
-		switch fieldDesc.Type {
-		case schema.FieldTypeID, schema.FieldTypeString:
-			expectedTypedField = FieldTypeString
-		case schema.FieldTypeBigInt:
-			expectedTypedField = FieldTypeBigint
-		case schema.FieldTypeBigDecimal:
-			expectedTypedField = FieldTypeBigdecimal
-		case schema.FieldTypeBytes:
-			expectedTypedField = FieldTypeBytes
-		case schema.FieldTypeInt:
-			expectedTypedField = FieldTypeInt
-		case schema.FieldTypeFloat:
-			expectedTypedField = FieldTypeFloat
-		case schema.FieldTypeBoolean:
-			expectedTypedField = FieldTypeBoolean
-		default:
-			return nil, fmt.Errorf("invalid field type: %q", fieldDesc.Type)
+		if f.NewValue == nil {
+			e.Values[i] = nullValue
+			continue
 		}
+		e.Values[i] = f.NewValue
+	}
 
-		if fieldDesc.Array {
-			arr, ok := f.NewValue.Typed["Array"]
-			if !ok {
-				return nil, fmt.Errorf("invalid field %q: expected array of %s, found %+v", normalizedName, fieldDesc.Type, f.NewValue.Typed)
+	return e, nil
+}
 
-			}
-			asMap, ok := arr.(map[string]interface{})
-			if !ok {
-				return nil, fmt.Errorf("invalid field %q: expected array of %s, found %+v", normalizedName, fieldDesc.Type, arr)
-			}
-			val, ok := asMap["value"]
-			if !ok {
-				e.Fields[normalizedName] = []interface{}{}
-				continue
-			}
+// checkValue returns an error if v does not hold a value of the field's type, a
+// null value is always accepted here, see ValidateFields.
+func checkValue(v *pbentity.Value, field *schema.Field) error {
+	if isNull(v) {
+		return nil
+	}
 
-			array, ok := val.([]interface{})
-			if !ok {
-				return nil, fmt.Errorf("invalid field %q: expected array for map value, found %+v", normalizedName, val)
-			}
-			out := make([]interface{}, len(array))
-			for i := range array {
-				out[i] = array[i].(map[string]interface{})["Typed"].(map[string]interface{})[expectedTypedField]
-			}
-			e.Fields[normalizedName] = out
+	if !field.Array {
+		return checkScalar(v, field.Type)
+	}
+
+	array, ok := v.Typed.(*pbentity.Value_Array)
+	if !ok {
+		return fmt.Errorf("expected array of %s, got %s", field.Type, valueTypeName(v))
+	}
 
+	for i, elem := range array.Array.GetValue() {
+		if isNull(elem) {
+			if !field.Nullable {
+				return fmt.Errorf("element %d: expected %s, got null", i, field.Type)
+			}
 			continue
 		}
 
-		v, ok := f.NewValue.Typed[expectedTypedField]
-		if !ok {
-			return nil, fmt.Errorf("invalid field %q: wrong type %q, got %+v", normalizedName, fieldDesc.Type, f.NewValue.Typed)
+		if err := checkScalar(elem, field.Type); err != nil {
+			return fmt.Errorf("element %d: %w", i, err)
 		}
-		e.Fields[normalizedName] = v
 	}
 
-	return e, nil
+	return nil
 }
 
-type EntityChangeAtBlockNum struct {
-	EntityChange struct {
-		Entity    string                          `json:"entity"`
-		ID        string                          `json:"id"`
-		Operation pbentity.EntityChange_Operation `json:"operation"`
-		Fields    []struct {
-			Name     string `json:"name"`
-			NewValue struct {
-				Typed map[string]interface{} `json:"Typed"`
-			} `json:"new_value"`
-		}
-	} `json:"entity_change"`
-	BlockNum uint64 `json:"block_num"`
+func checkScalar(v *pbentity.Value, fieldType schema.FieldType) error {
+	var ok bool
+	switch fieldType {
+	case schema.FieldTypeID, schema.FieldTypeString:
+		_, ok = v.Typed.(*pbentity.Value_String_)
+	case schema.FieldTypeBigInt:
+		_, ok = v.Typed.(*pbentity.Value_Bigint)
+	case schema.FieldTypeBigDecimal:
+		_, ok = v.Typed.(*pbentity.Value_Bigdecimal)
+	case schema.FieldTypeBytes:
+		_, ok = v.Typed.(*pbentity.Value_Bytes)
+	case schema.FieldTypeInt:
+		_, ok = v.Typed.(*pbentity.Value_Int32)
+	case schema.FieldTypeBoolean:
+		_, ok = v.Typed.(*pbentity.Value_Bool)
+	default:
+		return fmt.Errorf("unsupported field type %q", fieldType)
+	}
+
+	if !ok {
+		return fmt.Errorf("expected %s, got %s", fieldType, valueTypeName(v))
+	}
+	return nil
+}
+
+func valueTypeName(v *pbentity.Value) string {
+	switch v.Typed.(type) {
+	case *pbentity.Value_Int32:
+		return "Int32"
+	case *pbentity.Value_Bigdecimal:
+		return "Bigdecimal"
+	case *pbentity.Value_Bigint:
+		return "Bigint"
+	case *pbentity.Value_String_:
+		return "String"
+	case *pbentity.Value_Bytes:
+		return "Bytes"
+	case *pbentity.Value_Bool:
+		return "Bool"
+	case *pbentity.Value_Array:
+		return "Array"
+	}
+	return "null"
 }
@@ -0,0 +1,461 @@
+package csvprocessor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// EntityStore holds the live mutable entities of the processor, keyed by ID.
+// Entities returned by Get may be copies, they must be Put back once modified.
+type EntityStore interface {
+	Get(id string) (ent *Entity, found bool, err error)
+	Put(ent *Entity) error
+	Delete(id string) error
+	// Iterate calls f on every entity of the store, in no particular order.
+	Iterate(f func(ent *Entity) error) error
+	Len() int
+	Close() error
+}
+
+type EntityStoreType string
+
+const (
+	EntityStoreMemory EntityStoreType = "memory"
+	EntityStoreDisk   EntityStoreType = "disk"
+)
+
+func ParseEntityStoreType(in string) (EntityStoreType, error) {
+	switch t := EntityStoreType(in); t {
+	case EntityStoreMemory, EntityStoreDisk:
+		return t, nil
+	}
+	return "", fmt.Errorf("invalid entity store %q, must be one of %q or %q", in, EntityStoreMemory, EntityStoreDisk)
+}
+
+// NewEntityStore creates the entity store of the given type. The disk store keeps
+// its data in a temporary folder created under dir, the OS temporary folder when
+// empty. A memory store with a non-nil memoryBudget moves its entities to a disk
+// store once the estimated size of all the stores sharing the budget exceeds it.
+func NewEntityStore(storeType EntityStoreType, dir string, memoryBudget *MemoryBudget, logger *zap.Logger) (EntityStore, error) {
+	switch storeType {
+	case EntityStoreMemory:
+		if memoryBudget == nil {
+			return newMemoryEntityStore(), nil
+		}
+		return &thresholdEntityStore{
+			EntityStore: newMemoryEntityStore(),
+			dir:         dir,
+			budget:      memoryBudget,
+			logger:      logger,
+		}, nil
+	case EntityStoreDisk:
+		return newDiskEntityStore(dir)
+	}
+
+	return nil, fmt.Errorf("invalid entity store %q", storeType)
+}
+
+// MemoryBudget is the estimated size, in bytes, shared by the memory entity stores
+// of the processors running concurrently, so that peak memory does not grow with
+// their count.
+type MemoryBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewMemoryBudget returns a budget of limit bytes, nil when limit is 0 meaning
+// entities are never moved to disk.
+func NewMemoryBudget(limit uint64) *MemoryBudget {
+	if limit == 0 {
+		return nil
+	}
+	return &MemoryBudget{limit: int64(limit)}
+}
+
+// add records delta more bytes used and returns whether the budget is exceeded.
+func (b *MemoryBudget) add(delta int64) bool {
+	return b.used.Add(delta) > b.limit
+}
+
+type memoryEntityStore struct {
+	entities map[string]*Entity
+	size     uint64
+}
+
+func newMemoryEntityStore() *memoryEntityStore {
+	return &memoryEntityStore{entities: make(map[string]*Entity)}
+}
+
+func (s *memoryEntityStore) Get(id string) (*Entity, bool, error) {
+	ent, found := s.entities[id]
+	return ent, found, nil
+}
+
+func (s *memoryEntityStore) Put(ent *Entity) error {
+	if prev, found := s.entities[ent.ID]; found {
+		s.size -= prev.size
+	}
+
+	ent.size = estimateSize(ent)
+	s.size += ent.size
+	s.entities[ent.ID] = ent
+	return nil
+}
+
+func (s *memoryEntityStore) Delete(id string) error {
+	if prev, found := s.entities[id]; found {
+		s.size -= prev.size
+		delete(s.entities, id)
+	}
+	return nil
+}
+
+func (s *memoryEntityStore) Iterate(f func(ent *Entity) error) error {
+	for _, ent := range s.entities {
+		if err := f(ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryEntityStore) Len() int {
+	return len(s.entities)
+}
+
+func (s *memoryEntityStore) Close() error {
+	s.entities = nil
+	return nil
+}
+
+// estimateSize approximates the memory used by an entity, map and pointer
+// overheads included.
+func estimateSize(ent *Entity) uint64 {
+	size := uint64(96 + 2*len(ent.ID) + 8*len(ent.Values))
+	for _, v := range ent.Values {
+		size += valueSize(v)
+	}
+	return size
+}
+
+func valueSize(v *pbentity.Value) uint64 {
+	if isNull(v) || v == nullValue {
+		return 0
+	}
+
+	size := uint64(64)
+	switch typed := v.Typed.(type) {
+	case *pbentity.Value_String_:
+		size += uint64(len(typed.String_))
+	case *pbentity.Value_Bigint:
+		size += uint64(len(typed.Bigint))
+	case *pbentity.Value_Bigdecimal:
+		size += uint64(len(typed.Bigdecimal))
+	case *pbentity.Value_Bytes:
+		size += uint64(len(typed.Bytes))
+	case *pbentity.Value_Array:
+		for _, elem := range typed.Array.GetValue() {
+			size += 8 + valueSize(elem)
+		}
+	}
+	return size
+}
+
+// thresholdEntityStore is a memory store moving its entities to a disk store once
+// the memory budget it shares with the other stores is exceeded.
+type thresholdEntityStore struct {
+	EntityStore
+
+	dir    string
+	budget *MemoryBudget
+	logger *zap.Logger
+	onDisk bool
+	// accounted is the size of the memory store last added to the budget
+	accounted uint64
+}
+
+func (s *thresholdEntityStore) Put(ent *Entity) error {
+	if err := s.EntityStore.Put(ent); err != nil {
+		return err
+	}
+
+	return s.account()
+}
+
+func (s *thresholdEntityStore) Delete(id string) error {
+	if err := s.EntityStore.Delete(id); err != nil {
+		return err
+	}
+
+	return s.account()
+}
+
+func (s *thresholdEntityStore) Close() error {
+	s.release()
+	return s.EntityStore.Close()
+}
+
+func (s *thresholdEntityStore) release() {
+	s.budget.add(-int64(s.accounted))
+	s.accounted = 0
+}
+
+// account reports the size change of the memory store to the budget, moving its
+// entities to disk if the budget is exceeded.
+func (s *thresholdEntityStore) account() error {
+	if s.onDisk {
+		return nil
+	}
+
+	memoryStore := s.EntityStore.(*memoryEntityStore)
+	exceeded := s.budget.add(int64(memoryStore.size) - int64(s.accounted))
+	s.accounted = memoryStore.size
+	if !exceeded || memoryStore.Len() == 0 {
+		return nil
+	}
+
+	s.logger.Info("entity store memory threshold reached, moving entities to disk",
+		zap.Int("entity_count", memoryStore.Len()),
+		zap.Uint64("estimated_size", memoryStore.size),
+		zap.Int64("budget_used", s.budget.used.Load()),
+		zap.Int64("budget", s.budget.limit),
+	)
+
+	diskStore, err := newDiskEntityStore(s.dir)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	err = memoryStore.Iterate(func(ent *Entity) error {
+		batch.Put([]byte(ent.ID), encodeEntity(ent))
+		if batch.Len() >= 10_000 {
+			if err := diskStore.db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	})
+	if err == nil {
+		err = diskStore.db.Write(batch, nil)
+	}
+	if err != nil {
+		diskStore.Close()
+		return fmt.Errorf("moving entities to disk: %w", err)
+	}
+	diskStore.count = memoryStore.Len()
+
+	memoryStore.Close()
+	s.release()
+	s.EntityStore = diskStore
+	s.onDisk = true
+
+	s.logger.Info("entities moved to disk", zap.String("path", diskStore.path))
+	return nil
+}
+
+// diskEntityStore keeps the entities in an embedded LevelDB database, removed on
+// Close.
+type diskEntityStore struct {
+	db    *leveldb.DB
+	path  string
+	count int
+}
+
+func newDiskEntityStore(dir string) (*diskEntityStore, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("creating entity store folder: %w", err)
+		}
+	}
+
+	path, err := os.MkdirTemp(dir, "entities-")
+	if err != nil {
+		return nil, fmt.Errorf("creating entity store folder: %w", err)
+	}
+
+	db, err := leveldb.OpenFile(path, &opt.Options{
+		WriteBuffer:        64 * opt.MiB,
+		BlockCacheCapacity: 128 * opt.MiB,
+	})
+	if err != nil {
+		os.RemoveAll(path)
+		return nil, fmt.Errorf("opening entity store %q: %w", path, err)
+	}
+
+	return &diskEntityStore{db: db, path: path}, nil
+}
+
+func (s *diskEntityStore) Get(id string) (*Entity, bool, error) {
+	data, err := s.db.Get([]byte(id), nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("reading entity %q: %w", id, err)
+	}
+
+	ent, err := decodeEntity(id, data)
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding entity %q: %w", id, err)
+	}
+	return ent, true, nil
+}
+
+func (s *diskEntityStore) Put(ent *Entity) error {
+	key := []byte(ent.ID)
+	found, err := s.db.Has(key, nil)
+	if err != nil {
+		return fmt.Errorf("reading entity %q: %w", ent.ID, err)
+	}
+
+	if err := s.db.Put(key, encodeEntity(ent), nil); err != nil {
+		return fmt.Errorf("writing entity %q: %w", ent.ID, err)
+	}
+	if !found {
+		s.count++
+	}
+	return nil
+}
+
+func (s *diskEntityStore) Delete(id string) error {
+	key := []byte(id)
+	found, err := s.db.Has(key, nil)
+	if err != nil {
+		return fmt.Errorf("reading entity %q: %w", id, err)
+	}
+	if !found {
+		return nil
+	}
+
+	if err := s.db.Delete(key, nil); err != nil {
+		return fmt.Errorf("deleting entity %q: %w", id, err)
+	}
+	s.count--
+	return nil
+}
+
+func (s *diskEntityStore) Iterate(f func(ent *Entity) error) error {
+	it := s.db.NewIterator(nil, nil)
+	defer it.Release()
+
+	for it.Next() {
+		id := string(it.Key())
+		ent, err := decodeEntity(id, it.Value())
+		if err != nil {
+			return fmt.Errorf("decoding entity %q: %w", id, err)
+		}
+		if err := f(ent); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+func (s *diskEntityStore) Len() int {
+	return s.count
+}
+
+func (s *diskEntityStore) Close() error {
+	err := s.db.Close()
+	if removeErr := os.RemoveAll(s.path); removeErr != nil && err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// encodeEntity serializes an entity as its start block, flags and value count
+// followed by the index, length and protobuf encoding of each set value, an
+// explicit null being encoded with a zero length.
+func encodeEntity(ent *Entity) []byte {
+	var flags uint64
+	if ent.exported {
+		flags |= entityFlagExported
+	}
+
+	out := binary.AppendUvarint(nil, ent.StartBlock)
+	out = binary.AppendUvarint(out, flags)
+	out = binary.AppendUvarint(out, uint64(len(ent.Values)))
+	for i, v := range ent.Values {
+		if v == nil {
+			continue
+		}
+
+		out = binary.AppendUvarint(out, uint64(i))
+		if isNull(v) {
+			out = binary.AppendUvarint(out, 0)
+			continue
+		}
+
+		out = binary.AppendUvarint(out, uint64(proto.Size(v)))
+		// Marshalling a valid message into a buffer cannot fail
+		out, _ = proto.MarshalOptions{}.MarshalAppend(out, v)
+	}
+	return out
+}
+
+const entityFlagExported = 1
+
+func decodeEntity(id string, data []byte) (*Entity, error) {
+	startBlock, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid start block")
+	}
+	data = data[n:]
+
+	flags, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid flags")
+	}
+	data = data[n:]
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid value count")
+	}
+	data = data[n:]
+
+	ent := &Entity{
+		StartBlock: startBlock,
+		ID:         id,
+		Values:     make([]*pbentity.Value, count),
+		exported:   flags&entityFlagExported != 0,
+	}
+
+	for len(data) > 0 {
+		index, n := binary.Uvarint(data)
+		if n <= 0 || index >= count {
+			return nil, fmt.Errorf("invalid value index")
+		}
+		data = data[n:]
+
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return nil, fmt.Errorf("invalid value length")
+		}
+		data = data[n:]
+
+		if length == 0 {
+			ent.Values[index] = nullValue
+			continue
+		}
+
+		v := &pbentity.Value{}
+		if err := proto.Unmarshal(data[:length], v); err != nil {
+			return nil, fmt.Errorf("invalid value: %w", err)
+		}
+		ent.Values[index] = v
+		data = data[length:]
+	}
+
+	return ent, nil
+}
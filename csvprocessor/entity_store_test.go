@@ -0,0 +1,137 @@
+package csvprocessor
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEntityStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) EntityStore{
+		"memory": func(t *testing.T) EntityStore { return newMemoryEntityStore() },
+		"disk": func(t *testing.T) EntityStore {
+			store, err := NewEntityStore(EntityStoreDisk, t.TempDir(), nil, zap.NewNop())
+			require.NoError(t, err)
+			return store
+		},
+		"memory threshold": func(t *testing.T) EntityStore {
+			store, err := NewEntityStore(EntityStoreMemory, t.TempDir(), NewMemoryBudget(1024), zap.NewNop())
+			require.NoError(t, err)
+			return store
+		},
+	}
+
+	desc := testEntityDesc()
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			defer store.Close()
+
+			decoder := newEntityDecoder(desc)
+			for i := 0; i < 20; i++ {
+				ent, err := decoder.decode(testEntityChange(uint64(i), fmt.Sprintf("0x%02d", i)))
+				require.NoError(t, err)
+				ent.Values[5] = nullValue
+				require.NoError(t, store.Put(ent))
+			}
+			if thresholdStore, ok := store.(*thresholdEntityStore); ok {
+				assert.True(t, thresholdStore.onDisk)
+			}
+			require.NoError(t, store.Delete("0x03"))
+			require.NoError(t, store.Delete("0xmissing"))
+
+			ent, found, err := store.Get("0x05")
+			require.NoError(t, err)
+			require.True(t, found)
+			ent.StartBlock = 100
+			ent.Values[0] = &pbentity.Value{Typed: &pbentity.Value_Bool{Bool: false}}
+			require.NoError(t, store.Put(ent))
+
+			_, found, err = store.Get("0x03")
+			require.NoError(t, err)
+			assert.False(t, found)
+			assert.Equal(t, 19, store.Len())
+
+			var ids []string
+			require.NoError(t, store.Iterate(func(ent *Entity) error {
+				ids = append(ids, ent.ID)
+				return nil
+			}))
+			sort.Strings(ids)
+			assert.Len(t, ids, 19)
+			assert.Equal(t, "0x00", ids[0])
+
+			ent, found, err = store.Get("0x05")
+			require.NoError(t, err)
+			require.True(t, found)
+			assert.Equal(t, uint64(100), ent.StartBlock)
+			assert.False(t, ent.Values[0].GetBool())
+			assert.True(t, isNull(ent.Values[5]))
+			assert.NotNil(t, ent.Values[5])
+			assert.Equal(t, "0x05", ent.Values[2].GetString_())
+			assert.Equal(t, int32(2), ent.Values[7].GetArray().GetValue()[1].GetInt32())
+		})
+	}
+}
+
+func TestEntityStores_SharedMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget(4096)
+	decoder := newEntityDecoder(testEntityDesc())
+
+	var stores []*thresholdEntityStore
+	for i := 0; i < 2; i++ {
+		store, err := NewEntityStore(EntityStoreMemory, t.TempDir(), budget, zap.NewNop())
+		require.NoError(t, err)
+		defer store.Close()
+		stores = append(stores, store.(*thresholdEntityStore))
+	}
+
+	// Each store stays below the budget on its own but not both together
+	put := func(store EntityStore, id string) {
+		ent, err := decoder.decode(testEntityChange(1, id))
+		require.NoError(t, err)
+		require.NoError(t, store.Put(ent))
+	}
+	for i := 0; stores[0].accounted < 3000; i++ {
+		put(stores[0], fmt.Sprintf("0xa%02d", i))
+	}
+	assert.False(t, stores[0].onDisk)
+
+	for i := 0; !stores[1].onDisk; i++ {
+		require.Less(t, i, 100, "budget never exceeded")
+		put(stores[1], fmt.Sprintf("0xb%02d", i))
+	}
+	assert.False(t, stores[0].onDisk)
+	assert.Equal(t, int64(stores[0].accounted), budget.used.Load())
+
+	require.NoError(t, stores[0].Close())
+	assert.Equal(t, int64(0), budget.used.Load())
+}
+
+func TestEncodeEntity(t *testing.T) {
+	ent, err := newEntityDecoder(testEntityDesc()).decode(testEntityChange(42, "0xabc"))
+	require.NoError(t, err)
+	ent.Values[4] = nullValue
+	ent.Values[6] = nil
+
+	decoded, err := decodeEntity("0xabc", encodeEntity(ent))
+	require.NoError(t, err)
+	assert.Equal(t, ent.StartBlock, decoded.StartBlock)
+	require.Len(t, decoded.Values, len(ent.Values))
+	for i := range ent.Values {
+		if ent.Values[i] == nil {
+			assert.Nil(t, decoded.Values[i], "value %d", i)
+			continue
+		}
+		assert.True(t, proto.Equal(ent.Values[i], decoded.Values[i]), "value %d", i)
+	}
+
+	_, err = decodeEntity("0xabc", encodeEntity(ent)[:10])
+	assert.Error(t, err)
+}
@@ -0,0 +1,249 @@
+package csvprocessor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntityDesc() *schema.EntityDesc {
+	return &schema.EntityDesc{
+		Name: "pool",
+		Fields: map[string]*schema.Field{
+			"id":          {Name: "id", Type: schema.FieldTypeID},
+			"name":        {Name: "name", Type: schema.FieldTypeString, Nullable: true},
+			"liquidity":   {Name: "liquidity", Type: schema.FieldTypeBigInt},
+			"price":       {Name: "price", Type: schema.FieldTypeBigDecimal},
+			"fee_tier":    {Name: "fee_tier", Type: schema.FieldTypeInt},
+			"active":      {Name: "active", Type: schema.FieldTypeBoolean},
+			"owner":       {Name: "owner", Type: schema.FieldTypeBytes},
+			"tick_ids":    {Name: "tick_ids", Type: schema.FieldTypeInt, Array: true},
+			"token_names": {Name: "token_names", Type: schema.FieldTypeString, Array: true},
+		},
+	}
+}
+
+func testEntityChange(blockNum uint64, id string) *graphload.EntityChangeAtBlockNum {
+	str := func(in string) *pbentity.Value { return &pbentity.Value{Typed: &pbentity.Value_String_{String_: in}} }
+
+	return &graphload.EntityChangeAtBlockNum{
+		BlockNum: blockNum,
+		EntityChange: &pbentity.EntityChange{
+			Entity:    "Pool",
+			Id:        id,
+			Operation: pbentity.EntityChange_OPERATION_CREATE,
+			Fields: []*pbentity.Field{
+				{Name: "id", NewValue: str(id)},
+				{Name: "name", NewValue: str("WETH/USDC")},
+				{Name: "liquidity", NewValue: &pbentity.Value{Typed: &pbentity.Value_Bigint{Bigint: "123456789012345678901234567890"}}},
+				{Name: "price", NewValue: &pbentity.Value{Typed: &pbentity.Value_Bigdecimal{Bigdecimal: "1834.123456789"}}},
+				{Name: "feeTier", NewValue: &pbentity.Value{Typed: &pbentity.Value_Int32{Int32: 3000}}},
+				{Name: "active", NewValue: &pbentity.Value{Typed: &pbentity.Value_Bool{Bool: true}}},
+				{Name: "owner", NewValue: &pbentity.Value{Typed: &pbentity.Value_Bytes{Bytes: "hFgqh8ZmyJrv2UhHF3t/r0l20y8="}}},
+				{Name: "tickIds", NewValue: &pbentity.Value{Typed: &pbentity.Value_Array{Array: &pbentity.Array{Value: []*pbentity.Value{
+					{Typed: &pbentity.Value_Int32{Int32: 1}},
+					{Typed: &pbentity.Value_Int32{Int32: 2}},
+				}}}}},
+				{Name: "tokenNames", NewValue: &pbentity.Value{Typed: &pbentity.Value_Array{Array: &pbentity.Array{Value: []*pbentity.Value{
+					str("WETH"), str("USDC"),
+				}}}}},
+			},
+		},
+	}
+}
+
+func TestEntityDecoder(t *testing.T) {
+	desc := testEntityDesc()
+	decoder := newEntityDecoder(desc)
+
+	ent, err := decoder.decode(testEntityChange(10, "0xabc"))
+	require.NoError(t, err)
+	require.NoError(t, ent.ValidateFields(desc))
+	assert.Equal(t, uint64(10), ent.StartBlock)
+	assert.Equal(t, "0xabc", ent.ID)
+
+	update, err := decoder.decode(&graphload.EntityChangeAtBlockNum{
+		BlockNum: 12,
+		EntityChange: &pbentity.EntityChange{
+			Id:        "0xabc",
+			Operation: pbentity.EntityChange_OPERATION_UPDATE,
+			Fields: []*pbentity.Field{
+				{Name: "name"},
+				{Name: "active", NewValue: &pbentity.Value{Typed: &pbentity.Value_Bool{Bool: false}}},
+			},
+		},
+	})
+	require.NoError(t, err)
+	ent.Update(update)
+
+	var records []string
+	for i, f := range desc.OrderedFields() {
+		out, err := formatField(ent.Values[i], f)
+		require.NoError(t, err)
+		records = append(records, out)
+	}
+	assert.Equal(t, []string{"false", "3000", "0xabc", "123456789012345678901234567890", "NULL", "\\x84582a87c666c89aefd94847177b7faf4976d32f", "1834.123456789", "{1,2}", "{WETH,USDC}"}, records)
+}
+
+func TestEntityDecoder_Invalid(t *testing.T) {
+	tests := []struct {
+		name          string
+		field         *pbentity.Field
+		expectedError string
+	}{
+		{"unknown field", &pbentity.Field{Name: "unknown"}, `invalid field "unknown" not part of entity`},
+		{"wrong type", &pbentity.Field{Name: "feeTier", NewValue: &pbentity.Value{Typed: &pbentity.Value_String_{String_: "3000"}}}, `invalid field "fee_tier": expected Int, got String`},
+		{"scalar for array", &pbentity.Field{Name: "tickIds", NewValue: &pbentity.Value{Typed: &pbentity.Value_Int32{Int32: 1}}}, `invalid field "tick_ids": expected array of Int, got Int32`},
+		{"wrong element type", &pbentity.Field{Name: "tickIds", NewValue: &pbentity.Value{Typed: &pbentity.Value_Array{Array: &pbentity.Array{Value: []*pbentity.Value{
+			{Typed: &pbentity.Value_Bool{Bool: true}},
+		}}}}}, `invalid field "tick_ids": element 0: expected Int, got Bool`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ch := testEntityChange(10, "0xabc")
+			ch.EntityChange.Fields = append(ch.EntityChange.Fields, test.field)
+
+			_, err := newEntityDecoder(testEntityDesc()).decode(ch)
+			assert.EqualError(t, err, test.expectedError)
+		})
+	}
+}
+
+func TestEntity_ValidateFields(t *testing.T) {
+	desc := testEntityDesc()
+	ch := testEntityChange(10, "0xabc")
+	ch.EntityChange.Fields = ch.EntityChange.Fields[:2]
+
+	ent, err := newEntityDecoder(desc).decode(ch)
+	require.NoError(t, err)
+	assert.ErrorContains(t, ent.ValidateFields(desc), `field "active" cannot be nil`)
+}
+
+func benchmarkBundle(b *testing.B, fileType writer.FileType) []byte {
+	b.Helper()
+
+	encoder, err := bundler.NewEncoder(fileType)
+	require.NoError(b, err)
+
+	var out bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		data, err := encoder(testEntityChange(uint64(i), fmt.Sprintf("0x%040x", i)))
+		require.NoError(b, err)
+		out.Write(data)
+	}
+	return out.Bytes()
+}
+
+// BenchmarkDecode compares the typed decoding path of `tocsv` against the previous
+// one, which decoded fields in maps keyed by the JSON oneof names.
+func BenchmarkDecode(b *testing.B) {
+	desc := testEntityDesc()
+
+	b.Run("legacy_map_jsonl", func(b *testing.B) {
+		data := benchmarkBundle(b, writer.FileTypeJSONL)
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+				if len(line) == 0 {
+					continue
+				}
+				if _, err := legacyDecode(line, desc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	for _, fileType := range writer.FileTypes {
+		b.Run("typed_"+string(fileType), func(b *testing.B) {
+			data := benchmarkBundle(b, fileType)
+			decoder := newEntityDecoder(desc)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				changes, err := newChangesDecoder(bytes.NewReader(data), fileType)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for {
+					ch, err := changes.Decode()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := decoder.decode(ch); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// legacyDecode is a condensed copy of the map based decoding `tocsv` used before
+// the typed decoder, kept as a benchmark baseline.
+func legacyDecode(line []byte, desc *schema.EntityDesc) (map[string]interface{}, error) {
+	in := struct {
+		EntityChange struct {
+			ID     string `json:"id"`
+			Fields []*struct {
+				Name     string `json:"name"`
+				NewValue struct {
+					Typed map[string]interface{} `json:"Typed"`
+				} `json:"new_value"`
+			}
+		} `json:"entity_change"`
+		BlockNum uint64 `json:"block_num"`
+	}{}
+	if err := json.Unmarshal(line, &in); err != nil {
+		return nil, err
+	}
+
+	typedKeys := map[schema.FieldType]string{
+		schema.FieldTypeID: "String_", schema.FieldTypeString: "String_", schema.FieldTypeBigInt: "Bigint",
+		schema.FieldTypeBigDecimal: "Bigdecimal", schema.FieldTypeBytes: "Bytes", schema.FieldTypeInt: "Int32",
+		schema.FieldTypeBoolean: "Bool",
+	}
+
+	fields := map[string]interface{}{"id": in.EntityChange.ID}
+	for _, f := range in.EntityChange.Fields {
+		name := schema.NormalizeField(f.Name)
+		fieldDesc, ok := desc.Fields[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid field %q not part of entity", name)
+		}
+
+		key := typedKeys[fieldDesc.Type]
+		if !fieldDesc.Array {
+			fields[name] = f.NewValue.Typed[key]
+			continue
+		}
+
+		array, _ := f.NewValue.Typed["Array"].(map[string]interface{})["value"].([]interface{})
+		out := make([]interface{}, len(array))
+		for i := range array {
+			out[i] = array[i].(map[string]interface{})["Typed"].(map[string]interface{})[key]
+		}
+		fields[name] = out
+	}
+
+	return fields, nil
+}
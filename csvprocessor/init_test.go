@@ -0,0 +1,9 @@
+package csvprocessor
+
+import "github.com/streamingfast/logging"
+
+var zlog, tracer = logging.PackageLogger("csvprocessor", "github.com/streamingfast/substreams-graph-load/csvprocessor_test")
+
+func init() {
+	logging.InstantiateLoggers()
+}
@@ -0,0 +1,264 @@
+package csvprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// jsonScanner reads a single JSON document in place, it only supports what the
+// entity change decoder needs and allocates nothing but the strings it returns.
+type jsonScanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *jsonScanner) errorf(format string, args ...any) error {
+	return fmt.Errorf("offset %d: %s", s.pos, fmt.Sprintf(format, args...))
+}
+
+func (s *jsonScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next non space byte without consuming it, 0 at the end of data.
+func (s *jsonScanner) peek() byte {
+	s.skipSpace()
+	if s.pos >= len(s.data) {
+		return 0
+	}
+	return s.data[s.pos]
+}
+
+func (s *jsonScanner) expect(c byte) error {
+	if s.peek() != c {
+		return s.errorf("expected %q", c)
+	}
+	s.pos++
+	return nil
+}
+
+func (s *jsonScanner) literal(lit string) bool {
+	s.skipSpace()
+	if len(s.data)-s.pos < len(lit) || string(s.data[s.pos:s.pos+len(lit)]) != lit {
+		return false
+	}
+	s.pos += len(lit)
+	return true
+}
+
+// null consumes the next value if it is null.
+func (s *jsonScanner) null() bool {
+	return s.peek() == 'n' && s.literal("null")
+}
+
+// end returns an error if anything but spaces is left after the document.
+func (s *jsonScanner) end() error {
+	if s.peek() != 0 {
+		return s.errorf("unexpected data after top-level value")
+	}
+	return nil
+}
+
+// object calls member for each key of the next object, member must consume the
+// value of the key.
+func (s *jsonScanner) object(member func(key []byte) error) error {
+	if err := s.expect('{'); err != nil {
+		return err
+	}
+	if s.peek() == '}' {
+		s.pos++
+		return nil
+	}
+
+	for {
+		key, err := s.rawString()
+		if err != nil {
+			return err
+		}
+		if err := s.expect(':'); err != nil {
+			return err
+		}
+		if err := member(key); err != nil {
+			return err
+		}
+
+		switch s.peek() {
+		case ',':
+			s.pos++
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("expected ',' or '}' in object")
+		}
+	}
+}
+
+// array calls elem for each element of the next array, elem must consume it.
+func (s *jsonScanner) array(elem func() error) error {
+	if err := s.expect('['); err != nil {
+		return err
+	}
+	if s.peek() == ']' {
+		s.pos++
+		return nil
+	}
+
+	for {
+		if err := elem(); err != nil {
+			return err
+		}
+
+		switch s.peek() {
+		case ',':
+			s.pos++
+		case ']':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// rawString returns the content of the next string, pointing into data when it
+// has no escape sequence.
+func (s *jsonScanner) rawString() ([]byte, error) {
+	if err := s.expect('"'); err != nil {
+		return nil, err
+	}
+
+	start := s.pos
+	escaped := false
+	for s.pos < len(s.data) {
+		switch c := s.data[s.pos]; {
+		case c == '"':
+			s.pos++
+			if !escaped {
+				return s.data[start : s.pos-1], nil
+			}
+
+			var out string
+			if err := json.Unmarshal(s.data[start-1:s.pos], &out); err != nil {
+				return nil, s.errorf("invalid string: %s", err)
+			}
+			return []byte(out), nil
+		case c == '\\':
+			escaped = true
+			s.pos += 2
+		case c < 0x20:
+			return nil, s.errorf("invalid control character in string")
+		default:
+			s.pos++
+		}
+	}
+
+	return nil, s.errorf("unterminated string")
+}
+
+func (s *jsonScanner) string() (string, error) {
+	raw, err := s.rawString()
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+func (s *jsonScanner) bool() (bool, error) {
+	switch {
+	case s.literal("true"):
+		return true, nil
+	case s.literal("false"):
+		return false, nil
+	}
+	return false, s.errorf("expected boolean")
+}
+
+// integer reads the next number, which must be an integer in [min, max].
+func (s *jsonScanner) integer(min int64, max uint64) (negative bool, abs uint64, err error) {
+	if s.peek() == '-' {
+		negative = true
+		s.pos++
+	}
+
+	start := s.pos
+	for s.pos < len(s.data) && s.data[s.pos] >= '0' && s.data[s.pos] <= '9' {
+		digit := uint64(s.data[s.pos] - '0')
+		if abs > (math.MaxUint64-digit)/10 {
+			return false, 0, s.errorf("number overflows")
+		}
+		abs = abs*10 + digit
+		s.pos++
+	}
+	if s.pos == start {
+		return false, 0, s.errorf("expected integer")
+	}
+	if s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case '.', 'e', 'E':
+			return false, 0, s.errorf("expected integer, got a fractional number")
+		}
+	}
+
+	if negative && abs > uint64(-min) || !negative && abs > max {
+		return false, 0, s.errorf("number overflows")
+	}
+	return negative, abs, nil
+}
+
+func (s *jsonScanner) uint64() (uint64, error) {
+	_, abs, err := s.integer(0, math.MaxUint64)
+	return abs, err
+}
+
+func (s *jsonScanner) int32() (int32, error) {
+	negative, abs, err := s.integer(math.MinInt32, math.MaxInt32)
+	if negative {
+		return int32(-int64(abs)), err
+	}
+	return int32(abs), err
+}
+
+// skip consumes the next value whatever its type.
+func (s *jsonScanner) skip() error {
+	switch c := s.peek(); {
+	case c == '{':
+		return s.object(func(_ []byte) error { return s.skip() })
+	case c == '[':
+		return s.array(s.skip)
+	case c == '"':
+		_, err := s.rawString()
+		return err
+	case c == 't' || c == 'f':
+		_, err := s.bool()
+		return err
+	case c == 'n':
+		if s.null() {
+			return nil
+		}
+	case c == '-' || c >= '0' && c <= '9':
+		start := s.pos
+		for s.pos < len(s.data) && isNumberByte(s.data[s.pos]) {
+			s.pos++
+		}
+		var number json.Number
+		if err := json.Unmarshal(s.data[start:s.pos], &number); err != nil {
+			return s.errorf("invalid number: %s", err)
+		}
+		return nil
+	}
+
+	return s.errorf("unexpected value")
+}
+
+func isNumberByte(c byte) bool {
+	return c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.' || c == 'e' || c == 'E'
+}
@@ -8,4 +8,8 @@ func RegisterMetrics() {
 
 var metrics = dmetrics.NewSet()
 
+var EntityFilesProcessed = metrics.NewCounterVec("substreams_sink_graph_load_tocsv_entity_files", []string{"entity"}, "The number of entity files processed")
+var RowsWritten = metrics.NewCounterVec("substreams_sink_graph_load_tocsv_rows", []string{"entity"}, "The number of CSV rows written")
+var OpenEntities = metrics.NewGaugeVec("substreams_sink_graph_load_tocsv_open_entities", []string{"entity"}, "The number of open mutable entities held in the entity store")
+
 //var FlushedEntriesCount = metrics.NewCounter("substreams_sink_graphcsv_flushed_e", "The number of flushed entries")
@@ -0,0 +1,21 @@
+package csvprocessor
+
+// Option configures a Processor.
+type Option func(p *Processor)
+
+// WithEntityStore sets the store holding the live mutable entities, closed by the
+// processor once done, an in-memory store by default.
+func WithEntityStore(store EntityStore) Option {
+	return func(p *Processor) {
+		p.entities = store
+	}
+}
+
+// WithStartBlock makes the processor continue the run that stopped at startBlock,
+// loading the open entities from the snapshot it wrote and processing only the
+// entity changes from startBlock.
+func WithStartBlock(startBlock uint64) Option {
+	return func(p *Processor) {
+		p.startBlock = startBlock
+	}
+}
@@ -1,18 +1,19 @@
 package csvprocessor
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/url"
-	"regexp"
 	"strconv"
 
+	"github.com/streamingfast/bstream"
 	"github.com/streamingfast/dstore"
 	"github.com/streamingfast/logging"
 	"github.com/streamingfast/shutter"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
 	"github.com/streamingfast/substreams-graph-load/schema"
 	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
 	"go.uber.org/zap"
@@ -21,48 +22,80 @@ import (
 type Processor struct {
 	*shutter.Shutter
 
-	inputStore dstore.Store
-	csvOutput  *WriterManager
+	inputStore    dstore.Store
+	inputFileType writer.FileType
+	csvOutput     *WriterManager
 
-	entityDesc *schema.EntityDesc
+	snapshotStore dstore.Store
+	closuresStore dstore.Store
+	closures      *Writer
 
-	entities map[string]*Entity
+	entityDesc    *schema.EntityDesc
+	entityDecoder *entityDecoder
 
+	entities EntityStore
+
+	startBlock uint64
 	stopBlock  uint64
 	bundleSize uint64
 
+	entityFileCount int
+	closureCount    uint64
+	openEntityCount int
+
 	logger *zap.Logger
 	tracer logging.Tracer
 }
 
+// Stats summarizes the work of a processor, complete once it terminated.
+type Stats struct {
+	EntityFileCount int
+	RowCount        uint64
+	ClosureCount    uint64
+	OpenEntityCount int
+}
+
+func (p *Processor) Stats() Stats {
+	return Stats{
+		EntityFileCount: p.entityFileCount,
+		RowCount:        p.csvOutput.rowCount,
+		ClosureCount:    p.closureCount,
+		OpenEntityCount: p.openEntityCount,
+	}
+}
+
 func New(
 	srcFolder string,
 	destFolder string,
-	entity string,
+	entityDesc *schema.EntityDesc,
 	stopBlock uint64,
 	bundleSize uint64,
-	schemaFilename string,
+	outputCompression compression.Type,
 	logger *zap.Logger,
-	tracer logging.Tracer) (*Processor, error) {
+	tracer logging.Tracer,
+	opts ...Option) (*Processor, error) {
 
 	if stopBlock == 0 {
 		return nil, fmt.Errorf("stopBlock must be >0")
 	}
 	p := &Processor{
 		Shutter:    shutter.New(),
-		entities:   make(map[string]*Entity),
+		entityDesc: entityDesc,
+		entities:   newMemoryEntityStore(),
 		stopBlock:  stopBlock,
 		bundleSize: bundleSize,
 		logger:     logger,
 		tracer:     tracer,
 	}
-
-	srcURL, err := url.Parse(srcFolder)
-	if err != nil {
-		return nil, err
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.startBlock >= stopBlock {
+		return nil, fmt.Errorf("start block %d must be lower than stop block %d", p.startBlock, stopBlock)
 	}
-	tweakedSrcURL := srcURL.JoinPath(entity)
-	inputStore, err := dstore.NewJSONLStore(tweakedSrcURL.String())
+
+	entity := entityDesc.Name
+	inputStore, inputFileType, _, err := bundler.DetectEntityStore(context.Background(), srcFolder, entity)
 	if err != nil {
 		return nil, err
 	}
@@ -72,30 +105,25 @@ func New(
 		return nil, err
 	}
 	tweakedDestURL := destURL.JoinPath(entity)
-	outputStore, err := dstore.NewStore(tweakedDestURL.String(), "csv", "none", false)
+	outputStore, err := compression.NewStore(tweakedDestURL.String(), "csv", outputCompression, false)
 	if err != nil {
 		return nil, err
 	}
 
 	p.inputStore = inputStore
+	p.inputFileType = inputFileType
 
-	entities, err := schema.GetEntitiesFromSchema(schemaFilename)
+	p.snapshotStore, err = compression.NewStore(destURL.JoinPath("snapshots", entity).String(), "snapshot", compression.Zstd, true)
 	if err != nil {
 		return nil, err
 	}
-
-	for _, ent := range entities {
-		if ent.Name == entity {
-			p.entityDesc = ent
-			break
-		}
-	}
-	if p.entityDesc == nil {
-		logger.Info("cannot find entity in schema", zap.String("entity", entity), zap.String("schema", schemaFilename), zap.Any("entities", entities))
-		return nil, fmt.Errorf("cannot find entity %q in schema %q", entity, schemaFilename)
+	p.closuresStore, err = compression.NewStore(destURL.JoinPath("closures", entity).String(), "csv", outputCompression, false)
+	if err != nil {
+		return nil, err
 	}
 
-	p.csvOutput = NewWriterManager(bundleSize, stopBlock, outputStore, p.entityDesc)
+	p.entityDecoder = newEntityDecoder(p.entityDesc)
+	p.csvOutput = NewWriterManager(bundleSize, p.startBlock, stopBlock, outputStore, p.entityDesc)
 
 	return p, nil
 }
@@ -105,6 +133,20 @@ func (p *Processor) Run(ctx context.Context) {
 }
 
 func (p *Processor) run(ctx context.Context) error {
+	defer func() {
+		p.openEntityCount = p.entities.Len()
+		if err := p.entities.Close(); err != nil {
+			p.logger.Warn("unable to close entity store", zap.Error(err))
+		}
+	}()
+
+	if p.startBlock > 0 && !p.entityDesc.Immutable {
+		count, err := loadSnapshot(ctx, p.snapshotStore, p.entities, p.entityDesc, p.startBlock)
+		if err != nil {
+			return fmt.Errorf("loading snapshot: %w", err)
+		}
+		p.logger.Info("loaded open entities from snapshot", zap.Uint64("start_block", p.startBlock), zap.Int("entity_count", count))
+	}
 
 	entitiesToLoad := []string{}
 	var endRange uint64
@@ -113,7 +155,7 @@ func (p *Processor) run(ctx context.Context) error {
 
 	err := p.inputStore.Walk(context.Background(), "", func(filename string) (err error) {
 		fileCount++
-		startBlockNum, endBlockNum, err := getBlockRange(filename)
+		startBlockNum, endBlockNum, err := bundler.BlockRangeFromFilename(filename)
 		if err != nil {
 			return fmt.Errorf("fail reading block range in %q: %w", filename, err)
 		}
@@ -121,8 +163,14 @@ func (p *Processor) run(ctx context.Context) error {
 		if startBlockNum >= p.stopBlock {
 			return dstore.StopIteration
 		}
+		if endBlockNum < p.startBlock {
+			return nil
+		}
 
 		if endRange == 0 {
+			if startBlockNum > p.startBlock {
+				return fmt.Errorf("entities do not cover the full range, first file %q starts after start block %d", filename, p.startBlock)
+			}
 			endRange = endBlockNum
 		} else {
 			if startBlockNum != (endRange + 1) {
@@ -155,6 +203,9 @@ func (p *Processor) run(ctx context.Context) error {
 		if err := p.processEntityFile(ctx, filename); err != nil {
 			return fmt.Errorf("error processing file: %w", err)
 		}
+		p.entityFileCount++
+		EntityFilesProcessed.Inc(p.entityDesc.Name)
+		OpenEntities.SetInt(p.entities.Len(), p.entityDesc.Name)
 
 		if idx%10 == 0 {
 			p.logger.Info("entity file completed (1/10)",
@@ -175,20 +226,37 @@ func (p *Processor) run(ctx context.Context) error {
 			return err
 		}
 	}
-	p.csvOutput.Close()
+	if err := p.csvOutput.Close(); err != nil {
+		return err
+	}
 
-	return nil
-}
+	if p.closures != nil {
+		if err := p.closures.Close(); err != nil {
+			return fmt.Errorf("closing closures file: %w", err)
+		}
+	}
 
-func (p *Processor) flushAllEntities(ctx context.Context) error {
-	for _, ent := range p.entities {
-		if err := p.csvOutput.Write(ent, p.entityDesc, 0); err != nil {
+	if !p.entityDesc.Immutable {
+		if err := writeSnapshot(ctx, p.snapshotStore, p.entities, p.entityDesc, p.stopBlock); err != nil {
 			return err
 		}
+		p.logger.Info("wrote snapshot of open entities", zap.Uint64("stop_block", p.stopBlock), zap.Int("entity_count", p.entities.Len()))
 	}
+
 	return nil
 }
 
+func (p *Processor) flushAllEntities(ctx context.Context) error {
+	p.logger.Info("flushing remaining entities", zap.Int("entity_count", p.entities.Len()))
+	return p.entities.Iterate(func(ent *Entity) error {
+		if ent.exported {
+			// already exported as an open row by a previous run
+			return nil
+		}
+		return p.csvOutput.Write(ent, p.entityDesc, 0)
+	})
+}
+
 func (p *Processor) processEntityFile(ctx context.Context, filename string) error {
 	//ts.metrics.fileCount++
 	p.logger.Debug("processing entity file", zap.String("filename", filename))
@@ -197,21 +265,25 @@ func (p *Processor) processEntityFile(ctx context.Context, filename string) erro
 	if err != nil {
 		return fmt.Errorf("unable to load entitis file %q: %w", filename, err)
 	}
-	bufReader := bufio.NewReader(reader)
+	defer reader.Close()
+
+	decoder, err := newChangesDecoder(reader, p.inputFileType)
+	if err != nil {
+		return err
+	}
 
 	for {
 		//	ts.metrics.blockCount++
-		line, err := bufReader.ReadBytes('\n')
+		ch, err := decoder.Decode()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return fmt.Errorf("unable to read newline: %w", err)
+			return fmt.Errorf("decoding %q: %w", filename, err)
 		}
 
-		ch := &EntityChangeAtBlockNum{}
-		if err := json.Unmarshal(line, ch); err != nil {
-			return err
+		if ch.BlockNum < p.startBlock {
+			continue
 		}
 
 		if p.stopBlock != 0 && ch.BlockNum > p.stopBlock {
@@ -227,17 +299,20 @@ func (p *Processor) processEntityFile(ctx context.Context, filename string) erro
 			break
 		}
 
-		newEnt, err := newEntity(ch, p.entityDesc)
+		newEnt, err := p.entityDecoder.decode(ch)
 		if err != nil {
-			return err
+			return fmt.Errorf("@%d decoding entity %q: %w", ch.BlockNum, ch.EntityChange.GetId(), err)
 		}
 
-		prev, found := p.entities[ch.EntityChange.ID]
+		prev, found, err := p.entities.Get(ch.EntityChange.Id)
+		if err != nil {
+			return err
+		}
 
 		switch ch.EntityChange.Operation {
 		case pbentity.EntityChange_OPERATION_CREATE:
 			if found {
-				return fmt.Errorf("@%d got CREATE on entity %q but it already exists since block %d", ch.BlockNum, ch.EntityChange.ID, prev.StartBlock)
+				return fmt.Errorf("@%d got CREATE on entity %q but it already exists since block %d", ch.BlockNum, ch.EntityChange.Id, prev.StartBlock)
 			}
 
 			if err := newEnt.ValidateFields(p.entityDesc); err != nil {
@@ -250,7 +325,9 @@ func (p *Processor) processEntityFile(ctx context.Context, filename string) erro
 				}
 				continue
 			}
-			p.entities[ch.EntityChange.ID] = newEnt
+			if err := p.entities.Put(newEnt); err != nil {
+				return err
+			}
 
 		case pbentity.EntityChange_OPERATION_UPDATE:
 			if p.entityDesc.Immutable {
@@ -262,48 +339,61 @@ func (p *Processor) processEntityFile(ctx context.Context, filename string) erro
 				}
 				continue
 				// FIXME: enforce this at some point
-				// return fmt.Errorf("entity %q got updated but should be immutable", ch.EntityChange.ID)
+				// return fmt.Errorf("entity %q got updated but should be immutable", ch.EntityChange.Id)
 			}
 			if !found {
 				if err := newEnt.ValidateFields(p.entityDesc); err != nil {
 					return fmt.Errorf("@%d during UPDATE to an unseen entity: %w", ch.BlockNum, err)
 				}
-				p.entities[ch.EntityChange.ID] = newEnt
+				if err := p.entities.Put(newEnt); err != nil {
+					return err
+				}
 				continue
 				// FIXME: enforce this at some point
-				//return fmt.Errorf("entity %q got updated but previous value not found", ch.EntityChange.ID)
+				//return fmt.Errorf("entity %q got updated but previous value not found", ch.EntityChange.Id)
 			}
 			if err := prev.ValidateFields(p.entityDesc); err != nil {
 				return fmt.Errorf("@%d during UPDATE to an existing entity: %w", ch.BlockNum, err)
 			}
-			if err := p.csvOutput.Write(prev, p.entityDesc, ch.BlockNum); err != nil {
+			if err := p.closeEntity(ctx, prev, ch.BlockNum); err != nil {
 				return err
 			}
 			prev.Update(newEnt)
-			p.entities[ch.EntityChange.ID] = prev
+			if err := p.entities.Put(prev); err != nil {
+				return err
+			}
 
 		case pbentity.EntityChange_OPERATION_DELETE:
 			if p.entityDesc.Immutable {
-				return fmt.Errorf("entity %q got deleted but should be immutable", ch.EntityChange.ID)
+				return fmt.Errorf("entity %q got deleted but should be immutable", ch.EntityChange.Id)
 			}
 			if !found {
-				return fmt.Errorf("entity %q got updated but previous value not found", ch.EntityChange.ID)
+				return fmt.Errorf("entity %q got updated but previous value not found", ch.EntityChange.Id)
 			}
 
-			if err := p.csvOutput.Write(prev, p.entityDesc, ch.BlockNum); err != nil {
+			if err := p.closeEntity(ctx, prev, ch.BlockNum); err != nil {
+				return err
+			}
+			if err := p.entities.Delete(ch.EntityChange.Id); err != nil {
 				return err
 			}
-			delete(p.entities, ch.EntityChange.ID)
 
 		case pbentity.EntityChange_OPERATION_FINAL:
 			if p.entityDesc.Immutable {
 				continue
 			}
+			if !found {
+				return fmt.Errorf("entity %q got finalized but previous value not found", ch.EntityChange.Id)
+			}
 
-			if err := p.csvOutput.Write(prev, p.entityDesc, 0); err != nil {
+			if !prev.exported {
+				if err := p.csvOutput.Write(prev, p.entityDesc, 0); err != nil {
+					return err
+				}
+			}
+			if err := p.entities.Delete(ch.EntityChange.Id); err != nil {
 				return err
 			}
-			delete(p.entities, ch.EntityChange.ID)
 		}
 
 	}
@@ -337,15 +427,29 @@ func (p *Processor) processEntityFile(ctx context.Context, filename string) erro
 	return nil
 }
 
-func getBlockRange(filename string) (uint64, uint64, error) {
-	match := blockRangeRegex.FindStringSubmatch(filename)
-	if match == nil {
-		return 0, 0, fmt.Errorf("no block range in filename: %s", filename)
+// closeEntity ends the current version of ent at stopBlock. A version exported as
+// an open row by a previous run is recorded as a closure instead of a new row.
+func (p *Processor) closeEntity(ctx context.Context, ent *Entity, stopBlock uint64) error {
+	if !ent.exported {
+		return p.csvOutput.Write(ent, p.entityDesc, stopBlock)
 	}
 
-	startBlock, _ := strconv.ParseUint(match[1], 10, 64)
-	stopBlock, _ := strconv.ParseUint(match[2], 10, 64)
-	return startBlock, stopBlock, nil
-}
+	if p.closures == nil {
+		filename := fileNameFromRange(bstream.NewRangeExcludingEnd(p.startBlock, p.stopBlock))
+		closures, err := NewWriter(ctx, p.closuresStore, filename)
+		if err != nil {
+			return err
+		}
+		if err := closures.csvWriter.Write(ClosuresHeader); err != nil {
+			return err
+		}
+		p.closures = closures
+	}
 
-var blockRangeRegex = regexp.MustCompile(`(\d{10})-(\d{10})`)
+	p.closureCount++
+	return p.closures.csvWriter.Write([]string{
+		toValidString(ent.ID),
+		strconv.FormatUint(ent.StartBlock, 10),
+		strconv.FormatUint(stopBlock, 10),
+	})
+}
@@ -0,0 +1,157 @@
+package csvprocessor
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/compression"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessor_IncrementalMatchesFullRun(t *testing.T) {
+	ctx := context.Background()
+
+	srcFolder := t.TempDir()
+	schemaFilename := filepath.Join(t.TempDir(), "schema.graphql")
+	require.NoError(t, os.WriteFile(schemaFilename, []byte("type Token @entity {\n  id: ID!\n  amount: BigInt!\n}\n"), 0644))
+
+	change := func(id string, op pbentity.EntityChange_Operation, amount string) *pbentity.EntityChange {
+		out := &pbentity.EntityChange{Entity: "Token", Id: id, Operation: op}
+		if amount != "" {
+			out.Fields = []*pbentity.Field{{Name: "amount", NewValue: &pbentity.Value{Typed: &pbentity.Value_Bigint{Bigint: amount}}}}
+		}
+		return out
+	}
+
+	changes := map[uint64][]*pbentity.EntityChange{
+		1:  {change("a", pbentity.EntityChange_OPERATION_CREATE, "1"), change("b", pbentity.EntityChange_OPERATION_CREATE, "2")},
+		3:  {change("c", pbentity.EntityChange_OPERATION_CREATE, "3"), change("d", pbentity.EntityChange_OPERATION_CREATE, "4")},
+		12: {change("a", pbentity.EntityChange_OPERATION_UPDATE, "5")},
+		15: {change("b", pbentity.EntityChange_OPERATION_DELETE, ""), change("e", pbentity.EntityChange_OPERATION_CREATE, "6")},
+		16: {change("c", pbentity.EntityChange_OPERATION_FINAL, "")},
+		22: {change("a", pbentity.EntityChange_OPERATION_UPDATE, "7"), change("e", pbentity.EntityChange_OPERATION_UPDATE, "8")},
+	}
+
+	store, err := compression.NewStore(srcFolder+"/token", "jsonl", compression.Gzip, false)
+	require.NoError(t, err)
+	for start := uint64(0); start < 40; start += 10 {
+		var content strings.Builder
+		for blockNum := start; blockNum < start+10; blockNum++ {
+			for i, ch := range changes[blockNum] {
+				line, err := bundler.JSONLEncode(&graphload.EntityChangeAtBlockNum{EntityChange: ch, BlockNum: blockNum, Index: uint64(i)})
+				require.NoError(t, err)
+				content.Write(line)
+			}
+		}
+		require.NoError(t, store.WriteObject(ctx, fmt.Sprintf("%010d-%010d", start, start+9), strings.NewReader(content.String())))
+	}
+
+	run := func(destFolder string, startBlock, stopBlock uint64) {
+		p, err := New(srcFolder, destFolder, testSchemaEntity(t, schemaFilename), stopBlock, 10, compression.None, zlog, tracer, WithStartBlock(startBlock))
+		require.NoError(t, err)
+		p.Run(ctx)
+		require.NoError(t, p.Err())
+	}
+
+	fullFolder := t.TempDir()
+	run(fullFolder, 0, 30)
+
+	incrementalFolder := t.TempDir()
+	run(incrementalFolder, 0, 14)
+	run(incrementalFolder, 14, 30)
+
+	// Emulates 'inject-csv' loading both runs
+	rows := readCSVRows(t, filepath.Join(incrementalFolder, "token"), 0, 14)
+	closures := readCSVRows(t, filepath.Join(incrementalFolder, "closures", "token"), 0, 30)
+	assert.Len(t, closures, 2)
+	for _, closure := range closures {
+		id, lower, upper := closure[0], closure[1], closure[2]
+
+		closed := false
+		for _, row := range rows {
+			if row[0] == id && row[1] == fmt.Sprintf("[%s,)", lower) {
+				row[1] = fmt.Sprintf("[%s,%s)", lower, upper)
+				closed = true
+			}
+		}
+		require.True(t, closed, "closure %v does not match any open row", closure)
+	}
+	rows = append(rows, readCSVRows(t, filepath.Join(incrementalFolder, "token"), 14, 30)...)
+
+	expected := readCSVRows(t, filepath.Join(fullFolder, "token"), 0, 30)
+	assert.Equal(t, sortedRows(expected), sortedRows(rows))
+	assert.Len(t, expected, 8)
+}
+
+func TestProcessor_MissingSnapshot(t *testing.T) {
+	srcFolder := t.TempDir()
+	schemaFilename := filepath.Join(t.TempDir(), "schema.graphql")
+	require.NoError(t, os.WriteFile(schemaFilename, []byte("type Token @entity {\n  id: ID!\n}\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(srcFolder, "token"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(srcFolder, "token", "0000000000-0000000009.jsonl.gz"), nil, 0644))
+
+	p, err := New(srcFolder, t.TempDir(), testSchemaEntity(t, schemaFilename), 20, 10, compression.None, zlog, tracer, WithStartBlock(10))
+	require.NoError(t, err)
+	p.Run(context.Background())
+	assert.ErrorContains(t, p.Err(), "no snapshot at block 10")
+}
+
+func testSchemaEntity(t *testing.T, schemaFilename string) *schema.EntityDesc {
+	t.Helper()
+
+	entities, err := schema.GetEntitiesFromSchema(schemaFilename)
+	require.NoError(t, err)
+	for _, ent := range entities {
+		if ent.Name == "token" {
+			return ent
+		}
+	}
+	require.FailNow(t, "token entity not found in schema")
+	return nil
+}
+
+// readCSVRows reads the rows of the CSV files of folder whose range starts in
+// [startBlock, stopBlock), headers excluded.
+func readCSVRows(t *testing.T, folder string, startBlock, stopBlock uint64) (out [][]string) {
+	t.Helper()
+
+	files, err := os.ReadDir(folder)
+	require.NoError(t, err)
+
+	for _, file := range files {
+		fileStart, _, err := bundler.BlockRangeFromFilename(file.Name())
+		require.NoError(t, err)
+		if fileStart < startBlock || fileStart >= stopBlock {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(folder, file.Name()))
+		require.NoError(t, err)
+		records, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		require.NoError(t, err)
+
+		out = append(out, records[1:]...)
+	}
+	return out
+}
+
+func sortedRows(rows [][]string) []string {
+	out := make([]string, len(rows))
+	for i, row := range rows {
+		out[i] = strings.Join(row, ",")
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,200 @@
+package csvprocessor
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+)
+
+// snapshotMagic starts every snapshot file, followed by the version of its format.
+const snapshotMagic = "graphload-snapshot"
+const snapshotVersion = 1
+
+// SnapshotFilename returns the name of the snapshot of the open entities at stopBlock,
+// as written by a run stopping at that block.
+func SnapshotFilename(stopBlock uint64) string {
+	return fmt.Sprintf("%010d", stopBlock)
+}
+
+// writeSnapshot writes the entities of the store, open at stopBlock, to the
+// snapshot store. The snapshot records the name of the fields in the order of their
+// values so it can still be loaded if fields are added to the schema.
+func writeSnapshot(ctx context.Context, store dstore.Store, entities EntityStore, desc *schema.EntityDesc, stopBlock uint64) error {
+	reader, writer := io.Pipe()
+
+	go func() {
+		writer.CloseWithError(encodeSnapshot(writer, entities, desc, stopBlock))
+	}()
+
+	if err := store.WriteObject(ctx, SnapshotFilename(stopBlock), reader); err != nil {
+		reader.CloseWithError(err)
+		return fmt.Errorf("writing snapshot at block %d: %w", stopBlock, err)
+	}
+	return nil
+}
+
+func encodeSnapshot(w io.Writer, entities EntityStore, desc *schema.EntityDesc, stopBlock uint64) error {
+	out := bufio.NewWriter(w)
+
+	header := append([]byte(snapshotMagic), snapshotVersion)
+	header = binary.AppendUvarint(header, stopBlock)
+	header = binary.AppendUvarint(header, uint64(len(desc.OrderedFields())))
+	for _, f := range desc.OrderedFields() {
+		header = appendBytes(header, []byte(f.Name))
+	}
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+
+	var buf []byte
+	err := entities.Iterate(func(ent *Entity) error {
+		buf = appendBytes(buf[:0], []byte(ent.ID))
+		buf = appendBytes(buf, encodeEntity(ent))
+		_, err := out.Write(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return out.Flush()
+}
+
+// loadSnapshot puts the entities of the snapshot taken at startBlock in the store,
+// marked as already exported, and returns how many were loaded.
+func loadSnapshot(ctx context.Context, store dstore.Store, entities EntityStore, desc *schema.EntityDesc, startBlock uint64) (int, error) {
+	filename := SnapshotFilename(startBlock)
+	exists, err := store.FileExists(ctx, filename)
+	if err != nil {
+		return 0, fmt.Errorf("checking snapshot: %w", err)
+	}
+	if !exists {
+		return 0, fmt.Errorf("no snapshot at block %d in %q, it is written by a 'tocsv' run stopping at that block", startBlock, store.BaseURL())
+	}
+
+	reader, err := store.OpenObject(ctx, filename)
+	if err != nil {
+		return 0, fmt.Errorf("opening snapshot: %w", err)
+	}
+	defer reader.Close()
+
+	count, err := decodeSnapshot(bufio.NewReader(reader), entities, desc, startBlock)
+	if err != nil {
+		return count, fmt.Errorf("reading snapshot %q: %w", filename, err)
+	}
+	return count, nil
+}
+
+func decodeSnapshot(in *bufio.Reader, entities EntityStore, desc *schema.EntityDesc, startBlock uint64) (int, error) {
+	magic := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, fmt.Errorf("not a snapshot file")
+	}
+	if version := magic[len(snapshotMagic)]; version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	stopBlock, err := binary.ReadUvarint(in)
+	if err != nil {
+		return 0, fmt.Errorf("reading stop block: %w", err)
+	}
+	if stopBlock != startBlock {
+		return 0, fmt.Errorf("snapshot was taken at block %d, expected %d", stopBlock, startBlock)
+	}
+
+	fieldCount, err := binary.ReadUvarint(in)
+	if err != nil {
+		return 0, fmt.Errorf("reading field count: %w", err)
+	}
+
+	// indexes maps the position of each snapshot value to the current schema's one
+	indexes := make([]int, fieldCount)
+	for i := range indexes {
+		name, err := readBytes(in)
+		if err != nil {
+			return 0, fmt.Errorf("reading field names: %w", err)
+		}
+
+		indexes[i] = -1
+		for j, f := range desc.OrderedFields() {
+			if f.Name == string(name) {
+				indexes[i] = j
+				break
+			}
+		}
+		if indexes[i] == -1 {
+			return 0, fmt.Errorf("snapshot field %q is not part of entity %q anymore", name, desc.Name)
+		}
+	}
+
+	count := 0
+	for {
+		id, err := readBytes(in)
+		if err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, fmt.Errorf("reading entity: %w", err)
+		}
+
+		data, err := readBytes(in)
+		if err != nil {
+			return count, fmt.Errorf("reading entity %q: %w", id, unexpectedEOF(err))
+		}
+
+		snapshotEnt, err := decodeEntity(string(id), data)
+		if err != nil {
+			return count, fmt.Errorf("decoding entity %q: %w", id, err)
+		}
+		if len(snapshotEnt.Values) != len(indexes) {
+			return count, fmt.Errorf("entity %q has %d values, expected %d", id, len(snapshotEnt.Values), len(indexes))
+		}
+
+		ent := &Entity{
+			StartBlock: snapshotEnt.StartBlock,
+			ID:         snapshotEnt.ID,
+			Values:     make([]*pbentity.Value, len(desc.OrderedFields())),
+			exported:   true,
+		}
+		for i, v := range snapshotEnt.Values {
+			ent.Values[indexes[i]] = v
+		}
+
+		if err := entities.Put(ent); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+func appendBytes(out []byte, in []byte) []byte {
+	out = binary.AppendUvarint(out, uint64(len(in)))
+	return append(out, in...)
+}
+
+func readBytes(in *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(in)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(in, out); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return out, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -7,25 +7,34 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 
 	"github.com/streamingfast/bstream"
 	"github.com/streamingfast/dstore"
 	"github.com/streamingfast/substreams-graph-load/schema"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
 )
 
+// ClosuresHeader is the header of the closures files, listing the open rows exported
+// by a previous run whose block range ends at `upper`.
+var ClosuresHeader = []string{"id", "lower", "upper"}
+
 type WriterManager struct {
 	current      *Writer
 	currentRange *bstream.Range
+	startBlock   uint64
 	stopBlock    uint64
 	bundleSize   uint64
 	store        dstore.Store
 	entityDesc   *schema.EntityDesc
+	rowCount     uint64
 }
 
-func NewWriterManager(bundleSize, stopBlock uint64, store dstore.Store, entityDesc *schema.EntityDesc) *WriterManager {
+func NewWriterManager(bundleSize, startBlock, stopBlock uint64, store dstore.Store, entityDesc *schema.EntityDesc) *WriterManager {
 	return &WriterManager{
 		bundleSize: bundleSize,
+		startBlock: startBlock,
 		stopBlock:  stopBlock,
 		store:      store,
 		entityDesc: entityDesc,
@@ -48,6 +57,9 @@ func (wm *WriterManager) setNewWriter(ctx context.Context, blockNum uint64) erro
 		if err != nil {
 			return err
 		}
+		if r.StartBlock() < wm.startBlock {
+			r = bstream.NewRangeExcludingEnd(wm.startBlock, *r.EndBlock())
+		}
 		nextRange = r
 	} else {
 		r := wm.currentRange
@@ -106,7 +118,12 @@ func (wm *WriterManager) Close() error {
 }
 
 func (wm *WriterManager) Write(e *Entity, desc *schema.EntityDesc, stopBlock uint64) error {
-	return wm.current.Write(e, desc, stopBlock)
+	if err := wm.current.Write(e, desc, stopBlock); err != nil {
+		return err
+	}
+	wm.rowCount++
+	RowsWritten.Inc(desc.Name)
+	return nil
 }
 
 type Writer struct {
@@ -157,19 +174,22 @@ func (c *Writer) WriteHeader(desc *schema.EntityDesc) error {
 
 func (c *Writer) Write(e *Entity, desc *schema.EntityDesc, stopBlock uint64) error {
 	records := []string{
-		formatField(e.Fields["id"], schema.FieldTypeID, false, false),
+		toValidString(e.ID),
 		blockRange(e.StartBlock, stopBlock),
 	}
 
 	if desc.Immutable {
-		records[1] = fmt.Sprint(e.StartBlock)
+		records[1] = strconv.FormatUint(e.StartBlock, 10)
 	}
 
-	for _, f := range desc.OrderedFields() {
+	for i, f := range desc.OrderedFields() {
 		if f.Name == "id" {
 			continue
 		}
-		out := formatField(e.Fields[f.Name], f.Type, f.Array, f.Nullable)
+		out, err := formatField(e.Values[i], f)
+		if err != nil {
+			return fmt.Errorf("formatting field %q of entity %q: %w", f.Name, e.ID, err)
+		}
 		records = append(records, out)
 	}
 
@@ -179,135 +199,116 @@ func (c *Writer) Write(e *Entity, desc *schema.EntityDesc, stopBlock uint64) err
 	return nil
 }
 
-func panicIfNotNullable(isNullable bool) {
-	if !isNullable {
-		panic("invalid field: not nullable")
+// formatField renders a value in the text format of Postgres COPY, v must already
+// have been checked against the field's type.
+func formatField(v *pbentity.Value, field *schema.Field) (string, error) {
+	if isNull(v) {
+		if field.Nullable {
+			return "NULL", nil
+		}
+		if field.Array {
+			return "{}", nil
+		}
+		return nullDefault(field.Type)
 	}
-}
 
-func toEscapedStringArray(in []interface{}, formatter string) string {
-	outs := make([]string, len(in))
-	for i := range in {
-		formatted := toValidString(in[i])
-		outs[i] = strings.ReplaceAll(strings.ReplaceAll(formatted, `\`, `\\`), `,`, `\,`)
+	if !field.Array {
+		return formatScalar(v, field.Type)
 	}
-	return "{" + strings.Join(outs, ",") + "}"
-}
 
-func toHexArray(in []interface{}, formatter string) string {
-	outs := make([]string, len(in))
-	for i := range in {
-		outs[i] = toHex(in[i])
+	array, ok := v.Typed.(*pbentity.Value_Array)
+	if !ok {
+		return "", fmt.Errorf("expected array of %s, got %s", field.Type, valueTypeName(v))
 	}
-	return "{" + strings.Join(outs, ",") + "}"
-}
 
-func toInt32Array(in []interface{}, formatter string) string {
-	outs := make([]string, len(in))
-	for i := range in {
-		outs = append(outs, fmt.Sprintf(formatter, in[int32(in[i].(float64))]))
+	var out strings.Builder
+	out.WriteByte('{')
+	for i, elem := range array.Array.GetValue() {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		if isNull(elem) {
+			out.WriteString("NULL")
+			continue
+		}
+
+		formatted, err := formatScalar(elem, field.Type)
+		if err != nil {
+			return "", fmt.Errorf("element %d: %w", i, err)
+		}
+		out.WriteString(toEscapedArrayElement(formatted))
 	}
-	return "{" + strings.Join(outs, ",") + "}"
-}
+	out.WriteByte('}')
 
-func toValidString(in interface{}) string {
-	return strings.Replace(in.(string), "\x00", "", -1)
+	return out.String(), nil
 }
 
-func toHex(in interface{}) string {
-
-	b, err := base64.StdEncoding.DecodeString(in.(string))
-	if err != nil {
-		panic("received invalid data")
+func nullDefault(t schema.FieldType) (string, error) {
+	switch t {
+	case schema.FieldTypeID, schema.FieldTypeString, schema.FieldTypeBytes:
+		return "", nil
+	case schema.FieldTypeBigInt, schema.FieldTypeBigDecimal, schema.FieldTypeInt:
+		return "0", nil
+	case schema.FieldTypeBoolean:
+		return "false", nil
 	}
-
-	out := "\\x"
-	return out + hex.EncodeToString(b)
+	return "", fmt.Errorf("invalid field type: %q", t)
 }
 
-func formatField(f interface{}, t schema.FieldType, isArray, isNullable bool) string {
+func formatScalar(v *pbentity.Value, t schema.FieldType) (string, error) {
 	switch t {
 	case schema.FieldTypeID, schema.FieldTypeString:
-		if f == nil {
-			if isNullable {
-				return "NULL"
-			}
-			return ""
-		}
-		if isArray {
-			return toEscapedStringArray(f.([]interface{}), "%s")
+		if typed, ok := v.Typed.(*pbentity.Value_String_); ok {
+			return toValidString(typed.String_), nil
 		}
-		return toValidString(f)
 	case schema.FieldTypeBytes:
-		if f == nil {
-			if isNullable {
-				return "NULL"
-			}
-			return ""
-		}
-		if isArray {
-			return toHexArray(f.([]interface{}), "%s")
+		if typed, ok := v.Typed.(*pbentity.Value_Bytes); ok {
+			return toHex(typed.Bytes)
 		}
-		return toHex(f)
 	case schema.FieldTypeBigInt:
-		if f == nil {
-			if isNullable {
-				return "NULL"
-			}
-			return "0"
+		if typed, ok := v.Typed.(*pbentity.Value_Bigint); ok {
+			return toValidString(typed.Bigint), nil
 		}
-		if isArray {
-			return toEscapedStringArray(f.([]interface{}), "%s")
-		}
-		return toValidString(f)
 	case schema.FieldTypeBigDecimal:
-		if f == nil {
-			if isNullable {
-				return "NULL"
-			}
-			return "0"
-		}
-		if isArray {
-			return toEscapedStringArray(f.([]interface{}), "%s")
+		if typed, ok := v.Typed.(*pbentity.Value_Bigdecimal); ok {
+			return toValidString(typed.Bigdecimal), nil
 		}
-		return toValidString(f)
 	case schema.FieldTypeInt:
-		if f == nil {
-			if isNullable {
-				return "NULL"
-			}
-			return "0"
-		}
-		if isArray {
-			return toInt32Array(f.([]interface{}), "%d")
+		if typed, ok := v.Typed.(*pbentity.Value_Int32); ok {
+			return strconv.FormatInt(int64(typed.Int32), 10), nil
 		}
-		return fmt.Sprintf("%d", int32(f.(float64)))
-	// This is not supported here.
-	//case schema.FieldTypeFloat:
-	//	if f == nil {
-	//		if isNullable {
-	//			return "NULL"
-	//		}
-	//		return "0"
-	//	}
-	//	if isArray {
-	//		return toEscapedStringArray(f.([]interface{}), "%f")
-	//	}
-	//	return fmt.Sprintf("%f", f)
 	case schema.FieldTypeBoolean:
-		if f == nil {
-			if isNullable {
-				return "NULL"
-			}
-			return "false"
+		if typed, ok := v.Typed.(*pbentity.Value_Bool); ok {
+			return strconv.FormatBool(typed.Bool), nil
 		}
-		if isArray {
-			return toEscapedStringArray(f.([]interface{}), "%t")
-		}
-		return fmt.Sprintf("%t", f)
+	// Float is not supported here.
 	default:
-		panic(fmt.Errorf("invalid field type: %q", t))
+		return "", fmt.Errorf("invalid field type: %q", t)
+	}
+
+	return "", fmt.Errorf("expected %s, got %s", t, valueTypeName(v))
+}
+
+// toEscapedArrayElement quotes an array element for a Postgres array literal when
+// it contains characters that are otherwise interpreted by the array parser.
+func toEscapedArrayElement(in string) string {
+	if in != "" && !strings.ContainsAny(in, `{},"\ `) && !strings.EqualFold(in, "NULL") {
+		return in
+	}
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(in, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+func toValidString(in string) string {
+	return strings.ReplaceAll(in, "\x00", "")
+}
+
+func toHex(in string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(in)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 bytes: %w", err)
 	}
+
+	return "\\x" + hex.EncodeToString(b), nil
 }
 
 func (c *Writer) Close() error {
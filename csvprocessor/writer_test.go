@@ -4,18 +4,56 @@ import (
 	"testing"
 
 	"github.com/streamingfast/substreams-graph-load/schema"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFormatField(t *testing.T) {
-	var in interface{}
-	in = "hFgqh8ZmyJrv2UhHF3t/r0l20y8PBf2mK+yFdQAAAAA="
+	in := &pbentity.Value{Typed: &pbentity.Value_Bytes{Bytes: "hFgqh8ZmyJrv2UhHF3t/r0l20y8PBf2mK+yFdQAAAAA="}}
 	expected := "\\x84582a87c666c89aefd94847177b7faf4976d32f0f05fda62bec857500000000"
-	got := formatField(
-		in,
-		schema.FieldTypeBytes,
-		false,
-		false,
-	)
+	got, err := formatField(in, &schema.Field{Type: schema.FieldTypeBytes})
+	require.NoError(t, err)
 	assert.Equal(t, expected, got)
 }
+
+func TestFormatField_Values(t *testing.T) {
+	array := func(values ...*pbentity.Value) *pbentity.Value {
+		return &pbentity.Value{Typed: &pbentity.Value_Array{Array: &pbentity.Array{Value: values}}}
+	}
+	str := func(in string) *pbentity.Value { return &pbentity.Value{Typed: &pbentity.Value_String_{String_: in}} }
+	int32Value := func(in int32) *pbentity.Value { return &pbentity.Value{Typed: &pbentity.Value_Int32{Int32: in}} }
+
+	tests := []struct {
+		name     string
+		value    *pbentity.Value
+		field    *schema.Field
+		expected string
+	}{
+		{"string", str("a\x00b"), &schema.Field{Type: schema.FieldTypeString}, "ab"},
+		{"int", int32Value(-4), &schema.Field{Type: schema.FieldTypeInt}, "-4"},
+		{"bool", &pbentity.Value{Typed: &pbentity.Value_Bool{Bool: true}}, &schema.Field{Type: schema.FieldTypeBoolean}, "true"},
+		{"null nullable", nil, &schema.Field{Type: schema.FieldTypeInt, Nullable: true}, "NULL"},
+		{"null default", nullValue, &schema.Field{Type: schema.FieldTypeBigInt}, "0"},
+		{"null array", nil, &schema.Field{Type: schema.FieldTypeString, Array: true}, "{}"},
+		{"int array", array(int32Value(1), int32Value(2)), &schema.Field{Type: schema.FieldTypeInt, Array: true}, "{1,2}"},
+		{"string array", array(str("a"), str("b,c"), str(`d"\`), str(""), str("NULL")), &schema.Field{Type: schema.FieldTypeString, Array: true}, `{a,"b,c","d\"\\","","NULL"}`},
+		{"array null element", array(str("a"), nullValue), &schema.Field{Type: schema.FieldTypeString, Array: true, Nullable: true}, "{a,NULL}"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := formatField(test.value, test.field)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestFormatField_Invalid(t *testing.T) {
+	_, err := formatField(&pbentity.Value{Typed: &pbentity.Value_Bytes{Bytes: "not base64!"}}, &schema.Field{Type: schema.FieldTypeBytes})
+	assert.ErrorContains(t, err, "invalid base64")
+
+	_, err = formatField(&pbentity.Value{Typed: &pbentity.Value_Bool{Bool: true}}, &schema.Field{Type: schema.FieldTypeInt})
+	assert.ErrorContains(t, err, "expected Int, got Bool")
+}
@@ -0,0 +1,130 @@
+package graphload
+
+import (
+	"encoding/json"
+	"fmt"
+
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+)
+
+// UnmarshalJSON decodes an entity change line as written by `run`, which encodes the
+// protobuf structs with `encoding/json`, oneof values included as `{"Typed":{"<Variant>":...}}`.
+func (e *EntityChangeAtBlockNum) UnmarshalJSON(data []byte) error {
+	in := struct {
+		EntityChange *jsonEntityChange `json:"entity_change"`
+		BlockNum     uint64            `json:"block_num"`
+		Index        uint64            `json:"index"`
+	}{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	e.BlockNum = in.BlockNum
+	e.Index = in.Index
+	e.EntityChange = nil
+	if in.EntityChange == nil {
+		return nil
+	}
+
+	change := &pbentity.EntityChange{
+		Entity:    in.EntityChange.Entity,
+		Id:        in.EntityChange.ID,
+		Ordinal:   in.EntityChange.Ordinal,
+		Operation: in.EntityChange.Operation,
+	}
+
+	if len(in.EntityChange.Fields) > 0 {
+		change.Fields = make([]*pbentity.Field, len(in.EntityChange.Fields))
+	}
+	for i, f := range in.EntityChange.Fields {
+		if f == nil {
+			return fmt.Errorf("field %d is null", i)
+		}
+		newValue, err := f.NewValue.toValue()
+		if err != nil {
+			return fmt.Errorf("field %q new value: %w", f.Name, err)
+		}
+		oldValue, err := f.OldValue.toValue()
+		if err != nil {
+			return fmt.Errorf("field %q old value: %w", f.Name, err)
+		}
+
+		change.Fields[i] = &pbentity.Field{
+			Name:     f.Name,
+			NewValue: newValue,
+			OldValue: oldValue,
+		}
+	}
+
+	e.EntityChange = change
+	return nil
+}
+
+type jsonEntityChange struct {
+	Entity    string                          `json:"entity"`
+	ID        string                          `json:"id"`
+	Ordinal   uint64                          `json:"ordinal"`
+	Operation pbentity.EntityChange_Operation `json:"operation"`
+	Fields    []*jsonField                    `json:"fields"`
+}
+
+type jsonField struct {
+	Name     string     `json:"name"`
+	NewValue *jsonValue `json:"new_value"`
+	OldValue *jsonValue `json:"old_value"`
+}
+
+type jsonValue struct {
+	Typed *struct {
+		Int32      *int32  `json:"Int32"`
+		Bigdecimal *string `json:"Bigdecimal"`
+		Bigint     *string `json:"Bigint"`
+		String_    *string `json:"String_"`
+		Bytes      *string `json:"Bytes"`
+		Bool       *bool   `json:"Bool"`
+		Array      *struct {
+			Value []*jsonValue `json:"value"`
+		} `json:"Array"`
+	} `json:"Typed"`
+}
+
+func (v *jsonValue) toValue() (*pbentity.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	out := &pbentity.Value{}
+	typed := v.Typed
+	switch {
+	case typed == nil:
+	case typed.Int32 != nil:
+		out.Typed = &pbentity.Value_Int32{Int32: *typed.Int32}
+	case typed.Bigdecimal != nil:
+		out.Typed = &pbentity.Value_Bigdecimal{Bigdecimal: *typed.Bigdecimal}
+	case typed.Bigint != nil:
+		out.Typed = &pbentity.Value_Bigint{Bigint: *typed.Bigint}
+	case typed.String_ != nil:
+		out.Typed = &pbentity.Value_String_{String_: *typed.String_}
+	case typed.Bytes != nil:
+		out.Typed = &pbentity.Value_Bytes{Bytes: *typed.Bytes}
+	case typed.Bool != nil:
+		out.Typed = &pbentity.Value_Bool{Bool: *typed.Bool}
+	case typed.Array != nil:
+		array := &pbentity.Array{}
+		if len(typed.Array.Value) > 0 {
+			array.Value = make([]*pbentity.Value, len(typed.Array.Value))
+		}
+		for i, elem := range typed.Array.Value {
+			value, err := elem.toValue()
+			if err != nil {
+				return nil, fmt.Errorf("array element %d: %w", i, err)
+			}
+			array.Value[i] = value
+		}
+		out.Typed = &pbentity.Value_Array{Array: array}
+	default:
+		return nil, fmt.Errorf("unknown value type")
+	}
+
+	return out, nil
+}
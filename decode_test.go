@@ -0,0 +1,59 @@
+package graphload
+
+import (
+	"encoding/json"
+	"testing"
+
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEntityChangeAtBlockNum_UnmarshalJSON(t *testing.T) {
+	value := func(typed any) *pbentity.Value {
+		switch v := typed.(type) {
+		case int32:
+			return &pbentity.Value{Typed: &pbentity.Value_Int32{Int32: v}}
+		case bool:
+			return &pbentity.Value{Typed: &pbentity.Value_Bool{Bool: v}}
+		case []*pbentity.Value:
+			return &pbentity.Value{Typed: &pbentity.Value_Array{Array: &pbentity.Array{Value: v}}}
+		}
+		panic("unhandled")
+	}
+
+	in := &EntityChangeAtBlockNum{
+		BlockNum: 12,
+		Index:    3,
+		EntityChange: &pbentity.EntityChange{
+			Entity:    "Pool",
+			Id:        "0xabc",
+			Ordinal:   7,
+			Operation: pbentity.EntityChange_OPERATION_UPDATE,
+			Fields: []*pbentity.Field{
+				{Name: "int", NewValue: value(int32(-4))},
+				{Name: "zeroInt", NewValue: value(int32(0))},
+				{Name: "bool", NewValue: value(false)},
+				{Name: "string", NewValue: &pbentity.Value{Typed: &pbentity.Value_String_{String_: "hello"}}},
+				{Name: "bigint", NewValue: &pbentity.Value{Typed: &pbentity.Value_Bigint{Bigint: "123456789012345678901234567890"}}},
+				{Name: "bigdecimal", NewValue: &pbentity.Value{Typed: &pbentity.Value_Bigdecimal{Bigdecimal: "1.5"}}},
+				{Name: "bytes", NewValue: &pbentity.Value{Typed: &pbentity.Value_Bytes{Bytes: "AQID"}}},
+				{Name: "array", NewValue: value([]*pbentity.Value{value(int32(1)), value(true)})},
+				{Name: "emptyArray", NewValue: &pbentity.Value{Typed: &pbentity.Value_Array{Array: &pbentity.Array{}}}},
+				{Name: "untyped", NewValue: &pbentity.Value{}},
+				{Name: "null"},
+			},
+		},
+	}
+
+	data, err := json.Marshal(in)
+	require.NoError(t, err)
+
+	out := &EntityChangeAtBlockNum{}
+	require.NoError(t, json.Unmarshal(data, out))
+
+	assert.Equal(t, in.BlockNum, out.BlockNum)
+	assert.Equal(t, in.Index, out.Index)
+	assert.True(t, proto.Equal(in.EntityChange, out.EntityChange), "expected %s, got %s", in.EntityChange, out.EntityChange)
+}
@@ -0,0 +1,236 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the job config of a pipeline, describing the deployment to load and the
+// arguments of each phase.
+type Config struct {
+	// Deployment is the Qm hash of the deployment, or its sgdN schema
+	Deployment     string `yaml:"deployment"`
+	GraphQLSchema  string `yaml:"graphql_schema"`
+	PsqlDSN        string `yaml:"psql_dsn"`
+	EntitiesFolder string `yaml:"entities_folder"`
+	CSVFolder      string `yaml:"csv_folder"`
+	BundleSize     uint64 `yaml:"bundle_size"`
+	// StartBlock is the first block injected, the start of the first CSV file
+	StartBlock uint64 `yaml:"start_block"`
+	// StopBlock is the exclusive end of the range loaded, aligned on BundleSize
+	StopBlock uint64 `yaml:"stop_block"`
+
+	Run         RunConfig         `yaml:"run"`
+	ToCSV       ToCSVConfig       `yaml:"tocsv"`
+	DropIndex   PhaseConfig       `yaml:"drop_index"`
+	InjectCSV   InjectCSVConfig   `yaml:"inject_csv"`
+	Handoff     HandoffConfig     `yaml:"handoff"`
+	CreateIndex CreateIndexConfig `yaml:"create_index"`
+
+	digest string
+}
+
+// PhaseConfig holds the settings common to all phases.
+type PhaseConfig struct {
+	// Skip excludes the phase from the pipeline
+	Skip bool `yaml:"skip"`
+	// Flags are extra flags passed to the phase's command, like '--segments=8'
+	Flags []string `yaml:"flags"`
+}
+
+type RunConfig struct {
+	PhaseConfig `yaml:",inline"`
+
+	Endpoint string `yaml:"endpoint"`
+	Manifest string `yaml:"manifest"`
+	Module   string `yaml:"module"`
+	ChainID  string `yaml:"chain_id"`
+}
+
+type ToCSVConfig struct {
+	PhaseConfig `yaml:",inline"`
+
+	Workers int `yaml:"workers"`
+}
+
+type InjectCSVConfig struct {
+	PhaseConfig `yaml:",inline"`
+
+	Connections int `yaml:"connections"`
+}
+
+type HandoffConfig struct {
+	PhaseConfig `yaml:",inline"`
+
+	// BlockHash is the hash of the last block loaded, StopBlock - 1. When blank, it is
+	// read from the 'last_block.txt' file written by the run phase.
+	BlockHash string `yaml:"block_hash"`
+}
+
+type CreateIndexConfig struct {
+	PhaseConfig `yaml:",inline"`
+
+	// DDL is the file of the 'create index' statements to apply
+	DDL string `yaml:"ddl"`
+}
+
+// LoadConfig reads and validates the job config at path.
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading job config: %w", err)
+	}
+
+	config, err := parseConfig(content)
+	if err != nil {
+		return nil, fmt.Errorf("job config %q: %w", path, err)
+	}
+	return config, nil
+}
+
+func parseConfig(content []byte) (*Config, error) {
+	config := &Config{}
+	if err := yaml.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("invalid yaml: %w", err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(content)
+	config.digest = hex.EncodeToString(digest[:])
+	return config, nil
+}
+
+// Digest identifies the content of the config, to detect a config changed between
+// two executions of the same pipeline.
+func (c *Config) Digest() string {
+	return c.digest
+}
+
+func (c *Config) validate() error {
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"deployment", c.Deployment},
+		{"graphql_schema", c.GraphQLSchema},
+		{"psql_dsn", c.PsqlDSN},
+		{"entities_folder", c.EntitiesFolder},
+		{"csv_folder", c.CSVFolder},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			return fmt.Errorf("%q is required", field.name)
+		}
+	}
+
+	if c.BundleSize == 0 {
+		return fmt.Errorf(`"bundle_size" is required`)
+	}
+	if c.StopBlock <= c.StartBlock {
+		return fmt.Errorf(`"stop_block" %d must be greater than "start_block" %d`, c.StopBlock, c.StartBlock)
+	}
+
+	if !c.Run.Skip && (c.Run.Endpoint == "" || c.Run.Manifest == "" || c.Run.Module == "") {
+		return fmt.Errorf(`"run.endpoint", "run.manifest" and "run.module" are required unless the run phase is skipped`)
+	}
+	if !c.Handoff.Skip && c.Handoff.BlockHash == "" && c.Run.Skip {
+		return fmt.Errorf(`"handoff.block_hash", the hash of block %d, is required when the run phase is skipped`, c.StopBlock-1)
+	}
+	if !c.CreateIndex.Skip && c.CreateIndex.DDL == "" {
+		return fmt.Errorf(`"create_index.ddl" is required unless the create-index phase is skipped`)
+	}
+	if !c.DropIndex.Skip && c.CreateIndex.Skip {
+		return fmt.Errorf("the drop-index phase requires the create-index phase, the dropped indexes would never be created back")
+	}
+
+	return nil
+}
+
+// CheckFiles returns an error if a file needed by one of phases is missing. The DDL
+// file of the create-index phase is checked before dropping indexes too, or a missing
+// file would only fail the last phase, with the indexes already dropped.
+func (c *Config) CheckFiles(phases []Phase) error {
+	for _, phase := range phases {
+		if phase != PhaseDropIndex && phase != PhaseCreateIndex {
+			continue
+		}
+		if _, err := os.Stat(c.CreateIndex.DDL); err != nil {
+			return fmt.Errorf(`"create_index.ddl" of the %s phase: %w`, phase, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Args returns the graphload command line of the phase.
+func (c *Config) Args(phase Phase) []string {
+	stopBlock := strconv.FormatUint(c.StopBlock, 10)
+	bundleSize := fmt.Sprintf("--bundle-size=%d", c.BundleSize)
+
+	var args []string
+	switch phase {
+	case PhaseRun:
+		args = []string{"run", "--graphql-schema=" + c.GraphQLSchema, bundleSize}
+		if c.Run.ChainID != "" {
+			args = append(args, "--chain-id="+c.Run.ChainID)
+		}
+		args = append(args, c.EntitiesFolder, c.Run.Endpoint, c.Run.Manifest, c.Run.Module, stopBlock)
+	case PhaseToCSV:
+		args = []string{"tocsv", "--all-entities", "--graphql-schema=" + c.GraphQLSchema, bundleSize}
+		if c.ToCSV.Workers != 0 {
+			args = append(args, fmt.Sprintf("--workers=%d", c.ToCSV.Workers))
+		}
+		args = append(args, c.EntitiesFolder, c.CSVFolder, stopBlock)
+	case PhaseDropIndex:
+		args = []string{"drop-index", c.Deployment, c.PsqlDSN, c.GraphQLSchema}
+	case PhaseInjectCSV:
+		args = []string{"inject-csv", "--all-entities"}
+		if c.InjectCSV.Connections != 0 {
+			args = append(args, fmt.Sprintf("--connections=%d", c.InjectCSV.Connections))
+		}
+		args = append(args, c.Deployment, c.CSVFolder, c.GraphQLSchema, c.PsqlDSN, strconv.FormatUint(c.StartBlock, 10), stopBlock)
+	case PhaseHandoff:
+		if c.Handoff.BlockHash == "" {
+			args = []string{"handoff", "--last-block-from=" + c.EntitiesFolder, c.Deployment, c.PsqlDSN}
+		} else {
+			args = []string{"handoff", c.Deployment, c.Handoff.BlockHash, strconv.FormatUint(c.StopBlock-1, 10), c.PsqlDSN}
+		}
+	case PhaseCreateIndex:
+		args = []string{"create-index", c.Deployment, c.CreateIndex.DDL, c.PsqlDSN, c.GraphQLSchema}
+	default:
+		panic(fmt.Errorf("unknown phase %q", phase))
+	}
+
+	return append(args, c.phaseConfig(phase).Flags...)
+}
+
+// Skipped returns true if the phase is excluded from the pipeline by the config.
+func (c *Config) Skipped(phase Phase) bool {
+	return c.phaseConfig(phase).Skip
+}
+
+func (c *Config) phaseConfig(phase Phase) PhaseConfig {
+	switch phase {
+	case PhaseRun:
+		return c.Run.PhaseConfig
+	case PhaseToCSV:
+		return c.ToCSV.PhaseConfig
+	case PhaseDropIndex:
+		return c.DropIndex
+	case PhaseInjectCSV:
+		return c.InjectCSV.PhaseConfig
+	case PhaseHandoff:
+		return c.Handoff.PhaseConfig
+	case PhaseCreateIndex:
+		return c.CreateIndex.PhaseConfig
+	}
+	panic(fmt.Errorf("unknown phase %q", phase))
+}
@@ -0,0 +1,133 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Phase is a step of the pipeline, run by the graphload command of the same name.
+type Phase string
+
+const (
+	PhaseRun         Phase = "run"
+	PhaseToCSV       Phase = "tocsv"
+	PhaseDropIndex   Phase = "drop-index"
+	PhaseInjectCSV   Phase = "inject-csv"
+	PhaseHandoff     Phase = "handoff"
+	PhaseCreateIndex Phase = "create-index"
+)
+
+// Phases are all the phases, in the order they run.
+var Phases = []Phase{PhaseRun, PhaseToCSV, PhaseDropIndex, PhaseInjectCSV, PhaseHandoff, PhaseCreateIndex}
+
+func ParsePhase(in string) (Phase, error) {
+	for _, phase := range Phases {
+		if string(phase) == in {
+			return phase, nil
+		}
+	}
+	return "", fmt.Errorf("invalid phase %q, must be one of %q", in, Phases)
+}
+
+// State records the phases completed by a pipeline, persisted after each of them so
+// the pipeline resumes at the first phase not completed.
+type State struct {
+	// ConfigDigest is the digest of the job config the phases were completed with
+	ConfigDigest string                 `json:"config_digest"`
+	Phases       map[Phase]*PhaseStatus `json:"phases"`
+}
+
+type PhaseStatus struct {
+	CompletedAt time.Time `json:"completed_at"`
+	Duration    string    `json:"duration"`
+}
+
+func NewState(config *Config) *State {
+	return &State{ConfigDigest: config.Digest(), Phases: map[Phase]*PhaseStatus{}}
+}
+
+// LoadState reads the state at path, returning nil if it does not exist.
+func LoadState(path string) (*State, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading state: %w", err)
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("unmarshal state %q: %w", path, err)
+	}
+	if state.Phases == nil {
+		state.Phases = map[Phase]*PhaseStatus{}
+	}
+	return state, nil
+}
+
+// Save writes the state at path, through a temporary file so an interrupted write
+// does not lose the previous state.
+func (s *State) Save(path string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(content)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	return nil
+}
+
+func (s *State) Completed(phase Phase) bool {
+	return s.Phases[phase] != nil
+}
+
+func (s *State) MarkCompleted(phase Phase, duration time.Duration) {
+	s.Phases[phase] = &PhaseStatus{CompletedAt: time.Now().UTC(), Duration: duration.Round(time.Second).String()}
+}
+
+// SelectPhases returns the phases to run. With only set, it is the only one. With
+// from set, it is that phase and the following ones, completed or not. Otherwise,
+// it is the first phase not completed and the following ones, a phase completed on
+// its own with only set does not make the pipeline skip the ones before it. Phases
+// skipped by the config are never selected.
+func SelectPhases(config *Config, state *State, from, only Phase) (out []Phase) {
+	if only != "" {
+		if config.Skipped(only) {
+			return nil
+		}
+		return []Phase{only}
+	}
+
+	started := false
+	for _, phase := range Phases {
+		skipped := config.Skipped(phase)
+		if phase == from || from == "" && !skipped && !state.Completed(phase) {
+			started = true
+		}
+		if started && !skipped {
+			out = append(out, phase)
+		}
+	}
+	return out
+}
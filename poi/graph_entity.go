@@ -0,0 +1,33 @@
+package poi
+
+import (
+	"encoding/base64"
+
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+)
+
+// NewDigestEntityChange returns the `poi2$` entity change recording the POI digest
+// of the chain at the given block, as stored by `graph-node`.
+func NewDigestEntityChange(digest []byte, chainID string, blockNum uint64) *graphload.EntityChangeAtBlockNum {
+	return &graphload.EntityChangeAtBlockNum{
+		BlockNum: blockNum,
+		EntityChange: &pbentity.EntityChange{
+			Entity: schema.PoiEntityName,
+			Id:     chainID,
+			// Ordinal
+			Operation: pbentity.EntityChange_OPERATION_UPDATE,
+			Fields: []*pbentity.Field{
+				{
+					Name: "digest",
+					NewValue: &pbentity.Value{
+						Typed: &pbentity.Value_Bytes{
+							Bytes: base64.StdEncoding.EncodeToString(digest),
+						},
+					},
+				},
+			},
+		},
+	}
+}
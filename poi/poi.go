@@ -44,6 +44,23 @@ func (p *ProofOfIndexing) RemoveEntity(entity *pbentity.EntityChange) {
 	p.stream.Write(NewProofOfIndexingRemoveEntity(entity))
 }
 
+// AddEntityChange records the entity change as a set or remove event depending on
+// its operation.
+func (p *ProofOfIndexing) AddEntityChange(change *pbentity.EntityChange) error {
+	switch change.Operation {
+	case pbentity.EntityChange_OPERATION_CREATE, pbentity.EntityChange_OPERATION_UPDATE, pbentity.EntityChange_OPERATION_FINAL:
+		p.SetEntity(change)
+
+	case pbentity.EntityChange_OPERATION_DELETE:
+		p.RemoveEntity(change)
+
+	case pbentity.EntityChange_OPERATION_UNSPECIFIED:
+		return fmt.Errorf("received %q operation which is should never be sent", change.Operation)
+	}
+
+	return nil
+}
+
 // Pause returns the current `poi` bytes up to now.
 func (p *ProofOfIndexing) Pause(prev []byte) ([]byte, error) {
 	p.stream.fastHasherWrite(stablehash.U64(p.stream.vecLength), []uint64{
@@ -0,0 +1,9 @@
+package poiprocessor
+
+import "github.com/streamingfast/logging"
+
+var zlog, tracer = logging.PackageLogger("poiprocessor", "github.com/streamingfast/substreams-graph-load/poiprocessor_test")
+
+func init() {
+	logging.InstantiateLoggers()
+}
@@ -0,0 +1,353 @@
+package poiprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/streamingfast/logging"
+	"github.com/streamingfast/shutter"
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
+	"github.com/streamingfast/substreams-graph-load/poi"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	"go.uber.org/zap"
+)
+
+// Processor recomputes the POI offline by replaying, block by block, the
+// per-entity bundles written by `run`, and writes (or verifies) the `poi2$`
+// bundles exactly as `run` would have.
+type Processor struct {
+	*shutter.Shutter
+
+	srcFolder  string
+	entities   []string
+	workingDir string
+
+	startBlock uint64
+	stopBlock  uint64
+	bundleSize uint64
+	bufferSize uint64
+	chainID    string
+	lastPOI    []byte
+	verify     bool
+
+	logger *zap.Logger
+	tracer logging.Tracer
+}
+
+func New(
+	srcFolder string,
+	workingDir string,
+	entities []string,
+	startBlock uint64,
+	stopBlock uint64,
+	bundleSize uint64,
+	bufferSize uint64,
+	chainID string,
+	startPOI []byte,
+	verify bool,
+	logger *zap.Logger,
+	tracer logging.Tracer,
+) (*Processor, error) {
+	if stopBlock == 0 {
+		return nil, fmt.Errorf("stopBlock must be >0")
+	}
+	if startBlock >= stopBlock {
+		return nil, fmt.Errorf("start block %d must be lower than stop block %d", startBlock, stopBlock)
+	}
+
+	return &Processor{
+		Shutter:    shutter.New(),
+		srcFolder:  srcFolder,
+		entities:   entities,
+		workingDir: workingDir,
+		startBlock: startBlock,
+		stopBlock:  stopBlock,
+		bundleSize: bundleSize,
+		bufferSize: bufferSize,
+		chainID:    chainID,
+		lastPOI:    startPOI,
+		verify:     verify,
+		logger:     logger,
+		tracer:     tracer,
+	}, nil
+}
+
+// FirstBundleStartBlock returns the start block of the first bundle written for the
+// entity in srcFolder.
+func FirstBundleStartBlock(ctx context.Context, srcFolder string, entity string) (uint64, error) {
+	store, _, _, err := bundler.DetectEntityStore(ctx, srcFolder, entity)
+	if err != nil {
+		return 0, err
+	}
+
+	return firstBundleStartBlock(ctx, store)
+}
+
+func (p *Processor) Run(ctx context.Context) {
+	p.Shutdown(p.run(ctx))
+}
+
+func (p *Processor) run(ctx context.Context) error {
+	readers := make([]*bundleReader, len(p.entities))
+	// The poi2$ bundles are written with the file type and compression of the entity bundles
+	outputFileType, outputCompression := writer.FileTypeJSONL, compression.Gzip
+	for i, entity := range p.entities {
+		store, fileType, entityCompression, err := bundler.DetectEntityStore(ctx, p.srcFolder, entity)
+		if err != nil {
+			return err
+		}
+		outputFileType, outputCompression = fileType, entityCompression
+
+		reader, err := newBundleReader(ctx, store, fileType, p.startBlock, p.stopBlock)
+		if err != nil {
+			return fmt.Errorf("entity %q: %w", entity, err)
+		}
+		defer reader.Close()
+		readers[i] = reader
+	}
+
+	output, err := p.newOutput(ctx, outputFileType, outputCompression)
+	if err != nil {
+		return err
+	}
+
+	p.logger.Info("replaying entity changes",
+		zap.Int("entity_count", len(p.entities)),
+		zap.Uint64("start_block", p.startBlock),
+		zap.Uint64("stop_block", p.stopBlock),
+		zap.Bool("verify", p.verify),
+	)
+
+	var blockCount, poiCount uint64
+	for {
+		changes, blockNum, err := nextBlockChanges(ctx, readers)
+		if err != nil {
+			output.close(err)
+			return err
+		}
+		if changes == nil {
+			break
+		}
+		blockCount++
+
+		proofOfIndexing := poi.NewProofOfIndexing(blockNum, poi.VersionFast)
+		for _, change := range changes {
+			if err := proofOfIndexing.AddEntityChange(change.EntityChange); err != nil {
+				output.close(err)
+				return fmt.Errorf("@%d entity change POI: %w", blockNum, err)
+			}
+		}
+
+		digest, err := proofOfIndexing.Pause(p.lastPOI)
+		if err != nil {
+			output.close(err)
+			return fmt.Errorf("pause proof of indexing: %w", err)
+		}
+
+		if !bytes.Equal(digest, p.lastPOI) {
+			if err := output.write(ctx, blockNum, digest); err != nil {
+				output.close(err)
+				return err
+			}
+			p.lastPOI = digest
+			poiCount++
+		}
+	}
+
+	if err := output.close(nil); err != nil {
+		return err
+	}
+
+	p.logger.Info("replay completed",
+		zap.Uint64("block_count", blockCount),
+		zap.Uint64("poi_count", poiCount),
+		zap.String("last_poi", hex.EncodeToString(p.lastPOI)),
+	)
+	return nil
+}
+
+// nextBlockChanges returns all the entity changes of the lowest block found across
+// readers, ordered as they were received by `run`, nil when all readers are exhausted.
+func nextBlockChanges(ctx context.Context, readers []*bundleReader) (out []*graphload.EntityChangeAtBlockNum, blockNum uint64, err error) {
+	found := false
+	for _, reader := range readers {
+		change, err := reader.Peek(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		if change != nil && (!found || change.BlockNum < blockNum) {
+			blockNum = change.BlockNum
+			found = true
+		}
+	}
+
+	if !found {
+		return nil, 0, nil
+	}
+
+	for _, reader := range readers {
+		for {
+			change, err := reader.Peek(ctx)
+			if err != nil {
+				return nil, 0, err
+			}
+			if change == nil || change.BlockNum != blockNum {
+				break
+			}
+
+			out = append(out, change)
+			reader.Pop()
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Index < out[j].Index })
+	for i := 1; i < len(out); i++ {
+		if out[i].Index == out[i-1].Index {
+			return nil, 0, fmt.Errorf("@%d duplicate entity change index %d, bundles were likely written by a version of 'run' not recording it", blockNum, out[i].Index)
+		}
+	}
+
+	return out, blockNum, nil
+}
+
+type poiOutput interface {
+	write(ctx context.Context, blockNum uint64, digest []byte) error
+	close(err error) error
+}
+
+func (p *Processor) newOutput(ctx context.Context, outputFileType writer.FileType, outputCompression compression.Type) (poiOutput, error) {
+	if p.verify {
+		poiStore, fileType, _, err := bundler.DetectEntityStore(ctx, p.srcFolder, schema.PoiEntityName)
+		if err != nil {
+			return nil, err
+		}
+
+		reader, err := newBundleReader(ctx, poiStore, fileType, p.startBlock, p.stopBlock)
+		if err != nil {
+			return nil, fmt.Errorf("entity %q: %w", schema.PoiEntityName, err)
+		}
+		return &poiVerifier{reader: reader}, nil
+	}
+
+	baseStore, err := compression.NewStore(p.srcFolder, string(outputFileType), outputCompression, true)
+	if err != nil {
+		return nil, err
+	}
+
+	poiStore, err := baseStore.SubStore(schema.PoiEntityName)
+	if err != nil {
+		return nil, err
+	}
+
+	boundaryWriter := writer.NewBufferedIO(
+		p.bufferSize,
+		filepath.Join(p.workingDir, schema.PoiEntityName),
+		outputFileType,
+		p.logger.With(zap.String("entity_name", schema.PoiEntityName)),
+	)
+
+	poiBundler, err := bundler.New(p.bundleSize, p.stopBlock, boundaryWriter, poiStore, p.logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := poiBundler.Start(p.startBlock); err != nil {
+		return nil, err
+	}
+	poiBundler.Launch(context.Background())
+
+	return &poiWriter{bundler: poiBundler, chainID: p.chainID, stopBlock: p.stopBlock}, nil
+}
+
+type poiWriter struct {
+	bundler   *bundler.Bundler
+	chainID   string
+	stopBlock uint64
+}
+
+func (w *poiWriter) write(ctx context.Context, blockNum uint64, digest []byte) error {
+	if err := w.bundler.Roll(ctx, blockNum); err != nil {
+		return fmt.Errorf("roll bundler: %w", err)
+	}
+
+	return w.bundler.WriteEntityChange(poi.NewDigestEntityChange(digest, w.chainID, blockNum))
+}
+
+func (w *poiWriter) close(err error) error {
+	if err == nil {
+		if rollErr := w.bundler.Roll(context.Background(), w.stopBlock); rollErr != nil && !errors.Is(rollErr, bundler.ErrStopBlockReached) {
+			err = fmt.Errorf("roll bundler: %w", rollErr)
+		}
+	}
+
+	w.bundler.Shutdown(err)
+	<-w.bundler.Terminated()
+	return err
+}
+
+type poiVerifier struct {
+	reader *bundleReader
+}
+
+func (v *poiVerifier) write(ctx context.Context, blockNum uint64, digest []byte) error {
+	existing, err := v.reader.Peek(ctx)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf("POI mismatch at block %d: expected %x, found no entry", blockNum, digest)
+	}
+	v.reader.Pop()
+
+	existingDigest, err := digestFromEntityChange(existing)
+	if err != nil {
+		return fmt.Errorf("@%d: %w", existing.BlockNum, err)
+	}
+
+	if existing.BlockNum != blockNum {
+		return fmt.Errorf("POI mismatch at block %d: expected %x, found entry at block %d instead", blockNum, digest, existing.BlockNum)
+	}
+
+	if !bytes.Equal(existingDigest, digest) {
+		return fmt.Errorf("POI mismatch at block %d: expected %x, found %x", blockNum, digest, existingDigest)
+	}
+
+	return nil
+}
+
+func (v *poiVerifier) close(err error) error {
+	defer v.reader.Close()
+	if err != nil {
+		return err
+	}
+
+	existing, err := v.reader.Peek(context.Background())
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("POI mismatch at block %d: found an entry that was not recomputed", existing.BlockNum)
+	}
+
+	return nil
+}
+
+func digestFromEntityChange(change *graphload.EntityChangeAtBlockNum) ([]byte, error) {
+	if change.EntityChange != nil {
+		for _, f := range change.EntityChange.Fields {
+			if f.Name == "digest" {
+				return base64.StdEncoding.DecodeString(f.NewValue.GetBytes())
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no digest field in %s entity change", schema.PoiEntityName)
+}
@@ -0,0 +1,118 @@
+package poiprocessor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/streamingfast/dstore"
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/poi"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/substreams/sink/entity/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessor_ReplayMatchesRun(t *testing.T) {
+	ctx := context.Background()
+	srcFolder := t.TempDir()
+	baseStore, err := dstore.NewJSONLStore(srcFolder)
+	require.NoError(t, err)
+
+	change := func(entity, id string, op pbentity.EntityChange_Operation, value string) *pbentity.EntityChange {
+		out := &pbentity.EntityChange{Entity: entity, Id: id, Operation: op}
+		if value != "" {
+			out.Fields = []*pbentity.Field{{Name: "name", NewValue: &pbentity.Value{Typed: &pbentity.Value_String_{String_: value}}}}
+		}
+		return out
+	}
+
+	// Interleaved changes across entities within blocks, as received by `run`
+	blocks := map[uint64][]*pbentity.EntityChange{
+		3:  {change("Pool", "a", pbentity.EntityChange_OPERATION_CREATE, "a1"), change("Token", "t", pbentity.EntityChange_OPERATION_CREATE, "t1"), change("Pool", "b", pbentity.EntityChange_OPERATION_CREATE, "b1")},
+		7:  {change("Token", "t", pbentity.EntityChange_OPERATION_UPDATE, "t2"), change("Pool", "a", pbentity.EntityChange_OPERATION_UPDATE, "a2")},
+		15: {change("Pool", "b", pbentity.EntityChange_OPERATION_DELETE, "")},
+		26: {change("Token", "u", pbentity.EntityChange_OPERATION_CREATE, "u1"), change("Pool", "c", pbentity.EntityChange_OPERATION_CREATE, "c1")},
+	}
+	blockNums := []uint64{3, 7, 15, 26}
+
+	bundles := map[string]map[string]*bytes.Buffer{}
+	bundleOf := func(entity string, blockNum uint64) *bytes.Buffer {
+		if bundles[entity] == nil {
+			bundles[entity] = map[string]*bytes.Buffer{}
+			for start := uint64(0); start < 30; start += 10 {
+				bundles[entity][fmt.Sprintf("%010d-%010d", start, start+9)] = bytes.NewBuffer(nil)
+			}
+		}
+		start := blockNum - blockNum%10
+		return bundles[entity][fmt.Sprintf("%010d-%010d", start, start+9)]
+	}
+	bundleOf("pool", 0)
+	bundleOf("token", 0)
+	bundleOf(schema.PoiEntityName, 0)
+
+	var lastPOI []byte
+	for _, blockNum := range blockNums {
+		proofOfIndexing := poi.NewProofOfIndexing(blockNum, poi.VersionFast)
+		for i, ch := range blocks[blockNum] {
+			line, err := bundler.JSONLEncodeAny(&graphload.EntityChangeAtBlockNum{EntityChange: ch, BlockNum: blockNum, Index: uint64(i)})
+			require.NoError(t, err)
+			bundleOf(schema.NormalizeField(ch.Entity), blockNum).Write(line)
+			require.NoError(t, proofOfIndexing.AddEntityChange(ch))
+		}
+
+		digest, err := proofOfIndexing.Pause(lastPOI)
+		require.NoError(t, err)
+		line, err := bundler.JSONLEncodeAny(poi.NewDigestEntityChange(digest, "ethereum/mainnet", blockNum))
+		require.NoError(t, err)
+		bundleOf(schema.PoiEntityName, blockNum).Write(line)
+		lastPOI = digest
+	}
+
+	// The expected poi2$ bundles are kept in memory, the processor writes them
+	for _, entity := range []string{"pool", "token"} {
+		store, err := baseStore.SubStore(entity)
+		require.NoError(t, err)
+		for filename, content := range bundles[entity] {
+			require.NoError(t, store.WriteObject(ctx, filename, bytes.NewReader(content.Bytes())))
+		}
+	}
+
+	newProcessor := func(verify bool) *Processor {
+		p, err := New(srcFolder, t.TempDir(), []string{"pool", "token"}, 0, 30, 10, 0, "ethereum/mainnet", nil, verify, zlog, tracer)
+		require.NoError(t, err)
+		return p
+	}
+
+	require.NoError(t, newProcessor(false).run(ctx))
+
+	poiStore, err := baseStore.SubStore(schema.PoiEntityName)
+	require.NoError(t, err)
+	for filename, content := range bundles[schema.PoiEntityName] {
+		assert.Equal(t, content.String(), readObject(t, poiStore, filename), "bundle %s", filename)
+	}
+
+	require.NoError(t, newProcessor(true).run(ctx))
+
+	// Corrupt the last POI entry, verification must catch it
+	tampered := bytes.Replace(bundles[schema.PoiEntityName]["0000000020-0000000029"].Bytes(), []byte(`"block_num":26`), []byte(`"block_num":27`), 1)
+	require.NoError(t, poiStore.WriteObject(ctx, "0000000020-0000000029", bytes.NewReader(tampered)))
+
+	err = newProcessor(true).run(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "POI mismatch at block 26")
+}
+
+func readObject(t *testing.T, store dstore.Store, filename string) string {
+	reader, err := store.OpenObject(context.Background(), filename)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(content)
+}
@@ -0,0 +1,157 @@
+package poiprocessor
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/streamingfast/dstore"
+	graphload "github.com/streamingfast/substreams-graph-load"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+)
+
+// bundleReader streams, in order, the entity changes of contiguous bundles
+// covering [startBlock, stopBlock).
+type bundleReader struct {
+	store      dstore.Store
+	fileType   writer.FileType
+	filenames  []string
+	startBlock uint64
+	stopBlock  uint64
+
+	current io.ReadCloser
+	decoder bundler.Decoder
+	next    *graphload.EntityChangeAtBlockNum
+	done    bool
+}
+
+func newBundleReader(ctx context.Context, store dstore.Store, fileType writer.FileType, startBlock, stopBlock uint64) (*bundleReader, error) {
+	var filenames []string
+	var endRange uint64
+	err := store.Walk(ctx, "", func(filename string) error {
+		startBlockNum, endBlockNum, err := bundler.BlockRangeFromFilename(filename)
+		if err != nil {
+			return fmt.Errorf("fail reading block range in %q: %w", filename, err)
+		}
+
+		if startBlockNum >= stopBlock {
+			return dstore.StopIteration
+		}
+
+		if endBlockNum < startBlock {
+			return nil
+		}
+
+		if len(filenames) == 0 {
+			if startBlockNum > startBlock {
+				return fmt.Errorf("first bundle %q starts after start block %d", filename, startBlock)
+			}
+		} else if startBlockNum != endRange+1 {
+			return fmt.Errorf("broken file contiguity at %q (previous range end was %d)", filename, endRange)
+		}
+
+		endRange = endBlockNum
+		filenames = append(filenames, filename)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to walk files: %w", err)
+	}
+
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no bundle found in %q", store.BaseURL())
+	}
+
+	if endRange+1 < stopBlock {
+		return nil, fmt.Errorf("bundles do not cover the full range (%q -> %d), stop block: %d", filenames[0], endRange+1, stopBlock)
+	}
+
+	return &bundleReader{
+		store:      store,
+		fileType:   fileType,
+		filenames:  filenames,
+		startBlock: startBlock,
+		stopBlock:  stopBlock,
+	}, nil
+}
+
+func firstBundleStartBlock(ctx context.Context, store dstore.Store) (uint64, error) {
+	filenames, err := store.ListFiles(ctx, "", 1)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(filenames) == 0 {
+		return 0, fmt.Errorf("no bundle found in %q", store.BaseURL())
+	}
+
+	startBlock, _, err := bundler.BlockRangeFromFilename(filenames[0])
+	return startBlock, err
+}
+
+// Peek returns the next entity change without consuming it, nil once all
+// changes before the stop block have been read.
+func (r *bundleReader) Peek(ctx context.Context) (*graphload.EntityChangeAtBlockNum, error) {
+	for r.next == nil && !r.done {
+		if r.decoder == nil {
+			if len(r.filenames) == 0 {
+				r.done = true
+				break
+			}
+
+			reader, err := r.store.OpenObject(ctx, r.filenames[0])
+			if err != nil {
+				return nil, fmt.Errorf("unable to open file %q: %w", r.filenames[0], err)
+			}
+			r.current = reader
+			r.decoder, err = bundler.NewDecoder(reader, r.fileType)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		change, err := r.decoder.Decode()
+		if err != nil {
+			if err == io.EOF {
+				r.closeCurrent()
+				continue
+			}
+			return nil, fmt.Errorf("reading %q: %w", r.filenames[0], err)
+		}
+
+		if change.BlockNum < r.startBlock {
+			continue
+		}
+
+		if change.BlockNum >= r.stopBlock {
+			r.closeCurrent()
+			r.done = true
+			break
+		}
+
+		r.next = change
+	}
+
+	return r.next, nil
+}
+
+// Pop consumes the entity change last returned by Peek.
+func (r *bundleReader) Pop() {
+	r.next = nil
+}
+
+func (r *bundleReader) closeCurrent() {
+	if r.current != nil {
+		r.current.Close()
+	}
+	r.current = nil
+	r.decoder = nil
+	r.filenames = r.filenames[1:]
+}
+
+func (r *bundleReader) Close() {
+	if r.current != nil {
+		r.current.Close()
+	}
+}
@@ -0,0 +1,137 @@
+package postgres
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// withPassword returns the DSN with a password when it has none, read from
+// passwordFile when set, or else from the pgpass file, 'PGPASSFILE' or '~/.pgpass', as
+// libpq does. The DSN is returned as is if neither has one.
+func (c *DSN) withPassword(passwordFile string, getenv func(string) string) (*DSN, error) {
+	if c.password != "" {
+		return c, nil
+	}
+
+	if passwordFile != "" {
+		content, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading password file: %w", err)
+		}
+		password := strings.TrimRight(string(content), "\r\n")
+		if password == "" {
+			return nil, fmt.Errorf("password file %q is empty", passwordFile)
+		}
+
+		zlog.Debug("using password from password file", zap.String("path", passwordFile), zap.Stringer("dsn", c))
+		return c.setPassword(password), nil
+	}
+
+	pgpassFile := getenv("PGPASSFILE")
+	if pgpassFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return c, nil
+		}
+		pgpassFile = filepath.Join(home, ".pgpass")
+	}
+
+	password, err := readPgpass(pgpassFile, c)
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return c, nil
+	}
+
+	zlog.Debug("using password from pgpass file", zap.String("path", pgpassFile), zap.Stringer("dsn", c))
+	return c.setPassword(password), nil
+}
+
+func (c *DSN) setPassword(password string) *DSN {
+	out := *c
+	out.password = password
+	return &out
+}
+
+// readPgpass returns the password of the first entry of the pgpass file matching dsn,
+// blank if there are none or the file does not exist. As libpq, the file is ignored if
+// others can read it.
+func readPgpass(path string, dsn *DSN) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("reading pgpass file: %w", err)
+	}
+	if runtime.GOOS != "windows" && stat.Mode().Perm()&0077 != 0 {
+		zlog.Warn("ignoring pgpass file readable by group or others, it should be chmod 0600", zap.String("path", path))
+		return "", nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading pgpass file: %w", err)
+	}
+	return pgpassPassword(string(content), dsn), nil
+}
+
+// pgpassPassword returns the password of the first line of content, in the
+// 'hostname:port:database:username:password' format, matching dsn.
+func pgpassPassword(content string, dsn *DSN) string {
+	// A unix socket directory matches 'localhost'
+	host := dsn.host
+	if host == "" || dsn.Socket() {
+		host = "localhost"
+	}
+	expected := []string{host, strconv.FormatInt(dsn.port, 10), dsn.database, dsn.username}
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := splitPgpassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+
+		matches := true
+		for i, value := range expected {
+			if fields[i] != "*" && fields[i] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return fields[4]
+		}
+	}
+	return ""
+}
+
+// splitPgpassLine splits line on ':', '\:' and '\\' being a literal ':' and '\'.
+func splitPgpassLine(line string) (fields []string) {
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':' && len(fields) < 4:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
@@ -0,0 +1,439 @@
+package postgres
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// IndexDef is a 'CREATE INDEX' statement of a DDL file.
+type IndexDef struct {
+	Unique bool
+	// Name is the name of the index, derived from its definition when the statement
+	// lets Postgres name it, see generatedIndexName
+	Name string
+	// Schema is the schema of the table in the statement, blank if not qualified
+	Schema string
+	Table  string
+
+	only bool
+	// rest is everything following the table, like 'USING gist (id, block_range)'
+	rest []sqlToken
+}
+
+// ParseIndexDDL parses the 'CREATE INDEX' statements of content, separated by ';'.
+// Comments and blank statements are ignored and statements may span several lines.
+// Any statement other than 'CREATE INDEX' is an error.
+func ParseIndexDDL(content string) ([]*IndexDef, error) {
+	tokens, err := lexSQL(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*IndexDef
+	var statement []sqlToken
+	flush := func() error {
+		trimmed := trimSpaceTokens(statement)
+		statement = nil
+		if len(trimmed) == 0 {
+			return nil
+		}
+
+		def, err := parseCreateIndex(trimmed)
+		if err != nil {
+			return fmt.Errorf("statement %d %q: %w", len(out)+1, tokensString(trimmed), err)
+		}
+		out = append(out, def)
+		return nil
+	}
+
+	for _, token := range tokens {
+		switch {
+		case token.kind == sqlComment:
+			// Keeps the tokens on both sides apart, 'a/* */b' is 'a b'
+			statement = append(statement, sqlToken{kind: sqlSpace, text: " "})
+		case token.kind == sqlPunct && token.text == ";":
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		default:
+			statement = append(statement, token)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// SQL returns the statement creating the index on the table in pgSchema, whatever the
+// schema of the parsed statement. References to the parsed schema following the table
+// are rewritten as well. Indexes are created with 'IF NOT EXISTS', unnamed ones under
+// their generated name, so running the statements again is a no-op.
+func (d *IndexDef) SQL(pgSchema string, concurrently bool) string {
+	var sb strings.Builder
+	sb.WriteString("CREATE ")
+	if d.Unique {
+		sb.WriteString("UNIQUE ")
+	}
+	sb.WriteString("INDEX ")
+	if concurrently {
+		sb.WriteString("CONCURRENTLY ")
+	}
+	sb.WriteString("IF NOT EXISTS ")
+	sb.WriteString(QuoteIdentifier(d.Name))
+	sb.WriteString(" ON ")
+	if d.only {
+		sb.WriteString("ONLY ")
+	}
+	sb.WriteString(QuoteIdentifier(pgSchema, d.Table))
+	d.writeRest(&sb, QuoteIdentifier(pgSchema))
+
+	return sb.String()
+}
+
+// writeRest writes the tokens following the table, references to the parsed schema
+// being replaced by schemaRef.
+func (d *IndexDef) writeRest(sb *strings.Builder, schemaRef string) {
+	for i, token := range d.rest {
+		if d.Schema != "" && token.isIdentifier() && token.identifier() == d.Schema && nextNonSpace(d.rest, i+1).text == "." {
+			sb.WriteString(schemaRef)
+			continue
+		}
+		if token.kind == sqlSpace {
+			sb.WriteString(" ")
+			continue
+		}
+		sb.WriteString(token.text)
+	}
+}
+
+// generatedIndexName returns the name of an index created without one, the table
+// followed by a digest of the definition, independent of the schema, so the same
+// statement always creates the same index. It fits the 63 bytes of Postgres names.
+func (d *IndexDef) generatedIndexName() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "unique=%t only=%t table=%s ", d.Unique, d.only, d.Table)
+	d.writeRest(&sb, "$schema")
+	digest := sha256.Sum256([]byte(sb.String()))
+
+	table := d.Table
+	for len(table) > 50 {
+		_, size := utf8.DecodeLastRuneInString(table)
+		table = table[:len(table)-size]
+	}
+	return fmt.Sprintf("%s_%x_idx", table, digest[:4])
+}
+
+// Index is an index of a table, as listed by 'pg_indexes'.
+type Index struct {
+	Table string
+	Name  string
+	// Def is the 'CREATE INDEX' statement of the index
+	Def string
+	// Constraint is true when the index backs a constraint, like the primary key or
+	// the exclusion constraint on block_range, so it cannot be dropped on its own
+	Constraint bool
+}
+
+// ListIndexes returns the indexes of the tables of pgSchema, by table and name.
+func ListIndexes(ctx context.Context, conn Querier, pgSchema string) ([]*Index, error) {
+	rows, err := NewStatement("SELECT i.tablename, i.indexname, i.indexdef, EXISTS (").
+		SQL("SELECT 1 FROM pg_constraint c WHERE c.conindid = to_regclass(quote_ident(i.schemaname) || '.' || quote_ident(i.indexname))").
+		SQL(") FROM pg_indexes i WHERE i.schemaname = ").
+		Bind(pgSchema).
+		SQL(" ORDER BY i.tablename, i.indexname").
+		Query(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("listing indexes of %q: %w", pgSchema, err)
+	}
+	defer rows.Close()
+
+	var out []*Index
+	for rows.Next() {
+		index := &Index{}
+		if err := rows.Scan(&index.Table, &index.Name, &index.Def, &index.Constraint); err != nil {
+			return nil, fmt.Errorf("listing indexes of %q: %w", pgSchema, err)
+		}
+		out = append(out, index)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing indexes of %q: %w", pgSchema, err)
+	}
+	return out, nil
+}
+
+func parseCreateIndex(tokens []sqlToken) (*IndexDef, error) {
+	p := &tokenParser{tokens: tokens}
+	def := &IndexDef{}
+
+	if !p.keyword("CREATE") {
+		return nil, fmt.Errorf("not a CREATE INDEX statement")
+	}
+	def.Unique = p.keyword("UNIQUE")
+	if !p.keyword("INDEX") {
+		return nil, fmt.Errorf("not a CREATE INDEX statement")
+	}
+	p.keyword("CONCURRENTLY")
+	if p.keyword("IF") {
+		if !p.keyword("NOT") || !p.keyword("EXISTS") {
+			return nil, fmt.Errorf("expected IF NOT EXISTS")
+		}
+	}
+
+	if !p.keyword("ON") {
+		name, ok := p.identifier()
+		if !ok {
+			return nil, fmt.Errorf("expected index name or ON")
+		}
+		def.Name = name
+		if !p.keyword("ON") {
+			return nil, fmt.Errorf("expected ON after index name")
+		}
+	}
+	def.only = p.keyword("ONLY")
+
+	table, ok := p.identifier()
+	if !ok {
+		return nil, fmt.Errorf("expected table name after ON")
+	}
+	if p.punct(".") {
+		def.Schema = table
+		if table, ok = p.identifier(); !ok {
+			return nil, fmt.Errorf("expected table name after %q", def.Schema+".")
+		}
+	}
+	def.Table = table
+
+	def.rest = p.tokens[p.pos:]
+	if len(trimSpaceTokens(def.rest)) == 0 {
+		return nil, fmt.Errorf("expected index columns after table %q", def.Table)
+	}
+	if def.Name == "" {
+		def.Name = def.generatedIndexName()
+	}
+	return def, nil
+}
+
+type sqlTokenKind int
+
+const (
+	sqlWord sqlTokenKind = iota
+	sqlQuotedIdentifier
+	sqlString
+	sqlPunct
+	sqlSpace
+	sqlComment
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+}
+
+func (t sqlToken) isIdentifier() bool {
+	return t.kind == sqlWord || t.kind == sqlQuotedIdentifier
+}
+
+// identifier returns the name designated by the token, unquoted identifiers being
+// folded to lower case as Postgres does.
+func (t sqlToken) identifier() string {
+	if t.kind == sqlQuotedIdentifier {
+		return strings.ReplaceAll(t.text[1:len(t.text)-1], `""`, `"`)
+	}
+	return strings.ToLower(t.text)
+}
+
+// lexSQL splits in into tokens, enough to find statements, comments and identifiers.
+func lexSQL(in string) (out []sqlToken, err error) {
+	runes := []rune(in)
+	for i := 0; i < len(runes); {
+		start := i
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			for i < len(runes) && unicode.IsSpace(runes[i]) {
+				i++
+			}
+			out = append(out, sqlToken{sqlSpace, string(runes[start:i])})
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			out = append(out, sqlToken{sqlComment, string(runes[start:i])})
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			// Block comments nest in Postgres
+			depth := 0
+			for i < len(runes) {
+				if runes[i] == '/' && i+1 < len(runes) && runes[i+1] == '*' {
+					depth++
+					i += 2
+				} else if runes[i] == '*' && i+1 < len(runes) && runes[i+1] == '/' {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+			if depth != 0 {
+				return nil, fmt.Errorf("unterminated comment at offset %d", start)
+			}
+			out = append(out, sqlToken{sqlComment, string(runes[start:i])})
+		case r == '\'' || r == '"':
+			kind := sqlString
+			if r == '"' {
+				kind = sqlQuotedIdentifier
+			}
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated quote at offset %d", start)
+				}
+				if runes[i] == r {
+					// Quotes are escaped by doubling them
+					if i+1 < len(runes) && runes[i+1] == r {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+			out = append(out, sqlToken{kind, string(runes[start:i])})
+		case r == '$' && dollarQuoteTag(runes[i:]) != "":
+			// Dollar quoted strings, '$$...$$' or '$tag$...$tag$', as written by pg_dump
+			tag := []rune(dollarQuoteTag(runes[i:]))
+			i += len(tag)
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated dollar quote at offset %d", start)
+				}
+				if runes[i] == '$' && hasRunePrefix(runes[i:], tag) {
+					i += len(tag)
+					break
+				}
+				i++
+			}
+			out = append(out, sqlToken{sqlString, string(runes[start:i])})
+		case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			for i < len(runes) && (runes[i] == '_' || runes[i] == '$' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			out = append(out, sqlToken{sqlWord, string(runes[start:i])})
+		default:
+			i++
+			out = append(out, sqlToken{sqlPunct, string(r)})
+		}
+	}
+	return out, nil
+}
+
+// dollarQuoteTag returns the opening delimiter of the dollar quoted string starting
+// runes, like '$$' or '$tag$', blank if it does not start one, like the '$1' parameter.
+func dollarQuoteTag(runes []rune) string {
+	for i := 1; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '$':
+			return string(runes[:i+1])
+		case r == '_' || unicode.IsLetter(r) || (i > 1 && unicode.IsDigit(r)):
+			continue
+		}
+		return ""
+	}
+	return ""
+}
+
+func hasRunePrefix(runes, prefix []rune) bool {
+	if len(runes) < len(prefix) {
+		return false
+	}
+	for i, r := range prefix {
+		if runes[i] != r {
+			return false
+		}
+	}
+	return true
+}
+
+type tokenParser struct {
+	tokens []sqlToken
+	pos    int
+}
+
+// next returns the position of the next token which is not a space, without
+// consuming anything so a failed match leaves the parser where it was.
+func (p *tokenParser) next() int {
+	pos := p.pos
+	for pos < len(p.tokens) && p.tokens[pos].kind == sqlSpace {
+		pos++
+	}
+	return pos
+}
+
+func (p *tokenParser) keyword(keyword string) bool {
+	pos := p.next()
+	if pos < len(p.tokens) && p.tokens[pos].kind == sqlWord && strings.EqualFold(p.tokens[pos].text, keyword) {
+		p.pos = pos + 1
+		return true
+	}
+	return false
+}
+
+func (p *tokenParser) punct(punct string) bool {
+	pos := p.next()
+	if pos < len(p.tokens) && p.tokens[pos].kind == sqlPunct && p.tokens[pos].text == punct {
+		p.pos = pos + 1
+		return true
+	}
+	return false
+}
+
+func (p *tokenParser) identifier() (string, bool) {
+	pos := p.next()
+	if pos < len(p.tokens) && p.tokens[pos].isIdentifier() {
+		p.pos = pos + 1
+		return p.tokens[pos].identifier(), true
+	}
+	return "", false
+}
+
+func nextNonSpace(tokens []sqlToken, from int) sqlToken {
+	for i := from; i < len(tokens); i++ {
+		if tokens[i].kind != sqlSpace {
+			return tokens[i]
+		}
+	}
+	return sqlToken{}
+}
+
+func trimSpaceTokens(tokens []sqlToken) []sqlToken {
+	for len(tokens) > 0 && tokens[0].kind == sqlSpace {
+		tokens = tokens[1:]
+	}
+	for len(tokens) > 0 && tokens[len(tokens)-1].kind == sqlSpace {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+func tokensString(tokens []sqlToken) string {
+	var sb strings.Builder
+	for _, token := range tokens {
+		if token.kind == sqlSpace {
+			sb.WriteString(" ")
+			continue
+		}
+		sb.WriteString(token.text)
+	}
+	return sb.String()
+}
@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIndexDDL(t *testing.T) {
+	content := `
+-- pool.ddl, extracted from sgd34
+create index pool_id_block_range_excl on "sgd34"."pool" using gist (id, block_range);
+
+/* spans several lines, /* nested */ comment */
+CREATE INDEX brin_pool
+  ON sgd34.pool
+  USING brin(lower(block_range), coalesce(upper(block_range), 2147483647), vid);
+
+create unique index if not exists "Order_Name" on sgd34."order" (name) where name <> 'a;b -- c';
+create index on token using btree ("symbol") where kind = sgd34.token_kind('x');
+create index "attr_expr" on sgd34.pool (coalesce(name, $$it's; a -- name$$), $tag$a$$b;$tag$);
+`
+
+	defs, err := ParseIndexDDL(content)
+	require.NoError(t, err)
+	require.Len(t, defs, 5)
+
+	assert.Equal(t, "pool_id_block_range_excl", defs[0].Name)
+	assert.Equal(t, "sgd34", defs[0].Schema)
+	assert.Equal(t, "pool", defs[0].Table)
+	assert.Equal(t, `CREATE INDEX IF NOT EXISTS "pool_id_block_range_excl" ON "sgd7"."pool" using gist (id, block_range)`, defs[0].SQL("sgd7", false))
+
+	assert.Equal(t, `CREATE INDEX CONCURRENTLY IF NOT EXISTS "brin_pool" ON "sgd7"."pool" USING brin(lower(block_range), coalesce(upper(block_range), 2147483647), vid)`, defs[1].SQL("sgd7", true))
+
+	assert.True(t, defs[2].Unique)
+	assert.Equal(t, "Order_Name", defs[2].Name)
+	assert.Equal(t, "order", defs[2].Table)
+	assert.Equal(t, `CREATE UNIQUE INDEX IF NOT EXISTS "Order_Name" ON "sgd7"."order" (name) where name <> 'a;b -- c'`, defs[2].SQL("sgd7", false))
+
+	assert.Equal(t, "token_a9916b6c_idx", defs[3].Name)
+	assert.Equal(t, "", defs[3].Schema)
+	assert.Equal(t, `CREATE INDEX IF NOT EXISTS "token_a9916b6c_idx" ON "sgd7"."token" using btree ("symbol") where kind = sgd34.token_kind('x')`, defs[3].SQL("sgd7", false))
+
+	// Dollar quoted strings hold ';' and quotes as is
+	assert.Equal(t, "attr_expr", defs[4].Name)
+	assert.Equal(t, `CREATE INDEX IF NOT EXISTS "attr_expr" ON "sgd7"."pool" (coalesce(name, $$it's; a -- name$$), $tag$a$$b;$tag$)`, defs[4].SQL("sgd7", false))
+}
+
+func TestParseIndexDDL_GeneratedNames(t *testing.T) {
+	defs, err := ParseIndexDDL(`
+create index on sgd34.pool (lower(block_range));
+CREATE INDEX ON sgd12.pool (lower(block_range));
+create index on sgd34.pool (upper(block_range));
+create unique index on sgd34.pool (lower(block_range));
+create index on sgd34.a_table_whose_name_is_already_longer_than_the_sixty_three_bytes_of_postgres (id);
+`)
+	require.NoError(t, err)
+	require.Len(t, defs, 5)
+
+	// The name does not depend on the schema
+	assert.Equal(t, defs[0].Name, defs[1].Name)
+	assert.NotEqual(t, defs[0].Name, defs[2].Name)
+	assert.NotEqual(t, defs[0].Name, defs[3].Name)
+	assert.Regexp(t, `^pool_[0-9a-f]{8}_idx$`, defs[0].Name)
+
+	assert.LessOrEqual(t, len(defs[4].Name), 63)
+	assert.Regexp(t, `^a_table_whose_name_is_already_longer_than_the_sixt_[0-9a-f]{8}_idx$`, defs[4].Name)
+}
+
+func TestParseIndexDDL_RewritesSchemaReferences(t *testing.T) {
+	defs, err := ParseIndexDDL(`create index attr_0_kind on sgd34.token (kind) where kind <> 'sgd34.x'::sgd34.token_kind`)
+	require.NoError(t, err)
+	require.Len(t, defs, 1)
+
+	assert.Equal(t, `CREATE INDEX IF NOT EXISTS "attr_0_kind" ON "sgd7"."token" (kind) where kind <> 'sgd34.x'::"sgd7".token_kind`, defs[0].SQL("sgd7", false))
+}
+
+func TestParseIndexDDL_Invalid(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		expectedError string
+	}{
+		{"not an index", "create index a on sgd1.pool (id);\ndrop table sgd1.pool;", `statement 2 "drop table sgd1.pool": not a CREATE INDEX statement`},
+		{"no columns", "create index a on sgd1.pool", `statement 1 "create index a on sgd1.pool": expected index columns after table "pool"`},
+		{"unterminated quote", "create index a on sgd1.pool (id) where name = 'a", "unterminated quote at offset 46"},
+		{"unterminated dollar quote", "create index a on sgd1.pool (id) where name = $x$a$$", "unterminated dollar quote at offset 46"},
+		{"unterminated comment", "/* create index a on sgd1.pool (id)", "unterminated comment at offset 0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseIndexDDL(test.content)
+			assert.EqualError(t, err, test.expectedError)
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Deployment is a graph-node deployment, resolved from a '<deployment>' argument, with
+// a connection pool on the database of its shard.
+type Deployment struct {
+	// Hash is the deployment hash, 'Qm...'
+	Hash string
+	// ID is the id of the deployment in 'public.deployment_schemas'
+	ID int64
+	// Schema is the Postgres schema holding the tables of the deployment, 'sgdN'
+	Schema string
+	Shard  string
+	// GraphNodeVersion is the version of graph-node which created the deployment, blank
+	// when the database does not record it
+	GraphNodeVersion string
+
+	// Pool is a pool on the database of the deployment's shard, holding its tables and
+	// head block
+	Pool *pgxpool.Pool
+
+	// primary is a pool on the primary, holding the deployments' schemas and
+	// assignments, Pool when the deployment is on the primary and a single connection
+	// pool otherwise
+	primary *pgxpool.Pool
+}
+
+type deploymentRefKind int
+
+const (
+	deploymentRefHash deploymentRefKind = iota
+	deploymentRefSchema
+	deploymentRefSubgraphName
+)
+
+var deploymentSchemaRegex = regexp.MustCompile(`^sgd[0-9]+$`)
+
+func parseDeploymentRef(ref string) (deploymentRefKind, error) {
+	switch {
+	case ref == "":
+		return 0, fmt.Errorf("deployment is empty, should be a deployment hash (Qm...), a schema (sgdN) or a subgraph name")
+	case strings.HasPrefix(ref, "Qm"):
+		return deploymentRefHash, nil
+	case deploymentSchemaRegex.MatchString(ref):
+		return deploymentRefSchema, nil
+	}
+	return deploymentRefSubgraphName, nil
+}
+
+// OpenDeployment resolves ref, a deployment hash, a schema like 'sgd42' or the name of a
+// subgraph whose current version is the deployment, from dsnOrConfig, a '<psql-dsn>'
+// argument which is either a DSN or the path of a graph-node 'config.toml'. The
+// deployment is looked up on the primary, then a pool of at most maxConns connections is
+// opened on its shard, the pool on the primary being reopened with a single connection
+// when the shard is another database. The password of DSNs without one is read from
+// passwordFile when set, or else from the pgpass file. The deployment must be closed
+// once done.
+func OpenDeployment(ctx context.Context, dsnOrConfig string, ref string, maxConns int, passwordFile string) (*Deployment, error) {
+	kind, err := parseDeploymentRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var config *GraphNodeConfig
+	var primaryDSN *DSN
+	if IsGraphNodeConfig(dsnOrConfig) {
+		if config, err = LoadGraphNodeConfig(dsnOrConfig); err != nil {
+			return nil, err
+		}
+		primaryDSN = config.Primary()
+	} else if primaryDSN, err = ParseDSN(dsnOrConfig); err != nil {
+		return nil, fmt.Errorf("invalid postgres DSN %q: %w", RedactDSN(dsnOrConfig), err)
+	}
+
+	primary, err := connectPool(ctx, primaryDSN, maxConns, passwordFile)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to primary: %w", err)
+	}
+
+	d := &Deployment{Pool: primary, primary: primary}
+	if err := d.lookup(ctx, kind, ref); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	// Without a graph-node config, the DSN is the database of every shard
+	if config != nil && d.Shard != PrimaryShard {
+		shardDSN, err := config.Shard(d.Shard)
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("deployment %q: %w", ref, err)
+		}
+		if d.Pool, err = connectPool(ctx, shardDSN, maxConns, passwordFile); err != nil {
+			d.Pool = primary
+			d.Close()
+			return nil, fmt.Errorf("connecting to shard %q: %w", d.Shard, err)
+		}
+
+		// Writes go to the shard, the primary only serves a few metadata queries and
+		// must not double the connections held
+		primary.Close()
+		if d.primary, err = connectPool(ctx, primaryDSN, 1, passwordFile); err != nil {
+			d.Pool.Close()
+			return nil, fmt.Errorf("connecting to primary: %w", err)
+		}
+	}
+
+	if d.GraphNodeVersion, err = readGraphNodeVersion(ctx, d.Pool, d.ID); err != nil {
+		zlog.Warn("unable to read the graph-node version of the deployment", zap.String("schema", d.Schema), zap.Error(err))
+	}
+
+	zlog.Info("resolved deployment",
+		zap.String("deployment", ref),
+		zap.String("hash", d.Hash),
+		zap.Int64("id", d.ID),
+		zap.String("schema", d.Schema),
+		zap.String("shard", d.Shard),
+		zap.String("graph_node_version", d.GraphNodeVersion),
+	)
+	return d, nil
+}
+
+func connectPool(ctx context.Context, dsn *DSN, maxConns int, passwordFile string) (*pgxpool.Pool, error) {
+	dsn, err := dsn.withPassword(passwordFile, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.Debug("connecting to postgres", zap.Stringer("dsn", dsn))
+	poolConfig, err := pgxpool.ParseConfig(dsn.DSN())
+	if err != nil {
+		// The error of pgx may hold the DSN, password included
+		return nil, fmt.Errorf("invalid DSN %q", dsn)
+	}
+	poolConfig.MaxConns = int32(maxConns)
+
+	return pgxpool.ConnectConfig(ctx, poolConfig)
+}
+
+// Primary returns a pool on the primary, holding the deployments' schemas and
+// assignments.
+func (d *Deployment) Primary() *pgxpool.Pool {
+	return d.primary
+}
+
+// Sharded returns true if the deployment is not on the primary.
+func (d *Deployment) Sharded() bool {
+	return d.Pool != d.primary
+}
+
+// Close closes the pools of the deployment.
+func (d *Deployment) Close() {
+	if d.Pool != d.primary {
+		d.Pool.Close()
+	}
+	d.primary.Close()
+}
+
+func (d *Deployment) lookup(ctx context.Context, kind deploymentRefKind, ref string) error {
+	query := `SELECT ds.id, ds.subgraph, ds.name, ds.shard FROM public.deployment_schemas ds WHERE ds.subgraph = $1`
+	switch kind {
+	case deploymentRefSchema:
+		query = `SELECT ds.id, ds.subgraph, ds.name, ds.shard FROM public.deployment_schemas ds WHERE ds.name = $1`
+	case deploymentRefSubgraphName:
+		query = `
+			SELECT ds.id, ds.subgraph, ds.name, ds.shard
+			FROM subgraphs.subgraph s
+			JOIN subgraphs.subgraph_version v ON v.id = s.current_version
+			JOIN public.deployment_schemas ds ON ds.subgraph = v.deployment
+			WHERE s.name = $1`
+	}
+
+	rows, err := d.primary.Query(ctx, query, ref)
+	if err != nil {
+		return fmt.Errorf("looking up deployment %q: %w", ref, err)
+	}
+	defer rows.Close()
+
+	var found []Deployment
+	for rows.Next() {
+		var candidate Deployment
+		if err := rows.Scan(&candidate.ID, &candidate.Hash, &candidate.Schema, &candidate.Shard); err != nil {
+			return fmt.Errorf("looking up deployment %q: %w", ref, err)
+		}
+		found = append(found, candidate)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("looking up deployment %q: %w", ref, err)
+	}
+
+	switch len(found) {
+	case 0:
+		if kind == deploymentRefSubgraphName {
+			return fmt.Errorf("deployment %q not found: no subgraph with this name and a current version, nor a deployment hash (Qm...) or a schema (sgdN)", ref)
+		}
+		return fmt.Errorf("deployment %q not found in public.deployment_schemas", ref)
+	case 1:
+		d.ID, d.Hash, d.Schema, d.Shard = found[0].ID, found[0].Hash, found[0].Schema, found[0].Shard
+		return nil
+	}
+
+	// Copies of a deployment to other shards share its hash
+	copies := make([]string, len(found))
+	for i, candidate := range found {
+		copies[i] = fmt.Sprintf("%s in shard %s", candidate.Schema, candidate.Shard)
+	}
+	return fmt.Errorf("deployment %q has %d copies (%s), use the schema of the one to use instead", ref, len(found), strings.Join(copies, ", "))
+}
+
+// readGraphNodeVersion returns the version of graph-node which created the deployment,
+// from 'subgraphs.graph_node_versions'. The table referencing it changed across
+// releases, so it is looked up by its 'graph_node_version_id' column.
+func readGraphNodeVersion(ctx context.Context, conn Querier, deploymentID int64) (string, error) {
+	var table string
+	err := conn.QueryRow(ctx, `
+		SELECT c.table_name FROM information_schema.columns c
+		WHERE c.table_schema = 'subgraphs' AND c.column_name = 'graph_node_version_id'
+		AND EXISTS (SELECT 1 FROM information_schema.tables t WHERE t.table_schema = 'subgraphs' AND t.table_name = 'graph_node_versions')
+		ORDER BY c.table_name
+		LIMIT 1`,
+	).Scan(&table)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	var crateVersion, commitHash string
+	err = NewStatement("SELECT v.crate_version, v.git_commit_hash FROM ").
+		Ident("subgraphs", table).
+		SQL(" m JOIN subgraphs.graph_node_versions v ON v.id = m.graph_node_version_id WHERE m.id = ").
+		Bind(deploymentID).
+		QueryRow(ctx, conn).
+		Scan(&crateVersion, &commitHash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return formatGraphNodeVersion(crateVersion, commitHash), nil
+}
+
+func formatGraphNodeVersion(crateVersion, commitHash string) string {
+	if len(commitHash) > 7 {
+		commitHash = commitHash[:7]
+	}
+	if commitHash == "" {
+		return crateVersion
+	}
+	return fmt.Sprintf("%s (%s)", crateVersion, commitHash)
+}
@@ -0,0 +1,37 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeploymentRef(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected deploymentRefKind
+	}{
+		{"QmABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqr", deploymentRefHash},
+		{"sgd42", deploymentRefSchema},
+		{"sgd", deploymentRefSubgraphName},
+		{"sgd42a", deploymentRefSubgraphName},
+		{"uniswap/uniswap-v3", deploymentRefSubgraphName},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			kind, err := parseDeploymentRef(test.ref)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, kind)
+		})
+	}
+
+	_, err := parseDeploymentRef("")
+	assert.Error(t, err)
+}
+
+func TestFormatGraphNodeVersion(t *testing.T) {
+	assert.Equal(t, "0.35.1 (a1b2c3d)", formatGraphNodeVersion("0.35.1", "a1b2c3d4e5f6"))
+	assert.Equal(t, "0.35.1", formatGraphNodeVersion("0.35.1", ""))
+}
@@ -1,16 +1,23 @@
 package postgres
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/drone/envsubst"
 )
 
+// ParseDSN parses a 'postgresql://' or 'postgres://' URL, or a libpq 'key=value' DSN
+// like 'host=/var/run/postgresql dbname=graph'. Environment variables like
+// '${PGPASSWORD}' are expanded first. The host may be a unix socket directory, given as
+// the 'host' parameter of URLs or percent-encoded as their host.
 func ParseDSN(dsn string) (*DSN, error) {
 	return parseDSN(dsn, os.Getenv)
 }
@@ -21,60 +28,274 @@ func parseDSN(dsn string, mapper func(s string) string) (*DSN, error) {
 		return nil, fmt.Errorf("variables expansion failed: %w", err)
 	}
 
-	dsnURL, err := url.Parse(expanded)
+	var settings map[string]string
+	if strings.HasPrefix(expanded, "postgresql://") || strings.HasPrefix(expanded, "postgres://") {
+		settings, err = parseURLSettings(expanded)
+	} else if strings.Contains(expanded, "=") {
+		settings, err = parseKeywordValueSettings(expanded)
+	} else {
+		return nil, fmt.Errorf(`invalid DSN, should be a "postgresql://" URL or "key=value" pairs`)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("invalid url: %w", err)
+		return nil, err
+	}
+
+	return newDSN(settings)
+}
+
+// DSN are the connection settings of a Postgres database.
+type DSN struct {
+	host     string
+	port     int64
+	database string
+	username string
+	password string
+	// options are the other settings, like 'sslmode=disable', sorted by key
+	options [][2]string
+}
+
+func newDSN(settings map[string]string) (*DSN, error) {
+	dsn := &DSN{port: 5432}
+
+	for key, value := range settings {
+		switch key {
+		case "host":
+			dsn.host = value
+		case "port":
+			port, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q", value)
+			}
+			dsn.port = port
+		case "dbname":
+			dsn.database = value
+		case "user":
+			dsn.username = value
+		case "password":
+			dsn.password = value
+		default:
+			dsn.options = append(dsn.options, [2]string{key, value})
+		}
 	}
+	sort.Slice(dsn.options, func(i, j int) bool { return dsn.options[i][0] < dsn.options[j][0] })
 
-	if dsnURL.Scheme != "postgresql" {
-		return nil, fmt.Errorf(`invalid scheme %q, should be "postgresql"`, dsnURL.Scheme)
+	if err := dsn.validateTLS(settings); err != nil {
+		return nil, err
 	}
+	return dsn, nil
+}
 
-	host := dsnURL.Hostname()
+var sslModes = map[string]bool{"disable": true, "allow": true, "prefer": true, "require": true, "verify-ca": true, "verify-full": true}
+
+func (c *DSN) validateTLS(settings map[string]string) error {
+	if mode, found := settings["sslmode"]; found && !sslModes[mode] {
+		return fmt.Errorf("invalid sslmode %q, should be one of disable, allow, prefer, require, verify-ca or verify-full", mode)
+	}
 
-	port := int64(5432)
-	if strings.Contains(dsnURL.Host, ":") {
-		port, _ = strconv.ParseInt(dsnURL.Port(), 10, 32)
+	// A client certificate is useless without its key, and the other way around
+	_, hasCert := settings["sslcert"]
+	_, hasKey := settings["sslkey"]
+	if hasCert != hasKey {
+		return fmt.Errorf("sslcert and sslkey must be set together for TLS client certificate authentication")
 	}
+	if (hasCert || settings["sslrootcert"] != "") && settings["sslmode"] == "disable" {
+		return fmt.Errorf("TLS certificate options cannot be used with sslmode=disable")
+	}
+	return nil
+}
 
-	username := dsnURL.User.Username()
-	password, _ := dsnURL.User.Password()
-	database := strings.TrimPrefix(dsnURL.EscapedPath(), "/")
+// Socket returns true if the host is a unix socket directory.
+func (c *DSN) Socket() bool {
+	return strings.HasPrefix(c.host, "/")
+}
 
-	query := dsnURL.Query()
-	keys := make([]string, 0, len(query))
-	for key := range dsnURL.Query() {
-		keys = append(keys, key)
+// DSN returns the 'key=value' DSN, password included, to connect with.
+func (c *DSN) DSN() string {
+	return c.format(c.password)
+}
+
+// String returns the 'key=value' DSN with the password redacted, to be logged.
+func (c *DSN) String() string {
+	if c.password == "" {
+		return c.format("")
 	}
-	sort.Strings(keys)
+	return c.format(redactedPassword)
+}
 
-	options := make([]string, len(query))
-	for i, key := range keys {
-		options[i] = fmt.Sprintf("%s=%s", key, strings.Join(query[key], ","))
+func (c *DSN) format(password string) string {
+	var sb strings.Builder
+	write := func(key, value string) {
+		if sb.Len() > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(key)
+		sb.WriteString("=")
+		sb.WriteString(quoteDSNValue(value))
 	}
 
-	return &DSN{dsn, host, port, database, username, password, options}, nil
+	if c.host != "" {
+		write("host", c.host)
+	}
+	write("port", strconv.FormatInt(c.port, 10))
+	if c.username != "" {
+		write("user", c.username)
+	}
+	if c.database != "" {
+		write("dbname", c.database)
+	}
+	for _, option := range c.options {
+		write(option[0], option[1])
+	}
+	if password != "" {
+		write("password", password)
+	}
+	return sb.String()
 }
 
-type DSN struct {
-	original string
+// quoteDSNValue quotes value as libpq expects it, when it is empty or holds blanks,
+// quotes or backslashes.
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\n\r'\\") {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
 
-	host     string
-	port     int64
-	database string
-	username string
-	password string
-	options  []string
+func parseURLSettings(in string) (map[string]string, error) {
+	// Go does not accept percent-encoded hosts, the way libpq takes unix socket
+	// directories, they are swapped with a placeholder while parsing
+	in, socketHost, err := extractSocketHost(in)
+	if err != nil {
+		return nil, err
+	}
+
+	dsnURL, err := url.Parse(in)
+	if err != nil {
+		// The error of url.Parse holds the whole URL, password included
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+
+	settings := map[string]string{}
+	if host := dsnURL.Hostname(); host != "" {
+		settings["host"] = host
+	}
+	if socketHost != "" {
+		settings["host"] = socketHost
+	}
+	if port := dsnURL.Port(); port != "" {
+		settings["port"] = port
+	}
+	if dsnURL.User != nil {
+		if username := dsnURL.User.Username(); username != "" {
+			settings["user"] = username
+		}
+		if password, found := dsnURL.User.Password(); found {
+			settings["password"] = password
+		}
+	}
+	if database := strings.TrimPrefix(dsnURL.Path, "/"); database != "" {
+		settings["dbname"] = database
+	}
+
+	// Query parameters are settings too, like 'sslmode' or 'host' for a unix socket
+	for key, values := range dsnURL.Query() {
+		settings[key] = strings.Join(values, ",")
+	}
+	return settings, nil
 }
 
-func (c *DSN) DSN() string {
-	out := fmt.Sprintf("host=%s port=%d user=%s dbname=%s %s", c.host, c.port, c.username, c.database, strings.Join(c.options, " "))
-	if c.password != "" {
-		out = out + " password=" + c.password
+var socketHostRegex = regexp.MustCompile(`^(postgres(?:ql)?://(?:[^@/]*@)?)(%2[fF][^/?:]*)`)
+
+func extractSocketHost(in string) (out string, socketHost string, err error) {
+	match := socketHostRegex.FindStringSubmatchIndex(in)
+	if match == nil {
+		return in, "", nil
 	}
-	return out
+
+	socketHost, err = url.PathUnescape(in[match[4]:match[5]])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid unix socket host: %w", err)
+	}
+	return in[:match[4]] + "localhost" + in[match[5]:], socketHost, nil
 }
 
-func (c *DSN) String() string {
-	return c.original
+// parseKeywordValueSettings parses libpq 'key=value' pairs separated by blanks, values
+// being single-quoted when empty or holding blanks, with backslash escapes.
+func parseKeywordValueSettings(in string) (map[string]string, error) {
+	settings := map[string]string{}
+	runes := []rune(in)
+
+	skipSpaces := func(i int) int {
+		for i < len(runes) && unicode.IsSpace(runes[i]) {
+			i++
+		}
+		return i
+	}
+
+	for i := skipSpaces(0); i < len(runes); i = skipSpaces(i) {
+		start := i
+		for i < len(runes) && runes[i] != '=' && !unicode.IsSpace(runes[i]) {
+			i++
+		}
+		key := string(runes[start:i])
+
+		i = skipSpaces(i)
+		if i >= len(runes) || runes[i] != '=' || key == "" {
+			return nil, fmt.Errorf("invalid DSN, expected key=value pairs")
+		}
+		i = skipSpaces(i + 1)
+
+		var value strings.Builder
+		if i < len(runes) && runes[i] == '\'' {
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("invalid DSN, unterminated quoted value of %q", key)
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					value.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '\'' {
+					i++
+					break
+				}
+				value.WriteRune(runes[i])
+				i++
+			}
+		} else {
+			for i < len(runes) && !unicode.IsSpace(runes[i]) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+				i++
+			}
+		}
+
+		settings[key] = value.String()
+	}
+
+	return settings, nil
+}
+
+const redactedPassword = "xxxxx"
+
+var (
+	urlPasswordRegex     = regexp.MustCompile(`(://[^:@/?#\s]*):[^@\s]*@`)
+	queryPasswordRegex   = regexp.MustCompile(`([?&]password=)[^&\s]*`)
+	keywordPasswordRegex = regexp.MustCompile(`(^|\s)(password\s*=\s*)('(?:[^'\\]|\\.)*'|(?:[^\s\\]|\\.)*)`)
+)
+
+// RedactDSN returns in, a DSN as given on the command line, with its password
+// redacted, even when it is not a valid DSN.
+func RedactDSN(in string) string {
+	out := urlPasswordRegex.ReplaceAllString(in, "$1:"+redactedPassword+"@")
+	out = queryPasswordRegex.ReplaceAllString(out, "${1}"+redactedPassword)
+	return keywordPasswordRegex.ReplaceAllString(out, "${1}${2}"+redactedPassword)
 }
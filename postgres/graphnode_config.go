@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// PrimaryShard is the name of the shard holding graph-node's shared metadata, like
+// 'public.deployment_schemas' and the deployments' assignments.
+const PrimaryShard = "primary"
+
+// GraphNodeConfig is the store section of a graph-node 'config.toml', the DSN of each
+// shard.
+type GraphNodeConfig struct {
+	shards map[string]*DSN
+}
+
+type graphNodeConfigFile struct {
+	Store map[string]struct {
+		Connection string `toml:"connection"`
+	} `toml:"store"`
+}
+
+// IsGraphNodeConfig returns true if in, a '<psql-dsn>' argument, is the path of a
+// graph-node 'config.toml' instead of a DSN.
+func IsGraphNodeConfig(in string) bool {
+	return strings.HasSuffix(in, ".toml")
+}
+
+// LoadGraphNodeConfig reads the shards of the graph-node 'config.toml' at path. As in
+// graph-node, environment variables like '${PGPASSWORD}' are expanded in connections.
+func LoadGraphNodeConfig(path string) (*GraphNodeConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading graph-node config: %w", err)
+	}
+
+	config, err := parseGraphNodeConfig(content, os.Getenv)
+	if err != nil {
+		return nil, fmt.Errorf("graph-node config %q: %w", path, err)
+	}
+	return config, nil
+}
+
+func parseGraphNodeConfig(content []byte, mapper func(s string) string) (*GraphNodeConfig, error) {
+	file := &graphNodeConfigFile{}
+	if err := toml.Unmarshal(content, file); err != nil {
+		return nil, fmt.Errorf("invalid toml: %w", err)
+	}
+
+	config := &GraphNodeConfig{shards: make(map[string]*DSN, len(file.Store))}
+	for shard, store := range file.Store {
+		if store.Connection == "" {
+			return nil, fmt.Errorf("store %q has no connection", shard)
+		}
+
+		dsn, err := parseDSN(store.Connection, mapper)
+		if err != nil {
+			return nil, fmt.Errorf("store %q: invalid connection: %w", shard, err)
+		}
+		config.shards[shard] = dsn
+	}
+
+	if config.shards[PrimaryShard] == nil {
+		return nil, fmt.Errorf("no [store.%s] section", PrimaryShard)
+	}
+	return config, nil
+}
+
+// Primary returns the DSN of the primary shard.
+func (c *GraphNodeConfig) Primary() *DSN {
+	return c.shards[PrimaryShard]
+}
+
+// Shard returns the DSN of the shard.
+func (c *GraphNodeConfig) Shard(name string) (*DSN, error) {
+	dsn, found := c.shards[name]
+	if !found {
+		names := make([]string, 0, len(c.shards))
+		for shard := range c.shards {
+			names = append(names, shard)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("shard %q is not in the graph-node config, found %s", name, strings.Join(names, ", "))
+	}
+	return dsn, nil
+}
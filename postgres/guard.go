@@ -0,0 +1,144 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
+)
+
+// DeploymentAssignment is the graph-node assignment of a deployment, absent when the
+// deployment is unassigned.
+type DeploymentAssignment struct {
+	NodeID string
+	Paused bool
+}
+
+// ReadAssignment returns the assignment of the deployment stored in pgSchema, nil if
+// it is unassigned. How assignments reference deployments depends on layout.
+func ReadAssignment(ctx context.Context, conn Querier, layout *MetadataLayout, pgSchema string) (*DeploymentAssignment, error) {
+	join, err := layout.assignmentJoin()
+	if err != nil {
+		return nil, fmt.Errorf("reading assignment of %q: %w", pgSchema, err)
+	}
+
+	var hasPausedAt bool
+	err = conn.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM information_schema.columns
+			WHERE table_schema = 'subgraphs' AND table_name = 'subgraph_deployment_assignment' AND column_name = 'paused_at'
+		)`).Scan(&hasPausedAt)
+	if err != nil {
+		return nil, fmt.Errorf("reading assignment of %q: %w", pgSchema, err)
+	}
+
+	// Releases before pausing existed have no 'paused_at' column
+	paused := "false"
+	if hasPausedAt {
+		paused = "a.paused_at IS NOT NULL"
+	}
+
+	assignment := &DeploymentAssignment{}
+	err = NewStatement("SELECT a.node_id, ").SQL(paused).
+		SQL(" FROM subgraphs.subgraph_deployment_assignment a JOIN public.deployment_schemas ds ON ").SQL(join).
+		SQL(" WHERE ds.name = ").Bind(pgSchema).
+		QueryRow(ctx, conn).
+		Scan(&assignment.NodeID, &assignment.Paused)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading assignment of %q: %w", pgSchema, err)
+	}
+
+	return assignment, nil
+}
+
+// assignmentJoin returns the condition joining 'subgraph_deployment_assignment a' to
+// 'deployment_schemas ds'. Releases of the head layout key assignments by the integer
+// id of the deployment, legacy ones first keyed them by the deployment hash. An
+// unknown layout is an error, a join matching nothing would read as unassigned.
+func (l *MetadataLayout) assignmentJoin() (string, error) {
+	if l == nil {
+		return "", fmt.Errorf("unknown graph-node metadata layout")
+	}
+
+	switch l.Name {
+	case MetadataLayoutHead:
+		return "ds.id = a.id", nil
+	case MetadataLayoutSubgraphDeployment:
+		return "(ds.id::text = a.id::text OR ds.subgraph = a.id::text)", nil
+	}
+	return "", fmt.Errorf("unknown graph-node metadata layout %q, cannot find the assignment of deployments", l.Name)
+}
+
+// CheckNotIndexing fails if graph-node may be indexing the deployment stored in
+// pgSchema, that is if it is assigned to a node and not paused.
+func CheckNotIndexing(ctx context.Context, conn Querier, layout *MetadataLayout, pgSchema string) error {
+	assignment, err := ReadAssignment(ctx, conn, layout, pgSchema)
+	if err != nil {
+		return err
+	}
+	return checkAssignment(pgSchema, assignment)
+}
+
+func checkAssignment(pgSchema string, assignment *DeploymentAssignment) error {
+	// Old graphman releases unassigned deployments by assigning them to 'removed'
+	if assignment == nil || assignment.Paused || assignment.NodeID == "removed" {
+		return nil
+	}
+	return fmt.Errorf("deployment %q is assigned to node %q and not paused, graph-node may be writing to it: unassign or pause it first ('graphman unassign' or 'graphman pause'), or use --force", pgSchema, assignment.NodeID)
+}
+
+// DeploymentLock is a session advisory lock held on a deployment, so that two
+// graphload processes never write to the same deployment at the same time.
+type DeploymentLock struct {
+	conn     *pgxpool.Conn
+	pgSchema string
+}
+
+// Advisory locks of graphload use the two-int form, the first one, their class, being
+// fixed per purpose so the hash of their key, the second one, never collides with the
+// lock of another purpose.
+const (
+	// AdvisoryLockDeployment is the class of the locks of DeploymentLock, keyed by the
+	// deployment schema
+	AdvisoryLockDeployment int32 = 0x676c6401
+	// AdvisoryLockProgressTable is the class of the locks serializing the creation of
+	// the 'progress$' table of inject-csv, keyed by the qualified table
+	AdvisoryLockProgressTable int32 = 0x676c6402
+)
+
+// LockDeployment takes the advisory lock of the deployment stored in pgSchema on a
+// connection of pool, held until Release. It fails right away if another process
+// holds it.
+func LockDeployment(ctx context.Context, pool *pgxpool.Pool, pgSchema string) (*DeploymentLock, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("pool acquire: %w", err)
+	}
+
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1, hashtext($2))", AdvisoryLockDeployment, pgSchema).Scan(&locked); err != nil {
+		conn.Release()
+		return nil, fmt.Errorf("locking deployment %q: %w", pgSchema, err)
+	}
+	if !locked {
+		conn.Release()
+		return nil, fmt.Errorf("deployment %q is locked by another graphload process", pgSchema)
+	}
+
+	return &DeploymentLock{conn: conn, pgSchema: pgSchema}, nil
+}
+
+// Release releases the lock and its connection. The lock is released by Postgres
+// anyway when the connection closes.
+func (l *DeploymentLock) Release(ctx context.Context) {
+	if _, err := l.conn.Exec(ctx, "SELECT pg_advisory_unlock($1, hashtext($2))", AdvisoryLockDeployment, l.pgSchema); err != nil {
+		zlog.Warn("unable to release deployment lock", zap.String("schema", l.pgSchema), zap.Error(err))
+	}
+	l.conn.Release()
+}
@@ -0,0 +1,33 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAssignment(t *testing.T) {
+	assert.NoError(t, checkAssignment("sgd1", nil))
+	assert.NoError(t, checkAssignment("sgd1", &DeploymentAssignment{NodeID: "index_node_0", Paused: true}))
+	assert.NoError(t, checkAssignment("sgd1", &DeploymentAssignment{NodeID: "removed"}))
+	assert.EqualError(t, checkAssignment("sgd1", &DeploymentAssignment{NodeID: "index_node_0"}),
+		`deployment "sgd1" is assigned to node "index_node_0" and not paused, graph-node may be writing to it: unassign or pause it first ('graphman unassign' or 'graphman pause'), or use --force`)
+}
+
+func TestMetadataLayout_AssignmentJoin(t *testing.T) {
+	join, err := (&MetadataLayout{Name: MetadataLayoutHead}).assignmentJoin()
+	require.NoError(t, err)
+	assert.Equal(t, "ds.id = a.id", join)
+
+	join, err = (&MetadataLayout{Name: MetadataLayoutSubgraphDeployment, legacy: true}).assignmentJoin()
+	require.NoError(t, err)
+	assert.Contains(t, join, "ds.subgraph = a.id::text")
+
+	_, err = (&MetadataLayout{Name: "other"}).assignmentJoin()
+	assert.Error(t, err)
+
+	var unknown *MetadataLayout
+	_, err = unknown.assignmentJoin()
+	assert.Error(t, err)
+}
@@ -0,0 +1,275 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// Querier is the subset of pgx connections, pools and transactions used to read and
+// write graph-node metadata.
+type Querier interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// MetadataLayout is the layout of the graph-node tables holding the head block of a
+// deployment, which changed across graph-node releases.
+type MetadataLayout struct {
+	Name string
+	// Migration is the last diesel migration applied to the database, identifying the
+	// graph-node release that created it, blank if unknown.
+	Migration string
+
+	// Legacy releases store the head block in 'subgraphs.subgraph_deployment'
+	legacy bool
+	// The 'firehose_cursor' column appeared in later legacy releases
+	hasCursor bool
+}
+
+const (
+	// MetadataLayoutSubgraphDeployment is the layout of releases storing the head block
+	// in 'subgraphs.subgraph_deployment', keyed by the deployment hash.
+	MetadataLayoutSubgraphDeployment = "subgraph_deployment"
+	// MetadataLayoutHead is the layout of releases storing the head block in
+	// 'subgraphs.head', keyed by the id of the deployment in 'subgraphs.deployment'.
+	MetadataLayoutHead = "head"
+)
+
+// DeploymentHead is the head block metadata of a deployment, as text, nil when NULL.
+type DeploymentHead struct {
+	BlockHash   *string
+	BlockNumber *string
+	EntityCount *string
+	Cursor      *string
+}
+
+var metadataColumns = map[string][]string{
+	"subgraph_deployment": {"deployment", "latest_ethereum_block_hash", "latest_ethereum_block_number", "entity_count"},
+	"deployment":          {"id", "subgraph"},
+	"head":                {"id", "block_hash", "block_number", "entity_count", "firehose_cursor"},
+}
+
+// DetectMetadataLayout inspects the 'subgraphs' schema to find where the deployments'
+// head block is stored, failing on a layout it does not know.
+func DetectMetadataLayout(ctx context.Context, conn Querier) (*MetadataLayout, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT table_name, column_name
+		FROM information_schema.columns
+		WHERE table_schema = 'subgraphs' AND table_name IN ('subgraph_deployment', 'deployment', 'head')`)
+	if err != nil {
+		return nil, fmt.Errorf("reading graph-node metadata tables: %w", err)
+	}
+
+	tables := map[string]map[string]bool{}
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("reading graph-node metadata tables: %w", err)
+		}
+		if tables[table] == nil {
+			tables[table] = map[string]bool{}
+		}
+		tables[table][column] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading graph-node metadata tables: %w", err)
+	}
+
+	migration, err := lastMigration(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := metadataLayoutFromColumns(tables)
+	if err != nil {
+		if migration != "" {
+			return nil, fmt.Errorf("%w (last graph-node migration %s)", err, migration)
+		}
+		return nil, err
+	}
+	layout.Migration = migration
+	return layout, nil
+}
+
+func lastMigration(ctx context.Context, conn Querier) (string, error) {
+	var exists bool
+	if err := conn.QueryRow(ctx, `SELECT to_regclass('public.__diesel_schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return "", fmt.Errorf("reading graph-node migrations: %w", err)
+	}
+	if !exists {
+		return "", nil
+	}
+
+	var migration *string
+	if err := conn.QueryRow(ctx, `SELECT max(version) FROM public.__diesel_schema_migrations`).Scan(&migration); err != nil {
+		return "", fmt.Errorf("reading graph-node migrations: %w", err)
+	}
+	if migration == nil {
+		return "", nil
+	}
+	return *migration, nil
+}
+
+func metadataLayoutFromColumns(tables map[string]map[string]bool) (*MetadataLayout, error) {
+	hasColumns := func(table string) bool {
+		if tables[table] == nil {
+			return false
+		}
+		for _, column := range metadataColumns[table] {
+			if !tables[table][column] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Checked first as recent releases may keep a 'subgraph_deployment' table or view
+	if hasColumns("head") && hasColumns("deployment") {
+		return &MetadataLayout{Name: MetadataLayoutHead, hasCursor: true}, nil
+	}
+	if hasColumns("subgraph_deployment") {
+		return &MetadataLayout{
+			Name:      MetadataLayoutSubgraphDeployment,
+			legacy:    true,
+			hasCursor: tables["subgraph_deployment"]["firehose_cursor"],
+		}, nil
+	}
+
+	var found []string
+	for table, columns := range tables {
+		names := make([]string, 0, len(columns))
+		for column := range columns {
+			names = append(names, column)
+		}
+		sort.Strings(names)
+		found = append(found, fmt.Sprintf("subgraphs.%s(%s)", table, strings.Join(names, ", ")))
+	}
+	sort.Strings(found)
+	if len(found) == 0 {
+		found = []string{"none"}
+	}
+
+	return nil, fmt.Errorf("unknown graph-node metadata layout, expected either 'subgraphs.head' and 'subgraphs.deployment' or 'subgraphs.subgraph_deployment', found tables: %s", strings.Join(found, ", "))
+}
+
+func (l *MetadataLayout) headQuery(forUpdate bool) string {
+	cursor := "NULL::text"
+	if l.hasCursor {
+		cursor = "firehose_cursor"
+	}
+
+	var query string
+	if l.legacy {
+		query = fmt.Sprintf(`
+			SELECT encode(latest_ethereum_block_hash, 'hex'), latest_ethereum_block_number::text, entity_count::text, %s
+			FROM subgraphs.subgraph_deployment
+			WHERE deployment = $1`, cursor)
+	} else {
+		query = `
+			SELECT encode(h.block_hash, 'hex'), h.block_number::text, h.entity_count::text, h.firehose_cursor
+			FROM subgraphs.head h JOIN subgraphs.deployment d ON d.id = h.id
+			WHERE d.subgraph = $1`
+	}
+
+	if forUpdate {
+		if l.legacy {
+			query += " FOR UPDATE"
+		} else {
+			query += " FOR UPDATE OF h"
+		}
+	}
+	return query
+}
+
+// updateHeadQuery returns the statement setting the head block and entity count of a
+// deployment. The Firehose cursor is cleared rather than set, to NULL on every layout
+// as in ResetHeadQuery: without a cursor, graph-node restarts from the block after
+// the head, which is where it must pick up after the loaded range.
+func (l *MetadataLayout) updateHeadQuery() string {
+	if l.legacy {
+		cursor := ""
+		if l.hasCursor {
+			cursor = ", firehose_cursor = NULL"
+		}
+		return fmt.Sprintf(`
+			UPDATE subgraphs.subgraph_deployment
+			SET latest_ethereum_block_hash = $1, latest_ethereum_block_number = $2, entity_count = $3%s
+			WHERE deployment = $4`, cursor)
+	}
+
+	return `
+		UPDATE subgraphs.head h
+		SET block_hash = $1, block_number = $2, entity_count = $3, firehose_cursor = NULL
+		FROM subgraphs.deployment d
+		WHERE d.id = h.id AND d.subgraph = $4`
+}
+
+// ResetHeadQuery returns the statement clearing the head block, entity count and
+// cursor of the deployment whose hash is its only parameter, the state of a deployment
+// that never indexed a block.
+func (l *MetadataLayout) ResetHeadQuery() string {
+	if l.legacy {
+		cursor := ""
+		if l.hasCursor {
+			cursor = ", firehose_cursor = NULL"
+		}
+		return fmt.Sprintf(`
+			UPDATE subgraphs.subgraph_deployment
+			SET latest_ethereum_block_hash = NULL, latest_ethereum_block_number = NULL, entity_count = 0%s
+			WHERE deployment = $1`, cursor)
+	}
+
+	return `
+		UPDATE subgraphs.head h
+		SET block_hash = NULL, block_number = NULL, entity_count = 0, firehose_cursor = NULL
+		FROM subgraphs.deployment d
+		WHERE d.id = h.id AND d.subgraph = $1`
+}
+
+// ResetHead executes ResetHeadQuery for the deployment.
+func (l *MetadataLayout) ResetHead(ctx context.Context, conn Querier, deploymentHash string) error {
+	tag, err := conn.Exec(ctx, l.ResetHeadQuery(), deploymentHash)
+	if err != nil {
+		return fmt.Errorf("resetting head of deployment %q: %w", deploymentHash, err)
+	}
+	if tag.RowsAffected() != 1 {
+		return fmt.Errorf("resetting head of deployment %q: expected a single row updated, got %d", deploymentHash, tag.RowsAffected())
+	}
+	return nil
+}
+
+// ReadHead reads the head block metadata of the deployment, locking its row until the
+// end of the transaction with forUpdate.
+func (l *MetadataLayout) ReadHead(ctx context.Context, conn Querier, deploymentHash string, forUpdate bool) (*DeploymentHead, error) {
+	head := &DeploymentHead{}
+	err := conn.QueryRow(ctx, l.headQuery(forUpdate), deploymentHash).Scan(&head.BlockHash, &head.BlockNumber, &head.EntityCount, &head.Cursor)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("deployment %q not found in graph-node metadata", deploymentHash)
+		}
+		return nil, fmt.Errorf("reading head of deployment %q: %w", deploymentHash, err)
+	}
+	return head, nil
+}
+
+// WriteHead sets the head block and entity count of the deployment and clears its
+// Firehose cursor, so graph-node resumes indexing from the block after blockNum.
+func (l *MetadataLayout) WriteHead(ctx context.Context, conn Querier, deploymentHash string, blockHash []byte, blockNum uint64, entityCount int64) error {
+	tag, err := conn.Exec(ctx, l.updateHeadQuery(), blockHash, int64(blockNum), entityCount, deploymentHash)
+	if err != nil {
+		return fmt.Errorf("updating head of deployment %q: %w", deploymentHash, err)
+	}
+	if tag.RowsAffected() != 1 {
+		return fmt.Errorf("updating head of deployment %q: expected a single row updated, got %d", deploymentHash, tag.RowsAffected())
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataLayoutFromColumns(t *testing.T) {
+	columns := func(names ...string) map[string]bool {
+		out := map[string]bool{}
+		for _, name := range names {
+			out[name] = true
+		}
+		return out
+	}
+
+	tests := []struct {
+		name           string
+		tables         map[string]map[string]bool
+		expectedLayout string
+		expectedCursor bool
+		expectedError  string
+	}{
+		{
+			"legacy without cursor",
+			map[string]map[string]bool{
+				"subgraph_deployment": columns("id", "deployment", "latest_ethereum_block_hash", "latest_ethereum_block_number", "entity_count"),
+			},
+			MetadataLayoutSubgraphDeployment, false, "",
+		},
+		{
+			"legacy with cursor",
+			map[string]map[string]bool{
+				"subgraph_deployment": columns("id", "deployment", "latest_ethereum_block_hash", "latest_ethereum_block_number", "entity_count", "firehose_cursor"),
+			},
+			MetadataLayoutSubgraphDeployment, true, "",
+		},
+		{
+			"head",
+			map[string]map[string]bool{
+				"deployment":          columns("id", "subgraph"),
+				"head":                columns("id", "block_hash", "block_number", "entity_count", "firehose_cursor"),
+				"subgraph_deployment": columns("id", "deployment"),
+			},
+			MetadataLayoutHead, true, "",
+		},
+		{
+			"unknown",
+			map[string]map[string]bool{
+				"subgraph_deployment": columns("id", "deployment", "head_block"),
+			},
+			"", false, "unknown graph-node metadata layout, expected either 'subgraphs.head' and 'subgraphs.deployment' or 'subgraphs.subgraph_deployment', found tables: subgraphs.subgraph_deployment(deployment, head_block, id)",
+		},
+		{
+			"no tables",
+			map[string]map[string]bool{},
+			"", false, "unknown graph-node metadata layout, expected either 'subgraphs.head' and 'subgraphs.deployment' or 'subgraphs.subgraph_deployment', found tables: none",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout, err := metadataLayoutFromColumns(test.tables)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedLayout, layout.Name)
+			assert.Equal(t, test.expectedCursor, layout.hasCursor)
+		})
+	}
+}
+
+func TestMetadataLayout_Queries(t *testing.T) {
+	legacy := &MetadataLayout{Name: MetadataLayoutSubgraphDeployment, legacy: true}
+	assert.Contains(t, legacy.headQuery(true), "NULL::text\n")
+	assert.Contains(t, legacy.headQuery(true), "FROM subgraphs.subgraph_deployment")
+	assert.NotContains(t, legacy.updateHeadQuery(), "firehose_cursor")
+	assert.NotContains(t, legacy.ResetHeadQuery(), "firehose_cursor")
+
+	legacyCursor := &MetadataLayout{Name: MetadataLayoutSubgraphDeployment, legacy: true, hasCursor: true}
+	assert.Contains(t, legacyCursor.updateHeadQuery(), "firehose_cursor = NULL")
+
+	head := &MetadataLayout{Name: MetadataLayoutHead, hasCursor: true}
+	assert.Contains(t, head.headQuery(true), "FOR UPDATE OF h")
+	assert.Contains(t, head.updateHeadQuery(), "UPDATE subgraphs.head h")
+	assert.Contains(t, head.updateHeadQuery(), "firehose_cursor = NULL")
+	assert.Contains(t, head.ResetHeadQuery(), "block_number = NULL, entity_count = 0, firehose_cursor = NULL")
+}
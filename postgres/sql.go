@@ -0,0 +1,93 @@
+package postgres
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// QuoteIdentifier quotes the parts of a possibly qualified identifier, like a schema and
+// a table, so that names which are SQL keywords, like 'order' or 'user', are usable.
+func QuoteIdentifier(parts ...string) string {
+	return pgx.Identifier(parts).Sanitize()
+}
+
+// Statement builds a SQL statement from fragments, quoting identifiers and binding
+// values as parameters instead of writing them in the SQL.
+type Statement struct {
+	sb   strings.Builder
+	args []interface{}
+}
+
+// NewStatement starts a statement with sql, written as is.
+func NewStatement(sql string) *Statement {
+	s := &Statement{}
+	return s.SQL(sql)
+}
+
+// SQL appends sql, written as is, so it must never hold names or values.
+func (s *Statement) SQL(sql string) *Statement {
+	s.sb.WriteString(sql)
+	return s
+}
+
+// Ident appends the quoted identifier made of parts, like a schema and a table.
+func (s *Statement) Ident(parts ...string) *Statement {
+	s.sb.WriteString(QuoteIdentifier(parts...))
+	return s
+}
+
+// Idents appends the quoted names separated by commas, like a list of columns.
+func (s *Statement) Idents(names ...string) *Statement {
+	for i, name := range names {
+		if i > 0 {
+			s.sb.WriteString(", ")
+		}
+		s.sb.WriteString(QuoteIdentifier(name))
+	}
+	return s
+}
+
+// Bind appends the placeholder of a parameter bound to value, '$1' for the first one.
+func (s *Statement) Bind(value interface{}) *Statement {
+	s.args = append(s.args, value)
+	s.sb.WriteString("$")
+	s.sb.WriteString(strconv.Itoa(len(s.args)))
+	return s
+}
+
+// String returns the SQL of the statement.
+func (s *Statement) String() string {
+	return s.sb.String()
+}
+
+// Args returns the values bound to the parameters of the statement, in order.
+func (s *Statement) Args() []interface{} {
+	return s.args
+}
+
+func (s *Statement) Exec(ctx context.Context, conn Querier) (pgconn.CommandTag, error) {
+	return conn.Exec(ctx, s.String(), s.args...)
+}
+
+func (s *Statement) Query(ctx context.Context, conn Querier) (pgx.Rows, error) {
+	return conn.Query(ctx, s.String(), s.args...)
+}
+
+func (s *Statement) QueryRow(ctx context.Context, conn Querier) pgx.Row {
+	return conn.QueryRow(ctx, s.String(), s.args...)
+}
+
+// CopyFromCSV returns the COPY of a CSV file with a header into the table, the columns
+// being the ones of the header and forceNotNull the ones where an empty value is an
+// empty string and not NULL.
+func CopyFromCSV(pgSchema, table string, columns, forceNotNull []string) *Statement {
+	return NewStatement("COPY ").
+		Ident(pgSchema, table).
+		SQL(" (").Idents(columns...).
+		SQL(") FROM STDIN WITH (FORMAT CSV, HEADER, FORCE_NOT_NULL (").Idents(forceNotNull...).
+		SQL("))")
+}
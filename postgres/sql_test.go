@@ -0,0 +1,37 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+	assert.Equal(t, `"sgd1"."order"`, QuoteIdentifier("sgd1", "order"))
+	assert.Equal(t, `"user"`, QuoteIdentifier("user"))
+	assert.Equal(t, `"sgd1"."progress$"`, QuoteIdentifier("sgd1", "progress$"))
+	assert.Equal(t, `"we""ird"`, QuoteIdentifier(`we"ird`))
+}
+
+func TestStatement(t *testing.T) {
+	query := NewStatement("SELECT ").Idents("id", "user", "group").
+		SQL(" FROM ").Ident("sgd1", "order").
+		SQL(" WHERE ").Ident("group").SQL(" = ").Bind("admins").
+		SQL(" AND lower(block_range) >= ").Bind(uint64(12))
+
+	assert.Equal(t, `SELECT "id", "user", "group" FROM "sgd1"."order" WHERE "group" = $1 AND lower(block_range) >= $2`, query.String())
+	assert.Equal(t, []interface{}{"admins", uint64(12)}, query.Args())
+}
+
+func TestStatement_NoArgs(t *testing.T) {
+	query := NewStatement("TRUNCATE TABLE ").Ident("sgd1", "user").SQL(", ").Ident("sgd1", "group")
+
+	assert.Equal(t, `TRUNCATE TABLE "sgd1"."user", "sgd1"."group"`, query.String())
+	assert.Empty(t, query.Args())
+}
+
+func TestCopyFromCSV(t *testing.T) {
+	query := CopyFromCSV("sgd1", "order", []string{"id", "user", "group", "block_range"}, []string{"id", "block_range"})
+
+	assert.Equal(t, `COPY "sgd1"."order" ("id", "user", "group", "block_range") FROM STDIN WITH (FORMAT CSV, HEADER, FORCE_NOT_NULL ("id", "block_range"))`, query.String())
+}
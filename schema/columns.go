@@ -0,0 +1,170 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TableColumn is a column of an entity table, as described by information_schema.columns.
+type TableColumn struct {
+	Name string
+	// DataType is the SQL type category, 'ARRAY' or 'USER-DEFINED' (enums) for example
+	DataType string
+	// UDTName is the underlying type name, prefixed by '_' for arrays ('int4', '_text')
+	UDTName string
+	// HasDefault is true when the column is filled by Postgres when not provided, like 'vid'
+	HasDefault bool
+}
+
+// ColumnMismatch is a column whose type in the table is not the expected one.
+type ColumnMismatch struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+// ColumnsDiff lists the differences between the columns of CSV files and the ones of
+// the table they are injected into.
+type ColumnsDiff struct {
+	// Missing are the CSV columns not in the table
+	Missing []string
+	// Extra are the table columns without default not in the CSV
+	Extra []string
+	// Mistyped are the columns whose table type does not match the GraphQL schema
+	Mistyped []*ColumnMismatch
+}
+
+func (d *ColumnsDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Mistyped) == 0
+}
+
+func (d *ColumnsDiff) String() string {
+	var out strings.Builder
+	for _, name := range d.Missing {
+		fmt.Fprintf(&out, "  - %s: in CSV files, missing from table\n", name)
+	}
+	for _, name := range d.Extra {
+		fmt.Fprintf(&out, "  + %s: in table, missing from CSV files\n", name)
+	}
+	for _, mismatch := range d.Mistyped {
+		fmt.Fprintf(&out, "  ~ %s: expected %s, table has %s\n", mismatch.Name, mismatch.Expected, mismatch.Actual)
+	}
+	return out.String()
+}
+
+// DiffColumns compares the CSV header of the entity with the columns of its table,
+// using the types of the GraphQL schema to check the table ones.
+func DiffColumns(desc *EntityDesc, header []string, columns []*TableColumn) *ColumnsDiff {
+	diff := &ColumnsDiff{}
+
+	tableColumns := make(map[string]*TableColumn, len(columns))
+	for _, col := range columns {
+		tableColumns[col.Name] = col
+	}
+
+	inHeader := make(map[string]bool, len(header))
+	for _, name := range header {
+		inHeader[name] = true
+
+		col, found := tableColumns[name]
+		if !found {
+			diff.Missing = append(diff.Missing, name)
+			continue
+		}
+
+		expected, matches := expectedColumnType(desc, name)
+		if !matches(col) {
+			diff.Mistyped = append(diff.Mistyped, &ColumnMismatch{Name: name, Expected: expected, Actual: columnTypeName(col)})
+		}
+	}
+
+	for _, col := range columns {
+		if !inHeader[col.Name] && !col.HasDefault {
+			diff.Extra = append(diff.Extra, col.Name)
+		}
+	}
+
+	return diff
+}
+
+// expectedColumnType returns the description of the type expected for the column and
+// a function checking a table column against it.
+func expectedColumnType(desc *EntityDesc, name string) (string, func(col *TableColumn) bool) {
+	switch name {
+	case "block_range":
+		return "int4range", udtNameIs("int4range")
+	case "block$":
+		return "int4", udtNameIs("int4")
+	}
+
+	field, found := desc.Fields[name]
+	if !found {
+		return "no such field in GraphQL schema", func(*TableColumn) bool { return false }
+	}
+
+	var expected string
+	var udtNames []string
+	switch field.Type {
+	case FieldTypeString:
+		expected, udtNames = "text", []string{"text"}
+	case FieldTypeInt:
+		expected, udtNames = "int4", []string{"int4"}
+	case FieldTypeFloat:
+		expected, udtNames = "float8", []string{"float8"}
+	case FieldTypeBoolean:
+		expected, udtNames = "bool", []string{"bool"}
+	case FieldTypeBigInt, FieldTypeBigDecimal:
+		expected, udtNames = "numeric", []string{"numeric"}
+	case FieldTypeBytes:
+		expected, udtNames = "bytea", []string{"bytea"}
+	default:
+		// IDs, references to other entities (whose id may be Bytes) and enums
+		expected, udtNames = "text, bytea or enum", []string{"text", "bytea"}
+	}
+
+	if field.Array {
+		expected += " array"
+		for i, udtName := range udtNames {
+			udtNames[i] = "_" + udtName
+		}
+	}
+
+	return expected, func(col *TableColumn) bool {
+		if field.Type == FieldTypeID && isEnumColumn(col, field.Array) {
+			return true
+		}
+		for _, udtName := range udtNames {
+			if col.UDTName == udtName {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// builtinTypes are the underlying types graph-node uses for entity columns, any other
+// one is an enum.
+var builtinTypes = map[string]bool{
+	"text": true, "varchar": true, "bytea": true, "int4": true, "int8": true,
+	"numeric": true, "bool": true, "float8": true, "int4range": true,
+}
+
+func isEnumColumn(col *TableColumn, array bool) bool {
+	if array {
+		return col.DataType == "ARRAY" && !builtinTypes[strings.TrimPrefix(col.UDTName, "_")]
+	}
+	return col.DataType == "USER-DEFINED"
+}
+
+func udtNameIs(udtName string) func(col *TableColumn) bool {
+	return func(col *TableColumn) bool {
+		return col.UDTName == udtName
+	}
+}
+
+func columnTypeName(col *TableColumn) string {
+	if strings.HasPrefix(col.UDTName, "_") {
+		return strings.TrimPrefix(col.UDTName, "_") + " array"
+	}
+	return col.UDTName
+}
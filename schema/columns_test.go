@@ -0,0 +1,100 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffColumns(t *testing.T) {
+	entities, err := getEntitiesFromSchemaData([]byte(`
+		enum Kind { A, B }
+		type Pool @entity {
+			id: ID!
+			token: Token!
+			kind: Kind!
+			kinds: [Kind!]!
+			fee: BigInt!
+			ticks: [Int!]!
+			active: Boolean
+			name: String
+		}
+		type Token @entity {
+			id: Bytes!
+		}
+	`))
+	require.NoError(t, err)
+	pool := entities[0]
+	require.Equal(t, "pool", pool.Name)
+
+	column := func(name, dataType, udtName string) *TableColumn {
+		return &TableColumn{Name: name, DataType: dataType, UDTName: udtName}
+	}
+	matching := []*TableColumn{
+		{Name: "vid", DataType: "bigint", UDTName: "int8", HasDefault: true},
+		column("block_range", "int4range", "int4range"),
+		column("id", "text", "text"),
+		column("token", "bytea", "bytea"),
+		column("kind", "USER-DEFINED", "kind"),
+		column("kinds", "ARRAY", "_kind"),
+		column("fee", "numeric", "numeric"),
+		column("ticks", "ARRAY", "_int4"),
+		column("active", "boolean", "bool"),
+		column("name", "text", "text"),
+	}
+	header := []string{"id", "block_range", "active", "fee", "kind", "kinds", "name", "ticks", "token"}
+
+	tests := []struct {
+		name     string
+		header   []string
+		columns  []*TableColumn
+		expected *ColumnsDiff
+	}{
+		{"matching", header, matching, &ColumnsDiff{}},
+		{
+			"missing from table",
+			header,
+			withoutColumn(matching, "name"),
+			&ColumnsDiff{Missing: []string{"name"}},
+		},
+		{
+			"missing from csv",
+			[]string{"id", "block_range", "active", "fee", "kind", "kinds", "ticks", "token"},
+			matching,
+			&ColumnsDiff{Extra: []string{"name"}},
+		},
+		{
+			"mistyped",
+			header,
+			append(withoutColumn(withoutColumn(matching, "fee"), "ticks"), column("fee", "text", "text"), column("ticks", "ARRAY", "_numeric")),
+			&ColumnsDiff{Mistyped: []*ColumnMismatch{
+				{Name: "fee", Expected: "numeric", Actual: "text"},
+				{Name: "ticks", Expected: "int4 array", Actual: "numeric array"},
+			}},
+		},
+		{
+			"not in schema",
+			append(header, "unknown"),
+			append(matching, column("unknown", "text", "text")),
+			&ColumnsDiff{Mistyped: []*ColumnMismatch{{Name: "unknown", Expected: "no such field in GraphQL schema", Actual: "text"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := DiffColumns(pool, test.header, test.columns)
+			assert.Equal(t, test.expected, diff)
+			assert.Equal(t, test.expected.Empty(), diff.Empty())
+		})
+	}
+}
+
+func withoutColumn(columns []*TableColumn, name string) (out []*TableColumn) {
+	for _, col := range columns {
+		if col.Name != name {
+			out = append(out, col)
+		}
+	}
+	return out
+}
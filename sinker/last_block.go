@@ -0,0 +1,65 @@
+package sinker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/streamingfast/dstore"
+)
+
+// LastBlockFilename is the file of the destination folder recording the number and
+// hash of the last block processed by `run`, once it reached its stop block.
+const LastBlockFilename = "last_block.txt"
+
+func formatLastBlock(blockNum uint64, blockHash string) string {
+	return fmt.Sprintf("%d:%s\n", blockNum, blockHash)
+}
+
+// WriteLastBlock writes the number and hash of the last block processed by `run` in
+// the destination folder.
+func WriteLastBlock(ctx context.Context, destFolder string, blockNum uint64, blockHash string) error {
+	store, err := dstore.NewSimpleStore(destFolder)
+	if err != nil {
+		return fmt.Errorf("failed to initialize store at path %s: %w", destFolder, err)
+	}
+
+	if err := store.WriteObject(ctx, LastBlockFilename, bytes.NewReader([]byte(formatLastBlock(blockNum, blockHash)))); err != nil {
+		return fmt.Errorf("write %s: %w", LastBlockFilename, err)
+	}
+	return nil
+}
+
+// ReadLastBlock reads the number and hash of the last block processed by `run` in
+// the destination folder.
+func ReadLastBlock(ctx context.Context, destFolder string) (blockNum uint64, blockHash string, err error) {
+	store, err := dstore.NewSimpleStore(destFolder)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to initialize store at path %s: %w", destFolder, err)
+	}
+
+	reader, err := store.OpenObject(ctx, LastBlockFilename)
+	if err != nil {
+		return 0, "", fmt.Errorf("open %s: %w", LastBlockFilename, err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return 0, "", fmt.Errorf("read %s: %w", LastBlockFilename, err)
+	}
+
+	numPart, hashPart, found := strings.Cut(strings.TrimSpace(string(content)), ":")
+	if !found || hashPart == "" {
+		return 0, "", fmt.Errorf("invalid %s %q, expected '<block_num>:<block_hash>'", store.ObjectPath(LastBlockFilename), content)
+	}
+	blockNum, err = strconv.ParseUint(numPart, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid block number in %s %q: %w", store.ObjectPath(LastBlockFilename), content, err)
+	}
+
+	return blockNum, hashPart, nil
+}
@@ -0,0 +1,25 @@
+package sinker
+
+import (
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
+)
+
+// Option configures an EntitiesSink.
+type Option func(s *EntitiesSink)
+
+// WithCompression sets the compression of the entity bundles written by the sink,
+// gzip by default.
+func WithCompression(t compression.Type) Option {
+	return func(s *EntitiesSink) {
+		s.compression = t
+	}
+}
+
+// WithFileType sets the file type of the entity bundles written by the sink, JSONL
+// by default.
+func WithFileType(fileType writer.FileType) Option {
+	return func(s *EntitiesSink) {
+		s.fileType = fileType
+	}
+}
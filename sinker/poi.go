@@ -0,0 +1,108 @@
+package sinker
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/schema"
+)
+
+// LastPOIBefore scans the `poi2$` bundles written by a previous run in destFolder
+// and returns the last POI digest recorded strictly before blockNum. Bundles must
+// be contiguous and cover everything up to blockNum - 1. A nil digest is returned
+// if bundles are complete but no POI was recorded before blockNum.
+func LastPOIBefore(ctx context.Context, destFolder string, blockNum uint64) ([]byte, error) {
+	poiStore, fileType, _, err := bundler.DetectEntityStore(ctx, destFolder, schema.PoiEntityName)
+	if err != nil {
+		return nil, err
+	}
+
+	var filenames []string
+	var endRange uint64
+	err = poiStore.Walk(ctx, "", func(filename string) error {
+		startBlockNum, endBlockNum, err := bundler.BlockRangeFromFilename(filename)
+		if err != nil {
+			return fmt.Errorf("fail reading block range in %q: %w", filename, err)
+		}
+
+		if startBlockNum >= blockNum {
+			return dstore.StopIteration
+		}
+
+		if len(filenames) != 0 && startBlockNum != endRange+1 {
+			return fmt.Errorf("broken %s bundle contiguity at %q (previous range end was %d)", schema.PoiEntityName, filename, endRange)
+		}
+
+		endRange = endBlockNum
+		filenames = append(filenames, filename)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to walk %s files: %w", schema.PoiEntityName, err)
+	}
+
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no %s bundle found before block %d in %q", schema.PoiEntityName, blockNum, poiStore.BaseURL())
+	}
+
+	if endRange+1 < blockNum {
+		return nil, fmt.Errorf("%s bundles end at block %d, missing bundles up to block %d", schema.PoiEntityName, endRange, blockNum-1)
+	}
+
+	var digest []byte
+	for _, filename := range filenames {
+		fileDigest, err := lastPOIInFile(ctx, poiStore, fileType, filename, blockNum)
+		if err != nil {
+			return nil, fmt.Errorf("reading %q: %w", filename, err)
+		}
+
+		if fileDigest != nil {
+			digest = fileDigest
+		}
+	}
+
+	return digest, nil
+}
+
+func lastPOIInFile(ctx context.Context, store dstore.Store, fileType writer.FileType, filename string, beforeBlockNum uint64) (digest []byte, err error) {
+	reader, err := store.OpenObject(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decoder, err := bundler.NewDecoder(reader, fileType)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		poi, err := decoder.Decode()
+		if err != nil {
+			if err == io.EOF {
+				return digest, nil
+			}
+			return nil, err
+		}
+
+		if poi.BlockNum >= beforeBlockNum {
+			return digest, nil
+		}
+
+		for _, f := range poi.EntityChange.GetFields() {
+			if f.Name != "digest" {
+				continue
+			}
+
+			digest, err = base64.StdEncoding.DecodeString(f.NewValue.GetBytes())
+			if err != nil {
+				return nil, fmt.Errorf("invalid digest at block %d: %w", poi.BlockNum, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package sinker
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-graph-load/bundler"
+	"github.com/streamingfast/substreams-graph-load/poi"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastPOIBefore(t *testing.T) {
+	writeBundle := func(t *testing.T, store dstore.Store, filename string, pois map[uint64][]byte, blockNums ...uint64) {
+		buf := bytes.NewBuffer(nil)
+		for _, blockNum := range blockNums {
+			line, err := bundler.JSONLEncodeAny(poi.NewDigestEntityChange(pois[blockNum], "ethereum/mainnet", blockNum))
+			require.NoError(t, err)
+			buf.Write(line)
+		}
+		require.NoError(t, store.WriteObject(context.Background(), filename, buf))
+	}
+
+	pois := map[uint64][]byte{
+		5:  {0x05},
+		12: {0x12},
+		17: {0x17},
+		25: {0x25},
+	}
+
+	tests := []struct {
+		name        string
+		files       map[string][]uint64
+		blockNum    uint64
+		expected    []byte
+		expectedErr string
+	}{
+		{"last of previous bundle", map[string][]uint64{"0000000000-0000000009": {5}, "0000000010-0000000019": {12, 17}, "0000000020-0000000029": {25}}, 20, []byte{0x17}, ""},
+		{"middle of bundle", map[string][]uint64{"0000000000-0000000009": {5}, "0000000010-0000000019": {12, 17}}, 15, []byte{0x12}, ""},
+		{"empty bundle", map[string][]uint64{"0000000000-0000000009": {5}, "0000000010-0000000019": {}}, 20, []byte{0x05}, ""},
+		{"no bundle", map[string][]uint64{}, 20, nil, "no poi2$ bundle found before block 20"},
+		{"missing last bundle", map[string][]uint64{"0000000000-0000000009": {5}}, 20, nil, "poi2$ bundles end at block 9, missing bundles up to block 19"},
+		{"not contiguous", map[string][]uint64{"0000000000-0000000009": {5}, "0000000020-0000000029": {25}}, 30, nil, "broken poi2$ bundle contiguity"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destFolder := t.TempDir()
+			baseStore, err := dstore.NewJSONLStore(destFolder)
+			require.NoError(t, err)
+			poiStore, err := baseStore.SubStore(schema.PoiEntityName)
+			require.NoError(t, err)
+
+			for filename, blockNums := range test.files {
+				writeBundle(t, poiStore, filename, pois, blockNums...)
+			}
+
+			digest, err := LastPOIBefore(context.Background(), destFolder, test.blockNum)
+			if test.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, digest)
+		})
+	}
+}
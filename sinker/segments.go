@@ -0,0 +1,70 @@
+package sinker
+
+import (
+	"fmt"
+
+	"github.com/streamingfast/bstream"
+)
+
+// WithSegment configures the sink to stream the given segment of a larger block
+// range, processed concurrently by one sink per segment. The POI, which depends on
+// every previous block, is not computed and must be recomputed from the entity
+// bundles once all segments completed. Progress is persisted in the segment's own
+// state file and no segment writes `last_block.txt`, the caller writes it from the
+// last segment's state once every segment and the POI completed.
+func WithSegment(segment *bstream.Range) Option {
+	return func(s *EntitiesSink) {
+		s.deferPOI = true
+		s.stateFilename = SegmentStateFilename(segment.StartBlock(), *segment.EndBlock())
+		s.writeLastBlock = false
+	}
+}
+
+// PlanSegments splits [startBlock, stopBlock) into at most count contiguous
+// segments, each spanning a whole number of bundles, so that the bundles written
+// by all segments are exactly the ones a single sink would have written. Bundles
+// are spread as evenly as possible, the first segments receiving the extra ones.
+func PlanSegments(startBlock, stopBlock, bundleSize uint64, count int) ([]*bstream.Range, error) {
+	if bundleSize == 0 {
+		return nil, fmt.Errorf("bundle size must be >0")
+	}
+	if count <= 0 {
+		return nil, fmt.Errorf("segment count must be >0, got %d", count)
+	}
+	if startBlock >= stopBlock {
+		return nil, fmt.Errorf("start block %d must be lower than stop block %d", startBlock, stopBlock)
+	}
+
+	alignedStart := startBlock - startBlock%bundleSize
+	bundleCount := (stopBlock - alignedStart + bundleSize - 1) / bundleSize
+	if uint64(count) > bundleCount {
+		count = int(bundleCount)
+	}
+
+	perSegment := bundleCount / uint64(count)
+	extra := bundleCount % uint64(count)
+
+	segments := make([]*bstream.Range, 0, count)
+	segmentStart := alignedStart
+	for i := uint64(0); i < uint64(count); i++ {
+		bundles := perSegment
+		if i < extra {
+			bundles++
+		}
+
+		segmentEnd := segmentStart + bundles*bundleSize
+		if segmentEnd > stopBlock {
+			segmentEnd = stopBlock
+		}
+
+		from := segmentStart
+		if from < startBlock {
+			from = startBlock
+		}
+
+		segments = append(segments, bstream.NewRangeExcludingEnd(from, segmentEnd))
+		segmentStart = segmentEnd
+	}
+
+	return segments, nil
+}
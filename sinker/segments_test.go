@@ -0,0 +1,48 @@
+package sinker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanSegments(t *testing.T) {
+	type segment struct{ start, end uint64 }
+
+	tests := []struct {
+		name       string
+		startBlock uint64
+		stopBlock  uint64
+		count      int
+		expected   []segment
+	}{
+		{"even split", 0, 4000, 2, []segment{{0, 2000}, {2000, 4000}}},
+		{"extra bundles first", 0, 5000, 3, []segment{{0, 2000}, {2000, 4000}, {4000, 5000}}},
+		{"unaligned start", 1500, 4000, 2, []segment{{1500, 3000}, {3000, 4000}}},
+		{"unaligned stop", 0, 3500, 2, []segment{{0, 2000}, {2000, 3500}}},
+		{"more segments than bundles", 1000, 3000, 5, []segment{{1000, 2000}, {2000, 3000}}},
+		{"single segment", 1000, 1010, 1, []segment{{1000, 1010}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			segments, err := PlanSegments(test.startBlock, test.stopBlock, 1000, test.count)
+			require.NoError(t, err)
+
+			var actual []segment
+			for _, s := range segments {
+				actual = append(actual, segment{s.StartBlock(), *s.EndBlock()})
+			}
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestPlanSegments_Invalid(t *testing.T) {
+	_, err := PlanSegments(1000, 1000, 1000, 2)
+	assert.Error(t, err)
+
+	_, err = PlanSegments(0, 1000, 1000, 0)
+	assert.Error(t, err)
+}
@@ -3,7 +3,6 @@ package sinker
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"path/filepath"
@@ -16,6 +15,7 @@ import (
 	graphload "github.com/streamingfast/substreams-graph-load"
 	"github.com/streamingfast/substreams-graph-load/bundler"
 	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
 	"github.com/streamingfast/substreams-graph-load/poi"
 	"github.com/streamingfast/substreams-graph-load/schema"
 	sink "github.com/streamingfast/substreams-sink"
@@ -32,9 +32,28 @@ type EntitiesSink struct {
 
 	fileBundlers map[string]*bundler.Bundler
 	poiBundler   *bundler.Bundler
-	stopBlock    uint64
-	chainID      string
-	lastPOI      []byte
+	// refBundler is the bundler whose boundaries are used to checkpoint the state,
+	// all bundlers share the same boundaries.
+	refBundler  *bundler.Bundler
+	stopBlock   uint64
+	bundleSize  uint64
+	chainID     string
+	lastPOI     []byte
+	lastCursor  *sink.Cursor
+	startCursor *sink.Cursor
+
+	fileType       writer.FileType
+	compression    compression.Type
+	deferPOI       bool
+	writeLastBlock bool
+
+	stateStore    dstore.Store
+	stateFilename string
+	stateLock     sync.Mutex
+	// pendingStates are the checkpoints reached but not yet saved, oldest first,
+	// uploads can lag several boundaries behind on slow stores
+	pendingStates []*State
+	completed     bool
 
 	logger *zap.Logger
 	tracer logging.Tracer
@@ -51,8 +70,10 @@ func New(
 	bufferSize uint64,
 	chainID string,
 	startPOI []byte,
+	startCursor *sink.Cursor,
 	logger *zap.Logger,
 	tracer logging.Tracer,
+	opts ...Option,
 ) (*EntitiesSink, error) {
 	blockRange := sink.BlockRange()
 	if blockRange == nil || blockRange.EndBlock() == nil {
@@ -64,43 +85,71 @@ func New(
 		Sinker:  sink,
 
 		lastPOI:      startPOI,
+		lastCursor:   startCursor,
+		startCursor:  startCursor,
 		fileBundlers: make(map[string]*bundler.Bundler),
 		destFolder:   destFolder,
 		logger:       logger,
 		tracer:       tracer,
 		chainID:      chainID,
 		stopBlock:    *blockRange.EndBlock(),
+		bundleSize:   bundleSize,
+
+		fileType:       writer.FileTypeJSONL,
+		compression:    compression.Gzip,
+		writeLastBlock: true,
+		stateFilename:  StateFilename,
 
 		stats: NewStats(logger),
 	}
 
-	baseOutputStore, err := dstore.NewJSONLStore(destFolder)
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	// When resuming, bundles past the persisted state may have been (partially) written
+	// by the previous run, they must be overwritten.
+	overwrite := true
+	baseOutputStore, err := compression.NewStore(destFolder, string(s.fileType), s.compression, overwrite)
 	if err != nil {
 		return nil, err
 	}
 
+	s.stateStore, err = dstore.NewSimpleStore(destFolder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize store at path %s: %w", destFolder, err)
+	}
+
 	for _, entity := range entities {
-		fb, err := getBundler(entity, s.Sinker.BlockRange().StartBlock(), s.stopBlock, bundleSize, bufferSize, baseOutputStore, workingDir, logger)
+		fb, err := getBundler(entity, s.Sinker.BlockRange().StartBlock(), s.stopBlock, bundleSize, bufferSize, s.fileType, baseOutputStore, workingDir, logger)
 		if err != nil {
 			return nil, err
 		}
 		s.fileBundlers[entity] = fb
+		s.refBundler = fb
 	}
 
-	poiBundler, err := getBundler(schema.PoiEntityName, s.Sinker.BlockRange().StartBlock(), s.stopBlock, bundleSize, bufferSize, baseOutputStore, workingDir, logger)
-	if err != nil {
-		return nil, err
+	if !s.deferPOI {
+		poiBundler, err := getBundler(schema.PoiEntityName, s.Sinker.BlockRange().StartBlock(), s.stopBlock, bundleSize, bufferSize, s.fileType, baseOutputStore, workingDir, logger)
+		if err != nil {
+			return nil, err
+		}
+		s.poiBundler = poiBundler
+		s.refBundler = poiBundler
+	}
+
+	if s.refBundler == nil {
+		return nil, fmt.Errorf("no entity to sink")
 	}
-	s.poiBundler = poiBundler
 
 	return s, nil
 }
 
-func getBundler(entity string, startBlock, stopBlock, bundleSize, bufferSize uint64, baseOutputStore dstore.Store, workingDir string, logger *zap.Logger) (*bundler.Bundler, error) {
+func getBundler(entity string, startBlock, stopBlock, bundleSize, bufferSize uint64, fileType writer.FileType, baseOutputStore dstore.Store, workingDir string, logger *zap.Logger) (*bundler.Bundler, error) {
 	boundaryWriter := writer.NewBufferedIO(
 		bufferSize,
 		filepath.Join(workingDir, entity),
-		writer.FileTypeJSONL,
+		fileType,
 		logger.With(zap.String("entity_name", entity)),
 	)
 	subStore, err := baseOutputStore.SubStore(entity)
@@ -128,8 +177,10 @@ func (s *EntitiesSink) CloseAllFileBundlers(err error) {
 			wg.Done()
 		}()
 	}
-	s.poiBundler.Shutdown(err)
-	<-s.poiBundler.Terminated()
+	if s.poiBundler != nil {
+		s.poiBundler.Shutdown(err)
+		<-s.poiBundler.Terminated()
+	}
 	wg.Wait()
 }
 
@@ -142,6 +193,10 @@ func (s *EntitiesSink) Run(ctx context.Context) {
 			s.handleStopBlockReached(ctx)
 		}
 		s.CloseAllFileBundlers(err)
+		// All uploads are drained at this point, persist the last checkpoint reached
+		if err := s.saveStateIfUploaded(context.Background()); err != nil {
+			s.logger.Warn("could not save state", zap.Error(err))
+		}
 		s.stats.Close()
 		s.Sinker.Shutdown(err)
 	})
@@ -159,21 +214,48 @@ func (s *EntitiesSink) Run(ctx context.Context) {
 	for _, fb := range s.fileBundlers {
 		fb.Launch(uploadContext)
 	}
-	s.poiBundler.Launch(uploadContext)
+	if s.poiBundler != nil {
+		s.poiBundler.Launch(uploadContext)
+	}
+
+	s.Sinker.Run(ctx, s.startCursor, &completionHandler{
+		SinkerHandler: sink.NewSinkerHandlers(s.handleBlockScopedData, s.handleBlockUndoSignal),
+		onCompletion:  s.handleBlockRangeCompletion,
+	})
+}
+
+type completionHandler struct {
+	sink.SinkerHandler
+	onCompletion func(ctx context.Context, cursor *sink.Cursor) error
+}
+
+func (h *completionHandler) HandleBlockRangeCompletion(ctx context.Context, cursor *sink.Cursor) error {
+	return h.onCompletion(ctx, cursor)
+}
 
-	s.Sinker.Run(ctx, nil, sink.NewSinkerHandlers(s.handleBlockScopedData, s.handleBlockUndoSignal))
+func (s *EntitiesSink) handleBlockRangeCompletion(_ context.Context, _ *sink.Cursor) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	s.completed = true
+	return nil
 }
 
 func (s *EntitiesSink) handleStopBlockReached(ctx context.Context) error {
 	s.rollAllBundlers(ctx, s.stopBlock)
 
-	store, err := dstore.NewSimpleStore(s.destFolder)
-	if err != nil {
-		return fmt.Errorf("failed to initialize store at path %s: %w", s.destFolder, err)
+	s.stateLock.Lock()
+	if s.completed {
+		s.pendingStates = append(s.pendingStates, s.newState(s.stopBlock))
 	}
-	lastBlockAndHash := fmt.Sprintf("%d:%s\n", s.stats.lastBlock, s.stats.lastBlockHash)
-	if err := store.WriteObject(context.Background(), "last_block.txt", bytes.NewReader([]byte(lastBlockAndHash))); err != nil {
-		s.logger.Warn("could not write last block")
+	s.stateLock.Unlock()
+
+	if !s.writeLastBlock {
+		return nil
+	}
+
+	if err := WriteLastBlock(context.Background(), s.destFolder, s.stats.lastBlock, s.stats.lastBlockHash); err != nil {
+		s.logger.Warn("could not write last block", zap.Error(err))
 	}
 
 	return nil
@@ -196,7 +278,9 @@ func (s *EntitiesSink) rollAllBundlers(ctx context.Context, blockNum uint64) {
 		}()
 	}
 
-	s.poiBundler.Roll(ctx, blockNum)
+	if s.poiBundler != nil {
+		s.poiBundler.Roll(ctx, blockNum)
+	}
 	wg.Wait()
 }
 
@@ -224,92 +308,143 @@ func (s *EntitiesSink) handleBlockScopedData(ctx context.Context, data *pbsubstr
 		}
 	}
 
+	activeBoundary := s.refBundler.ActiveBoundary()
+	boundaryCrossed := activeBoundary != nil && !activeBoundary.Contains(data.Clock.Number)
+
 	s.rollAllBundlers(ctx, data.Clock.Number)
 	if s.IsTerminating() {
 		return nil
 	}
 
-	proofOfIndexing := poi.NewProofOfIndexing(data.Clock.Number, poi.VersionFast)
+	if boundaryCrossed {
+		// Everything below the new active boundary is now closed, it becomes our next
+		// checkpoint once uploaded. Cursor and POI are still the ones of the previous block.
+		s.stateLock.Lock()
+		s.pendingStates = append(s.pendingStates, s.newState(s.refBundler.ActiveBoundary().StartBlock()))
+		s.stateLock.Unlock()
+	}
 
-	for _, change := range entityChanges.EntityChanges {
-		jsonlChange, err := bundler.JSONLEncodeAny(&graphload.EntityChangeAtBlockNum{
-			EntityChange: change,
-			BlockNum:     data.Clock.Number,
-		})
-		if err != nil {
-			return err
-		}
+	if err := s.saveStateIfUploaded(ctx); err != nil {
+		return fmt.Errorf("save state: %w", err)
+	}
 
+	var proofOfIndexing *poi.ProofOfIndexing
+	if !s.deferPOI {
+		proofOfIndexing = poi.NewProofOfIndexing(data.Clock.Number, poi.VersionFast)
+	}
+
+	for i, change := range entityChanges.EntityChanges {
 		entity := schema.NormalizeField(change.Entity)
 		entityBundler, ok := s.fileBundlers[entity]
 		if !ok {
 			return fmt.Errorf("cannot get bundler writer for entity %s", entity)
 		}
-		entityBundler.Writer().Write(jsonlChange)
 
-		if err := addEntityChangeToPOI(proofOfIndexing, change); err != nil {
-			return fmt.Errorf("entity change POI: %w", err)
+		if err := entityBundler.WriteEntityChange(&graphload.EntityChangeAtBlockNum{
+			EntityChange: change,
+			BlockNum:     data.Clock.Number,
+			Index:        uint64(i),
+		}); err != nil {
+			return fmt.Errorf("write entity change: %w", err)
 		}
-	}
 
-	poi, err := proofOfIndexing.Pause(s.lastPOI)
-	if err != nil {
-		return fmt.Errorf("pause proof of indexing: %w", err)
+		if proofOfIndexing != nil {
+			if err := proofOfIndexing.AddEntityChange(change); err != nil {
+				return fmt.Errorf("entity change POI: %w", err)
+			}
+		}
 	}
 
-	if !bytes.Equal(poi, s.lastPOI) {
-		poiEntity := getPOIEntity(poi, s.chainID, data.Clock.Number)
-		jsonlPOI, err := bundler.JSONLEncodeAny(poiEntity)
-		if err != nil {
+	if proofOfIndexing != nil {
+		if err := s.writePOI(proofOfIndexing, data.Clock.Number); err != nil {
 			return err
 		}
-		s.poiBundler.Writer().Write(jsonlPOI)
-
-		s.lastPOI = poi
 	}
 	s.stats.RecordBlock(cursor.Block().Num())
 	s.stats.RecordLastBlockHash(cursor.Block().ID())
+	s.lastCursor = cursor
 
 	return nil
 }
 
-func addEntityChangeToPOI(proofOfIndexing *poi.ProofOfIndexing, change *pbentity.EntityChange) error {
-	switch change.Operation {
-	case pbentity.EntityChange_OPERATION_CREATE, pbentity.EntityChange_OPERATION_UPDATE, pbentity.EntityChange_OPERATION_FINAL:
-		proofOfIndexing.SetEntity(change)
+func (s *EntitiesSink) writePOI(proofOfIndexing *poi.ProofOfIndexing, blockNum uint64) error {
+	digest, err := proofOfIndexing.Pause(s.lastPOI)
+	if err != nil {
+		return fmt.Errorf("pause proof of indexing: %w", err)
+	}
 
-	case pbentity.EntityChange_OPERATION_DELETE:
-		proofOfIndexing.RemoveEntity(change)
+	if !bytes.Equal(digest, s.lastPOI) {
+		if err := s.poiBundler.WriteEntityChange(poi.NewDigestEntityChange(digest, s.chainID, blockNum)); err != nil {
+			return fmt.Errorf("write POI: %w", err)
+		}
 
-	case pbentity.EntityChange_OPERATION_UNSPECIFIED:
-		return fmt.Errorf("received %q operation which is should never be sent", change.Operation)
+		s.lastPOI = digest
 	}
 
 	return nil
 }
 
-func (s *EntitiesSink) handleBlockUndoSignal(ctx context.Context, data *pbsubstreamsrpc.BlockUndoSignal, cursor *sink.Cursor) error {
-	return fmt.Errorf("received undo signal: should not happen, substreams connection should be 'final-blocks-only'")
+func (s *EntitiesSink) newState(blockNum uint64) *State {
+	return &State{
+		Cursor:      s.lastCursor.String(),
+		BlockNum:    blockNum,
+		BundleSize:  s.bundleSize,
+		FileType:    s.fileType,
+		Compression: s.compression,
+		LastPOI:     s.lastPOI,
+	}
 }
 
-func getPOIEntity(digest []byte, chainID string, blockNum uint64) *graphload.EntityChangeAtBlockNum {
-	return &graphload.EntityChangeAtBlockNum{
-		BlockNum: blockNum,
-		EntityChange: &pbentity.EntityChange{
-			Entity: schema.PoiEntityName,
-			Id:     chainID,
-			// Ordinal
-			Operation: pbentity.EntityChange_OPERATION_UPDATE,
-			Fields: []*pbentity.Field{
-				{
-					Name: "digest",
-					NewValue: &pbentity.Value{
-						Typed: &pbentity.Value_Bytes{
-							Bytes: base64.StdEncoding.EncodeToString(digest),
-						},
-					},
-				},
-			},
-		},
+// saveStateIfUploaded persists the newest pending state whose block every bundler
+// has uploaded all its bundles up to, dropping the older ones.
+func (s *EntitiesSink) saveStateIfUploaded(ctx context.Context) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	if len(s.pendingStates) == 0 {
+		return nil
 	}
+
+	entities := make(map[string]uint64, len(s.fileBundlers)+1)
+	for entity, fb := range s.fileBundlers {
+		entities[entity] = fb.UploadedUpTo()
+	}
+	if s.poiBundler != nil {
+		entities[schema.PoiEntityName] = s.poiBundler.UploadedUpTo()
+	}
+
+	state, remaining := popUploadedState(s.pendingStates, entities)
+	if state == nil {
+		return nil
+	}
+
+	state.Entities = entities
+	if err := state.save(ctx, s.stateStore, s.stateFilename); err != nil {
+		return err
+	}
+
+	s.logger.Debug("state saved", zap.Uint64("block_num", state.BlockNum), zap.Int("pending_states", len(remaining)))
+	s.pendingStates = remaining
+	return nil
+}
+
+// popUploadedState returns the newest of the pending states, oldest first, whose
+// block is at or below the uploaded end block of every entity, and the states
+// following it. It returns nil and pending as is if there is none.
+func popUploadedState(pending []*State, uploadedUpTo map[string]uint64) (*State, []*State) {
+	uploaded := len(pending)
+	for _, upTo := range uploadedUpTo {
+		for uploaded > 0 && pending[uploaded-1].BlockNum > upTo {
+			uploaded--
+		}
+	}
+
+	if uploaded == 0 {
+		return nil, pending
+	}
+	return pending[uploaded-1], pending[uploaded:]
+}
+
+func (s *EntitiesSink) handleBlockUndoSignal(ctx context.Context, data *pbsubstreamsrpc.BlockUndoSignal, cursor *sink.Cursor) error {
+	return fmt.Errorf("received undo signal: should not happen, substreams connection should be 'final-blocks-only'")
 }
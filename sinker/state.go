@@ -0,0 +1,107 @@
+package sinker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
+)
+
+const StateFilename = "state.json"
+
+// SegmentStateFilename is the name of the state file persisted by the sink
+// streaming the [startBlock, stopBlock) segment of a segmented `run`.
+func SegmentStateFilename(startBlock, stopBlock uint64) string {
+	return fmt.Sprintf("state-%010d-%010d.json", startBlock, stopBlock)
+}
+
+// State is the checkpoint persisted in the destination folder so that an
+// interrupted `run` can resume from the last bundle boundary that was fully
+// uploaded, for every entity, without duplicating nor losing any line.
+type State struct {
+	// Cursor is the Substreams cursor of the last block processed before BlockNum,
+	// blank if no block was processed before it.
+	Cursor string `json:"cursor"`
+	// BlockNum is the next block to process, every bundle ending at or below it has
+	// been uploaded.
+	BlockNum   uint64 `json:"block_num"`
+	BundleSize uint64 `json:"bundle_size"`
+	// FileType and Compression are the ones of the bundles written so far, blank in
+	// states persisted before they were recorded, which were always gzipped JSONL.
+	FileType    writer.FileType  `json:"file_type,omitempty"`
+	Compression compression.Type `json:"compression,omitempty"`
+	// LastPOI is the proof of indexing digest as of BlockNum - 1.
+	LastPOI []byte `json:"last_poi"`
+	// Entities holds, for each entity (including the POI one), the exclusive end
+	// block of the last bundle uploaded.
+	Entities map[string]uint64 `json:"entities"`
+}
+
+// LoadState reads the state persisted under filename in the destination folder,
+// returning nil if none exists.
+func LoadState(ctx context.Context, destFolder string, filename string) (*State, error) {
+	store, err := dstore.NewSimpleStore(destFolder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize store at path %s: %w", destFolder, err)
+	}
+
+	reader, err := store.OpenObject(ctx, filename)
+	if err != nil {
+		if errors.Is(err, dstore.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open state: %w", err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("unmarshal state %q: %w", store.ObjectPath(filename), err)
+	}
+
+	return state, nil
+}
+
+// CheckFormat returns an error if the bundles written before the state are not of
+// fileType compressed with t, resuming would mix both formats in the same folder.
+func (s *State) CheckFormat(fileType writer.FileType, t compression.Type) error {
+	stateFileType, stateCompression := s.FileType, s.Compression
+	if stateFileType == "" {
+		stateFileType = writer.FileTypeJSONL
+	}
+	if stateCompression == "" {
+		stateCompression = compression.Gzip
+	}
+
+	if stateFileType != fileType {
+		return fmt.Errorf("state from previous run was produced with file type %q, cannot resume with file type %q", stateFileType, fileType)
+	}
+	if stateCompression != t {
+		return fmt.Errorf("state from previous run was produced with compression %q, cannot resume with compression %q", stateCompression, t)
+	}
+	return nil
+}
+
+func (s *State) save(ctx context.Context, store dstore.Store, filename string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	if err := store.WriteObject(ctx, filename, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+
+	return nil
+}
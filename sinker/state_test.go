@@ -0,0 +1,81 @@
+package sinker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-graph-load/bundler/writer"
+	"github.com/streamingfast/substreams-graph-load/compression"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestState_SaveAndLoad(t *testing.T) {
+	destFolder := t.TempDir()
+
+	state, err := LoadState(context.Background(), destFolder, StateFilename)
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	store, err := dstore.NewSimpleStore(destFolder)
+	require.NoError(t, err)
+
+	expected := &State{
+		Cursor:      "cursor",
+		BlockNum:    2000,
+		BundleSize:  1000,
+		FileType:    writer.FileTypeProtobuf,
+		Compression: compression.Zstd,
+		LastPOI:     []byte{0x01, 0x02, 0x03},
+		Entities:    map[string]uint64{"pool": 2000, "poi2$": 3000},
+	}
+	require.NoError(t, expected.save(context.Background(), store, StateFilename))
+
+	state, err = LoadState(context.Background(), destFolder, StateFilename)
+	require.NoError(t, err)
+	assert.Equal(t, expected, state)
+}
+
+func TestState_CheckFormat(t *testing.T) {
+	state := &State{FileType: writer.FileTypeProtobuf, Compression: compression.Zstd}
+	assert.NoError(t, state.CheckFormat(writer.FileTypeProtobuf, compression.Zstd))
+	assert.Error(t, state.CheckFormat(writer.FileTypeJSONL, compression.Zstd))
+	assert.Error(t, state.CheckFormat(writer.FileTypeProtobuf, compression.Gzip))
+
+	// States persisted before the format was recorded were always gzipped JSONL
+	legacy := &State{}
+	assert.NoError(t, legacy.CheckFormat(writer.FileTypeJSONL, compression.Gzip))
+	assert.Error(t, legacy.CheckFormat(writer.FileTypeJSONL, compression.Zstd))
+}
+
+func TestReadLastBlock(t *testing.T) {
+	destFolder := t.TempDir()
+
+	_, _, err := ReadLastBlock(context.Background(), destFolder)
+	require.ErrorIs(t, err, dstore.ErrNotFound)
+
+	require.NoError(t, WriteLastBlock(context.Background(), destFolder, 17229999, "0bdf3e28"))
+
+	blockNum, blockHash, err := ReadLastBlock(context.Background(), destFolder)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(17229999), blockNum)
+	assert.Equal(t, "0bdf3e28", blockHash)
+}
+
+func TestPopUploadedState(t *testing.T) {
+	pending := []*State{{BlockNum: 1000}, {BlockNum: 2000}, {BlockNum: 3000}}
+
+	state, remaining := popUploadedState(pending, map[string]uint64{"pool": 500, "poi2$": 3000})
+	assert.Nil(t, state)
+	assert.Equal(t, pending, remaining)
+
+	// Uploads lagging several boundaries behind still save the newest uploaded one
+	state, remaining = popUploadedState(pending, map[string]uint64{"pool": 2500, "poi2$": 3000})
+	assert.Equal(t, pending[1], state)
+	assert.Equal(t, pending[2:], remaining)
+
+	state, remaining = popUploadedState(pending, map[string]uint64{"pool": 3000, "poi2$": 3000})
+	assert.Equal(t, pending[2], state)
+	assert.Empty(t, remaining)
+}
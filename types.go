@@ -5,4 +5,7 @@ import pbentity "github.com/streamingfast/substreams-sink-entity-changes/pb/sf/s
 type EntityChangeAtBlockNum struct {
 	EntityChange *pbentity.EntityChange `json:"entity_change,omitempty"`
 	BlockNum     uint64                 `json:"block_num,omitempty"`
+	// Index is the position of the change within its block's entity changes, across
+	// all entities, it is required to recompute the POI from per-entity bundles.
+	Index uint64 `json:"index,omitempty"`
 }
@@ -0,0 +1,311 @@
+package verify
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/shabbyrobe/go-num"
+	"github.com/streamingfast/substreams-graph-load/schema"
+	"github.com/streamingfast/substreams-graph-load/stablehash"
+)
+
+// Row is a row of an entity table, identified by its ID and the lower block of its
+// block range, with the digest of its normalized content.
+type Row struct {
+	ID         string
+	LowerBlock uint64
+	Digest     num.U128
+}
+
+// RowDigester computes the digest of the rows of an entity table, whether read from
+// the CSV files or back from Postgres. Values are normalized according to the types
+// of the GraphQL schema so both representations of a row have the same digest.
+type RowDigester struct {
+	header    []string
+	fields    []*schema.Field
+	immutable bool
+	stopBlock uint64
+}
+
+// NewRowDigester creates the digester of rows with the columns of header, the CSV
+// header of the entity. Block ranges ending at or after stopBlock are considered
+// open, as they are in the CSV files produced up to stopBlock.
+func NewRowDigester(desc *schema.EntityDesc, header []string, stopBlock uint64) (*RowDigester, error) {
+	if len(header) < 2 || header[0] != "id" || (header[1] != "block_range" && header[1] != "block$") {
+		return nil, fmt.Errorf("invalid header, expected 'id' followed by 'block_range' or 'block$'")
+	}
+
+	d := &RowDigester{
+		header:    header,
+		fields:    make([]*schema.Field, len(header)),
+		immutable: header[1] == "block$",
+		stopBlock: stopBlock,
+	}
+	for i, name := range header {
+		if i == 1 {
+			continue
+		}
+
+		field, found := desc.Fields[name]
+		if !found {
+			return nil, fmt.Errorf("column %q is not a field of entity %q", name, desc.Name)
+		}
+		d.fields[i] = field
+	}
+
+	return d, nil
+}
+
+// Header returns the columns of the rows, in the order their values are expected.
+func (d *RowDigester) Header() []string {
+	return d.header
+}
+
+// CSVValues converts a CSV record to the values of a row the way COPY does, an empty
+// unquoted value of a nullable column being NULL.
+func (d *RowDigester) CSVValues(record []string) ([]*string, error) {
+	if len(record) != len(d.header) {
+		return nil, fmt.Errorf("record has %d columns, expected %d", len(record), len(d.header))
+	}
+
+	out := make([]*string, len(record))
+	for i := range record {
+		if record[i] == "" && d.fields[i] != nil && d.fields[i].Nullable && d.fields[i].Name != "id" {
+			continue
+		}
+		out[i] = &record[i]
+	}
+	return out, nil
+}
+
+// LowerBlock returns the first block of the row, cheaper than Digest when only
+// counting rows.
+func (d *RowDigester) LowerBlock(values []*string) (uint64, error) {
+	lower, _, _, err := d.blockRange(values)
+	return lower, err
+}
+
+// Digest returns the row with the digest of its values, NULL ones being nil.
+func (d *RowDigester) Digest(values []*string) (*Row, error) {
+	if len(values) != len(d.header) {
+		return nil, fmt.Errorf("row has %d values, expected %d", len(values), len(d.header))
+	}
+	if values[0] == nil {
+		return nil, fmt.Errorf("row has no id")
+	}
+
+	lower, upper, open, err := d.blockRange(values)
+	if err != nil {
+		return nil, fmt.Errorf("row %q: %w", *values[0], err)
+	}
+
+	id := *values[0]
+	if d.fields[0].Type == schema.FieldTypeBytes {
+		// Postgres renders bytea as '\x' prefixed hex
+		id = `\x` + strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(id, `\x`), "0x"))
+	}
+
+	digest := &rowDigest{
+		id:    stablehash.String(id),
+		lower: stablehash.U64(lower),
+		data:  make(stablehash.Map[string, stablehash.Hashable], len(values)-2),
+	}
+	if !open {
+		digest.upper = stablehash.Some(stablehash.U64(upper))
+	}
+
+	for i := 2; i < len(values); i++ {
+		if values[i] == nil {
+			continue
+		}
+
+		hashable, err := normalizeValue(*values[i], d.fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("row %q, column %q: %w", *values[0], d.header[i], err)
+		}
+		digest.data[d.header[i]] = hashable
+	}
+
+	return &Row{
+		ID:         id,
+		LowerBlock: lower,
+		Digest:     stablehash.FastHash(digest),
+	}, nil
+}
+
+func (d *RowDigester) blockRange(values []*string) (lower, upper uint64, open bool, err error) {
+	if values[1] == nil {
+		return 0, 0, false, fmt.Errorf("no %s", d.header[1])
+	}
+	in := *values[1]
+
+	if d.immutable {
+		lower, err = strconv.ParseUint(in, 10, 64)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("invalid block %q", in)
+		}
+		return lower, 0, true, nil
+	}
+
+	// Both tocsv and Postgres render int4range as '[lower,upper)' or '[lower,)'
+	if !strings.HasPrefix(in, "[") || !strings.HasSuffix(in, ")") {
+		return 0, 0, false, fmt.Errorf("invalid block range %q", in)
+	}
+	bounds := in[1 : len(in)-1]
+	lowerPart, upperPart, found := strings.Cut(bounds, ",")
+	if !found {
+		return 0, 0, false, fmt.Errorf("invalid block range %q", in)
+	}
+
+	if lower, err = strconv.ParseUint(lowerPart, 10, 64); err != nil {
+		return 0, 0, false, fmt.Errorf("invalid block range %q", in)
+	}
+	if upperPart == "" {
+		return lower, 0, true, nil
+	}
+	if upper, err = strconv.ParseUint(upperPart, 10, 64); err != nil {
+		return 0, 0, false, fmt.Errorf("invalid block range %q", in)
+	}
+
+	// Rows open at the stop block of the CSV files may have been closed since by an
+	// incremental load of the following range
+	if upper >= d.stopBlock {
+		return lower, 0, true, nil
+	}
+	return lower, upper, false, nil
+}
+
+type rowDigest struct {
+	id    stablehash.String
+	lower stablehash.U64
+	upper stablehash.Optional[stablehash.U64]
+	data  stablehash.Map[string, stablehash.Hashable]
+}
+
+func (r *rowDigest) StableHash(addr stablehash.FieldAddress, hasher stablehash.Hasher) {
+	r.id.StableHash(addr.Child(0), hasher)
+	r.lower.StableHash(addr.Child(1), hasher)
+	r.upper.StableHash(addr.Child(2), hasher)
+	r.data.StableHash(addr.Child(3), hasher)
+}
+
+func normalizeValue(in string, field *schema.Field) (stablehash.Hashable, error) {
+	if !field.Array {
+		return normalizeScalar(in, field.Type)
+	}
+
+	elements, err := parseArray(in)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(stablehash.List[*stablehash.Optional[stablehash.Hashable]], len(elements))
+	for i, elem := range elements {
+		if elem == nil {
+			none := stablehash.None[stablehash.Hashable]()
+			out[i] = &none
+			continue
+		}
+
+		hashable, err := normalizeScalar(*elem, field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		some := stablehash.Some(hashable)
+		out[i] = &some
+	}
+	return out, nil
+}
+
+func normalizeScalar(in string, fieldType schema.FieldType) (stablehash.Hashable, error) {
+	switch fieldType {
+	case schema.FieldTypeInt:
+		v, err := strconv.ParseInt(in, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Int %q", in)
+		}
+		return stablehash.I32(v), nil
+	case schema.FieldTypeBigInt:
+		v, ok := new(big.Int).SetString(in, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid BigInt %q", in)
+		}
+		return (*stablehash.BigInt)(v), nil
+	case schema.FieldTypeBigDecimal:
+		v, err := stablehash.NewBigDecimalFromString(in)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BigDecimal %q: %w", in, err)
+		}
+		return v, nil
+	case schema.FieldTypeBoolean:
+		v, err := strconv.ParseBool(in)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Boolean %q", in)
+		}
+		return stablehash.Bool(v), nil
+	case schema.FieldTypeBytes:
+		v, err := hex.DecodeString(strings.TrimPrefix(in, `\x`))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Bytes %q", in)
+		}
+		return stablehash.Bytes(v), nil
+	}
+
+	// IDs, strings, references to other entities and enums, a reference to an entity
+	// whose id is Bytes is in the same '\x' form on both sides
+	return stablehash.String(in), nil
+}
+
+// parseArray parses a Postgres array literal like '{a,"b c",NULL}', NULL elements
+// being nil.
+func parseArray(in string) ([]*string, error) {
+	if !strings.HasPrefix(in, "{") || !strings.HasSuffix(in, "}") {
+		return nil, fmt.Errorf("invalid array %q", in)
+	}
+	inner := in[1 : len(in)-1]
+	if inner == "" {
+		return nil, nil
+	}
+
+	var out []*string
+	for i := 0; i <= len(inner); {
+		var elem strings.Builder
+		quoted := i < len(inner) && inner[i] == '"'
+		if quoted {
+			i++
+			for ; i < len(inner) && inner[i] != '"'; i++ {
+				if inner[i] == '\\' {
+					i++
+					if i == len(inner) {
+						break
+					}
+				}
+				elem.WriteByte(inner[i])
+			}
+			if i >= len(inner) {
+				return nil, fmt.Errorf("invalid array %q, unterminated quoted element", in)
+			}
+			i++
+		} else {
+			for ; i < len(inner) && inner[i] != ','; i++ {
+				elem.WriteByte(inner[i])
+			}
+		}
+
+		if i < len(inner) && inner[i] != ',' {
+			return nil, fmt.Errorf("invalid array %q, expected ',' at position %d", in, i+1)
+		}
+		i++
+
+		value := elem.String()
+		if !quoted && strings.EqualFold(value, "NULL") {
+			out = append(out, nil)
+			continue
+		}
+		out = append(out, &value)
+	}
+	return out, nil
+}
@@ -0,0 +1,104 @@
+package verify
+
+import (
+	"testing"
+
+	"github.com/streamingfast/substreams-graph-load/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntity() *schema.EntityDesc {
+	return &schema.EntityDesc{
+		Name: "pool",
+		Fields: map[string]*schema.Field{
+			"id":     {Name: "id", Type: schema.FieldTypeID},
+			"fee":    {Name: "fee", Type: schema.FieldTypeBigDecimal},
+			"active": {Name: "active", Type: schema.FieldTypeBoolean},
+			"owner":  {Name: "owner", Type: schema.FieldTypeBytes},
+			"names":  {Name: "names", Type: schema.FieldTypeString, Array: true, Nullable: true},
+			"label":  {Name: "label", Type: schema.FieldTypeString, Nullable: true},
+		},
+	}
+}
+
+func s(in string) *string {
+	return &in
+}
+
+func TestRowDigester_CSVMatchesDatabase(t *testing.T) {
+	digester, err := NewRowDigester(testEntity(), []string{"id", "block_range", "active", "fee", "label", "names", "owner"}, 100)
+	require.NoError(t, err)
+
+	csvValues, err := digester.CSVValues([]string{"a", "[10,)", "true", "1.50", "", `{"b c",d,NULL}`, `\xAB01`})
+	require.NoError(t, err)
+	csvRow, err := digester.Digest(csvValues)
+	require.NoError(t, err)
+
+	// As rendered by Postgres for the same row closed after the stop block
+	dbRow, err := digester.Digest([]*string{s("a"), s("[10,120)"), s("true"), s("1.50"), nil, s(`{"b c",d,NULL}`), s(`\xab01`)})
+	require.NoError(t, err)
+
+	assert.Equal(t, "a", csvRow.ID)
+	assert.Equal(t, uint64(10), csvRow.LowerBlock)
+	assert.Equal(t, csvRow, dbRow)
+
+	tests := []struct {
+		name   string
+		values []*string
+	}{
+		{"closed before stop block", []*string{s("a"), s("[10,50)"), s("true"), s("1.50"), nil, s(`{"b c",d,NULL}`), s(`\xab01`)}},
+		{"other value", []*string{s("a"), s("[10,)"), s("false"), s("1.50"), nil, s(`{"b c",d,NULL}`), s(`\xab01`)}},
+		{"empty string instead of null", []*string{s("a"), s("[10,)"), s("true"), s("1.50"), s(""), s(`{"b c",d,NULL}`), s(`\xab01`)}},
+		{"null array element", []*string{s("a"), s("[10,)"), s("true"), s("1.50"), nil, s(`{"b c",d,""}`), s(`\xab01`)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			row, err := digester.Digest(test.values)
+			require.NoError(t, err)
+			assert.NotEqual(t, csvRow.Digest, row.Digest)
+		})
+	}
+}
+
+func TestRowDigester_Immutable(t *testing.T) {
+	digester, err := NewRowDigester(testEntity(), []string{"id", "block$", "label"}, 100)
+	require.NoError(t, err)
+
+	row, err := digester.Digest([]*string{s("a"), s("42"), s("x")})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), row.LowerBlock)
+
+	_, err = NewRowDigester(testEntity(), []string{"id", "block$", "unknown"}, 100)
+	assert.EqualError(t, err, `column "unknown" is not a field of entity "pool"`)
+}
+
+func TestParseArray(t *testing.T) {
+	tests := []struct {
+		in          string
+		expected    []*string
+		expectedErr string
+	}{
+		{"{}", nil, ""},
+		{"{a}", []*string{s("a")}, ""},
+		{`{a,"b,c",NULL,"NULL",""}`, []*string{s("a"), s("b,c"), nil, s("NULL"), s("")}, ""},
+		{`{"a \"quoted\" \\x"}`, []*string{s(`a "quoted" \x`)}, ""},
+		{"a,b", nil, `invalid array "a,b"`},
+		{"a}", nil, `invalid array "a}"`},
+		{`{"a}`, nil, `invalid array "{\"a}", unterminated quoted element`},
+		{`{"a"b}`, nil, `invalid array "{\"a\"b}", expected ',' at position 4`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			actual, err := parseArray(test.in)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package verify
+
+import (
+	"sort"
+
+	"github.com/shabbyrobe/go-num"
+)
+
+// RangeStats aggregates the rows whose lower block falls in a block range. The digest
+// is the sum of the rows' digests so it does not depend on their order.
+type RangeStats struct {
+	Count  uint64
+	Digest num.U128
+}
+
+// TableStats holds the stats of a table per block range, keyed by the first block of
+// each range. Ranges are aligned on a multiple of their size.
+type TableStats struct {
+	rangeSize uint64
+	ranges    map[uint64]*RangeStats
+}
+
+func NewTableStats(rangeSize uint64) *TableStats {
+	return &TableStats{rangeSize: rangeSize, ranges: make(map[uint64]*RangeStats)}
+}
+
+// RangeStart returns the first block of the range containing blockNum.
+func (s *TableStats) RangeStart(blockNum uint64) uint64 {
+	return blockNum - blockNum%s.rangeSize
+}
+
+func (s *TableStats) RangeSize() uint64 {
+	return s.rangeSize
+}
+
+func (s *TableStats) rangeAt(start uint64) *RangeStats {
+	stats, found := s.ranges[start]
+	if !found {
+		stats = &RangeStats{}
+		s.ranges[start] = stats
+	}
+	return stats
+}
+
+// Count adds count rows to the range starting at rangeStart.
+func (s *TableStats) Count(rangeStart uint64, count uint64) {
+	s.rangeAt(rangeStart).Count += count
+}
+
+// Add adds the row to the range containing its lower block.
+func (s *TableStats) Add(row *Row) {
+	stats := s.rangeAt(s.RangeStart(row.LowerBlock))
+	stats.Count++
+	stats.Digest = stats.Digest.Add(row.Digest)
+}
+
+func (s *TableStats) Total() (out uint64) {
+	for _, stats := range s.ranges {
+		out += stats.Count
+	}
+	return out
+}
+
+// RangeDiff is a block range whose rows differ between the CSV files and the database.
+type RangeDiff struct {
+	Start         uint64
+	CSVCount      uint64
+	DBCount       uint64
+	DigestDiffers bool
+}
+
+// CompareRanges returns the ranges whose row count, or digest when withDigest is set,
+// differ between csv and db, ordered by block.
+func CompareRanges(csv, db *TableStats, withDigest bool) (out []*RangeDiff) {
+	starts := map[uint64]bool{}
+	for start := range csv.ranges {
+		starts[start] = true
+	}
+	for start := range db.ranges {
+		starts[start] = true
+	}
+
+	for start := range starts {
+		csvStats, dbStats := csv.rangeAt(start), db.rangeAt(start)
+		digestDiffers := withDigest && csvStats.Digest != dbStats.Digest
+		if csvStats.Count != dbStats.Count || digestDiffers {
+			out = append(out, &RangeDiff{
+				Start:         start,
+				CSVCount:      csvStats.Count,
+				DBCount:       dbStats.Count,
+				DigestDiffers: digestDiffers,
+			})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+	return out
+}
+
+type RowDiffKind string
+
+const (
+	RowOnlyInCSV      RowDiffKind = "only in CSV files"
+	RowOnlyInDatabase RowDiffKind = "only in database"
+	RowContentDiffers RowDiffKind = "content differs"
+)
+
+// RowDiff is a row that differs between the CSV files and the database.
+type RowDiff struct {
+	ID         string
+	LowerBlock uint64
+	Kind       RowDiffKind
+}
+
+type rowKey struct {
+	id         string
+	lowerBlock uint64
+}
+
+// DiffRows compares the rows of the CSV files with the ones of the database, matched
+// by ID and lower block, and returns at most max differing ones ordered by ID.
+func DiffRows(csvRows, dbRows []*Row, max int) []*RowDiff {
+	dbByKey := make(map[rowKey]*Row, len(dbRows))
+	for _, row := range dbRows {
+		dbByKey[rowKey{row.ID, row.LowerBlock}] = row
+	}
+
+	var out []*RowDiff
+	for _, row := range csvRows {
+		key := rowKey{row.ID, row.LowerBlock}
+		dbRow, found := dbByKey[key]
+		switch {
+		case !found:
+			out = append(out, &RowDiff{ID: row.ID, LowerBlock: row.LowerBlock, Kind: RowOnlyInCSV})
+		case dbRow.Digest != row.Digest:
+			out = append(out, &RowDiff{ID: row.ID, LowerBlock: row.LowerBlock, Kind: RowContentDiffers})
+		}
+		delete(dbByKey, key)
+	}
+	for _, row := range dbByKey {
+		out = append(out, &RowDiff{ID: row.ID, LowerBlock: row.LowerBlock, Kind: RowOnlyInDatabase})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ID != out[j].ID {
+			return out[i].ID < out[j].ID
+		}
+		return out[i].LowerBlock < out[j].LowerBlock
+	})
+	if len(out) > max {
+		out = out[:max]
+	}
+	return out
+}
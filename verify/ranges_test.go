@@ -0,0 +1,52 @@
+package verify
+
+import (
+	"testing"
+
+	"github.com/shabbyrobe/go-num"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareRanges(t *testing.T) {
+	csv, db := NewTableStats(10), NewTableStats(10)
+
+	csv.Add(&Row{ID: "a", LowerBlock: 1, Digest: num.U128From64(1)})
+	csv.Add(&Row{ID: "b", LowerBlock: 12, Digest: num.U128From64(2)})
+	csv.Add(&Row{ID: "c", LowerBlock: 25, Digest: num.U128From64(3)})
+
+	db.Add(&Row{ID: "a", LowerBlock: 1, Digest: num.U128From64(1)})
+	db.Add(&Row{ID: "b", LowerBlock: 12, Digest: num.U128From64(4)})
+	db.Add(&Row{ID: "d", LowerBlock: 31, Digest: num.U128From64(5)})
+
+	assert.Equal(t, []*RangeDiff{
+		{Start: 20, CSVCount: 1, DBCount: 0},
+		{Start: 30, CSVCount: 0, DBCount: 1},
+	}, CompareRanges(csv, db, false))
+
+	assert.Equal(t, []*RangeDiff{
+		{Start: 10, CSVCount: 1, DBCount: 1, DigestDiffers: true},
+		{Start: 20, CSVCount: 1, DBCount: 0, DigestDiffers: true},
+		{Start: 30, CSVCount: 0, DBCount: 1, DigestDiffers: true},
+	}, CompareRanges(csv, db, true))
+}
+
+func TestDiffRows(t *testing.T) {
+	csvRows := []*Row{
+		{ID: "a", LowerBlock: 1, Digest: num.U128From64(1)},
+		{ID: "b", LowerBlock: 2, Digest: num.U128From64(2)},
+		{ID: "c", LowerBlock: 3, Digest: num.U128From64(3)},
+	}
+	dbRows := []*Row{
+		{ID: "c", LowerBlock: 3, Digest: num.U128From64(3)},
+		{ID: "b", LowerBlock: 2, Digest: num.U128From64(20)},
+		{ID: "a", LowerBlock: 4, Digest: num.U128From64(1)},
+	}
+
+	assert.Equal(t, []*RowDiff{
+		{ID: "a", LowerBlock: 1, Kind: RowOnlyInCSV},
+		{ID: "a", LowerBlock: 4, Kind: RowOnlyInDatabase},
+		{ID: "b", LowerBlock: 2, Kind: RowContentDiffers},
+	}, DiffRows(csvRows, dbRows, 10))
+
+	assert.Len(t, DiffRows(csvRows, dbRows, 2), 2)
+}